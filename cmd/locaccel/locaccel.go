@@ -44,19 +44,9 @@ func loadConfig(lookupEnv func(string) (string, bool)) (*config.Config, bool, er
 func startServer(conf *config.Config, logger *zerolog.Logger) {
 	logger.Info().Str("version", version.Get()).Msg("Running locaccel")
 
-	client := &http.Client{
-		Timeout: conf.HTTPClient.Timeout,
-		Transport: &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			MaxConnsPerHost:       20,
-			MaxIdleConnsPerHost:   10,
-			IdleConnTimeout:       90 * time.Second,
-			ResponseHeaderTimeout: conf.HTTPClient.HeadersTimeout,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+	client, err := server.NewHTTPClient(conf.HTTPClient)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to start server: can't setup the http client")
 	}
 
 	quotaLow, err := conf.Cache.GetQuotaLow()
@@ -68,7 +58,17 @@ func startServer(conf *config.Config, logger *zerolog.Logger) {
 		logger.Fatal().Err(err).Msg("Unable to get high quota for the cache.")
 	}
 
-	cache, err := httpclient.NewCache(conf.Cache.Path, quotaLow, quotaHigh, logger)
+	cache, err := httpclient.NewCache(
+		conf.Cache.Path,
+		quotaLow,
+		quotaHigh,
+		httpclient.Compression{
+			Enabled:      conf.Cache.Compression.Enabled,
+			MinSize:      conf.Cache.Compression.MinSize.Bytes,
+			ContentTypes: conf.Cache.Compression.ContentTypes,
+		},
+		logger,
+	)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("unable to start server: can't setup cache")
 	}
@@ -122,6 +122,9 @@ func startServer(conf *config.Config, logger *zerolog.Logger) {
 		logger.Panic().Err(err).Msg("An error occurred while shutting down the server")
 	}
 
+	logger.Info().Msg("Waiting for background requests to finish")
+	cachingClient.Wait()
+
 	logger.Info().Msg("Server shut down")
 }
 
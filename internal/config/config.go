@@ -11,49 +11,137 @@ import (
 	"github.com/benjaminschubert/locaccel/internal/units"
 )
 
+// StaleIfError configures when stale responses are served instead of errors
+type StaleIfError struct {
+	// MaxAge bounds how long a response can have been stale, for responses not
+	// specifying a stale-if-error directive. Unbounded if not set
+	MaxAge *time.Duration `yaml:"max_age"`
+	// StatusCodes are the upstream status codes considered as errors
+	StatusCodes []int `yaml:"status_codes"`
+	// AllowMustRevalidate allows serving responses requiring revalidation
+	AllowMustRevalidate bool `yaml:"allow_must_revalidate"`
+}
+
+// Caching configures how responses are cached for a given registry
+type Caching struct {
+	// StaleWhileRevalidate is the window during which a stale response is served
+	// while being revalidated in the background, for responses not specifying one
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	StaleIfError         StaleIfError  `yaml:"stale_if_error"`
+	// IgnoreClientNoCache prevents clients from forcing a revalidation
+	IgnoreClientNoCache bool `yaml:"ignore_client_no_cache"`
+	// NegativeTTL is how long responses for missing resources (404 and 410) are
+	// cached. They are not cached if not set
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	// PartitionByAuthorization caches the responses to requests with credentials
+	// separately for each of them, unless they are public. Private responses can
+	// then be cached without being served to anyone else
+	PartitionByAuthorization bool `yaml:"partition_by_authorization"`
+	// VerifyDigests checks that the files match the digests the registry promises
+	// for them before storing them, failing the responses otherwise. Verified
+	// files are then served for any request expecting the same digests
+	VerifyDigests bool `yaml:"verify_digests"`
+	// Rules override the freshness of responses for specific paths. The first
+	// matching rule applies
+	Rules []FreshnessRule
+}
+
+// UpstreamCachesPolicy configures how upstream caches are contacted
+type UpstreamCachesPolicy struct {
+	// HedgingDelay is how long to wait for an upstream cache to return headers
+	// before also trying the next one. They are tried one after the other if not set
+	HedgingDelay time.Duration `yaml:"hedging_delay"`
+	// OrderByLatency tries the fastest upstream caches first
+	OrderByLatency bool `yaml:"order_by_latency"`
+}
+
 type AnsibleGalaxy struct {
-	Upstream       string
-	Port           uint16
-	UpstreamCaches []SerializableURL `yaml:"upstream_caches"`
+	Upstream             string
+	Port                 uint16
+	UpstreamCaches       []SerializableURL    `yaml:"upstream_caches"`
+	UpstreamCachesPolicy UpstreamCachesPolicy `yaml:"upstream_caches_policy"`
+	Peers                []SerializableURL
+	Offline              bool
+	HTTPClient           *HTTPClientOverride `yaml:"http"`
+	Credentials          *Credentials
+	Caching              Caching
 }
 
 type GoProxy struct {
-	Upstream       string
-	SumDBURL       string `yaml:"sumdb_url"`
-	Port           uint16
-	UpstreamCaches []SerializableURL `yaml:"upstream_caches"`
+	Upstream string
+	SumDBURL string `yaml:"sumdb_url"`
+	// SumDBKey is the key with which the answers of the checksum database are
+	// signed, like in GOSUMDB. The one of sum.golang.org is used if not set
+	SumDBKey             string `yaml:"sumdb_key"`
+	Port                 uint16
+	UpstreamCaches       []SerializableURL    `yaml:"upstream_caches"`
+	UpstreamCachesPolicy UpstreamCachesPolicy `yaml:"upstream_caches_policy"`
+	Peers                []SerializableURL
+	Offline              bool
+	HTTPClient           *HTTPClientOverride `yaml:"http"`
+	Credentials          *Credentials
+	Caching              Caching
 }
 
 type NpmRegistry struct {
-	Upstream       string
-	Scheme         string
-	Port           uint16
-	UpstreamCaches []SerializableURL `yaml:"upstream_caches"`
+	Upstream             string
+	Scheme               string
+	Port                 uint16
+	UpstreamCaches       []SerializableURL    `yaml:"upstream_caches"`
+	UpstreamCachesPolicy UpstreamCachesPolicy `yaml:"upstream_caches_policy"`
+	Peers                []SerializableURL
+	Offline              bool
+	HTTPClient           *HTTPClientOverride `yaml:"http"`
+	Credentials          *Credentials
+	Caching              Caching
 }
 
 type OciRegistry struct {
-	Upstream       string
-	Port           uint16
-	UpstreamCaches []SerializableURL `yaml:"upstream_caches"`
+	Upstream             string
+	Port                 uint16
+	UpstreamCaches       []SerializableURL    `yaml:"upstream_caches"`
+	UpstreamCachesPolicy UpstreamCachesPolicy `yaml:"upstream_caches_policy"`
+	Peers                []SerializableURL
+	Offline              bool
+	HTTPClient           *HTTPClientOverride `yaml:"http"`
+	Credentials          *Credentials
+	Caching              Caching
 }
 
 type PyPIRegistry struct {
-	Upstream       string
-	CDN            string
-	Port           uint16
-	UpstreamCaches []SerializableURL `yaml:"upstream_caches"`
+	Upstream             string
+	CDN                  string
+	Port                 uint16
+	UpstreamCaches       []SerializableURL    `yaml:"upstream_caches"`
+	UpstreamCachesPolicy UpstreamCachesPolicy `yaml:"upstream_caches_policy"`
+	Peers                []SerializableURL
+	Offline              bool
+	HTTPClient           *HTTPClientOverride `yaml:"http"`
+	Credentials          *Credentials
+	Caching              Caching
 }
 
 type Proxy struct {
-	AllowedUpstreams []string `yaml:"allowed_upstreams"`
-	Port             uint16
-	UpstreamCaches   []SerializableURL `yaml:"upstream_caches"`
+	AllowedUpstreams     []string `yaml:"allowed_upstreams"`
+	Port                 uint16
+	UpstreamCaches       []SerializableURL    `yaml:"upstream_caches"`
+	UpstreamCachesPolicy UpstreamCachesPolicy `yaml:"upstream_caches_policy"`
+	Peers                []SerializableURL
+	Offline              bool
+	HTTPClient           *HTTPClientOverride `yaml:"http"`
+	Caching              Caching
 }
 
 type RubyGemRegistry struct {
-	Upstream       string
-	Port           uint16
-	UpstreamCaches []SerializableURL `yaml:"upstream_caches"`
+	Upstream             string
+	Port                 uint16
+	UpstreamCaches       []SerializableURL    `yaml:"upstream_caches"`
+	UpstreamCachesPolicy UpstreamCachesPolicy `yaml:"upstream_caches_policy"`
+	Peers                []SerializableURL
+	Offline              bool
+	HTTPClient           *HTTPClientOverride `yaml:"http"`
+	Credentials          *Credentials
+	Caching              Caching
 }
 
 type Log struct {
@@ -66,11 +154,138 @@ type Cache struct {
 	Private   bool
 	QuotaLow  units.DiskQuota `yaml:"quota_low"`
 	QuotaHigh units.DiskQuota `yaml:"quota_high"`
+	// Compression stores files compressed, so they use less of the quota
+	Compression Compression
+}
+
+// Compression selects the files stored compressed in the cache
+type Compression struct {
+	Enabled bool
+	// MinSize is the size from which files are compressed
+	MinSize units.Bytes `yaml:"min_size"`
+	// ContentTypes are patterns matching the media types of the responses to
+	// compress, like `text/*`. All are compressed if empty
+	ContentTypes []string `yaml:"content_types"`
+}
+
+type Retry struct {
+	// Attempts is the maximum number of retries for a request. Retries are disabled if 0
+	Attempts int
+	// StatusCodes are the upstream status codes on which requests are retried
+	StatusCodes []int `yaml:"status_codes"`
+	// InitialBackoff is how long to wait before the first retry, doubled for each retry
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	// MaxBackoff bounds how long to wait before retrying
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// Budget is the number of retries allowed for each request, on average
+	Budget float64
+}
+
+// TLS configures how the connections to upstream are secured
+type TLS struct {
+	// CABundle is the path to PEM certificates to trust, in addition to the system ones
+	CABundle string `yaml:"ca_bundle"`
+	// ClientCert and ClientKey are the paths to a PEM certificate and its key, with
+	// which to authenticate to upstream
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	// InsecureSkipVerify disables the verification of the upstream certificates
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 }
 
 type HTTPClient struct {
 	Timeout        time.Duration
 	HeadersTimeout time.Duration `yaml:"headers_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// MaxConnsPerHost bounds the number of connections to each upstream host
+	MaxConnsPerHost int `yaml:"max_conns_per_host"`
+	// MaxConcurrentRequests bounds the number of requests in flight to each
+	// upstream, queueing the others. Unlimited if 0
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+	// MaxBandwidth is the number of bytes per second that can be downloaded
+	// from upstream. Unlimited if 0. The global limit is shared by all the
+	// registries, which can each have their own limit on top of it, so it is
+	// not merged
+	MaxBandwidth units.Bytes `yaml:"max_bandwidth"`
+	// Proxy is the proxy through which to contact upstream. The one from the
+	// environment is used if not set or empty
+	Proxy *SerializableURL
+	TLS   TLS
+	Retry Retry
+}
+
+// TLSOverride overrides the TLS configuration for a registry. Only the values
+// set are overridden, which allows overriding them with zero values
+type TLSOverride struct {
+	CABundle           *string `yaml:"ca_bundle"`
+	ClientCert         *string `yaml:"client_cert"`
+	ClientKey          *string `yaml:"client_key"`
+	InsecureSkipVerify *bool   `yaml:"insecure_skip_verify"`
+}
+
+// RetryOverride overrides the retries configuration for a registry. Only the
+// values set are overridden, which allows overriding them with zero values
+type RetryOverride struct {
+	Attempts       *int
+	StatusCodes    []int          `yaml:"status_codes"`
+	InitialBackoff *time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     *time.Duration `yaml:"max_backoff"`
+	Budget         *float64
+}
+
+// HTTPClientOverride overrides the HTTP client configuration for a registry.
+// Only the values set are overridden, which allows overriding them with zero
+// values
+type HTTPClientOverride struct {
+	Timeout               *time.Duration
+	HeadersTimeout        *time.Duration `yaml:"headers_timeout"`
+	ConnectTimeout        *time.Duration `yaml:"connect_timeout"`
+	MaxConnsPerHost       *int           `yaml:"max_conns_per_host"`
+	MaxConcurrentRequests *int           `yaml:"max_concurrent_requests"`
+	// MaxBandwidth is the limit of the registry, applied on top of the global
+	// one. It is not merged, so not setting it is the same as setting it to 0
+	MaxBandwidth units.Bytes `yaml:"max_bandwidth"`
+	// Proxy overrides the proxy through which to contact upstream. An empty one
+	// uses the proxy from the environment
+	Proxy *SerializableURL
+	TLS   TLSOverride
+	Retry RetryOverride
+}
+
+// Merge returns the configuration, with the values set in the override taking
+// precedence
+func (c HTTPClient) Merge(override *HTTPClientOverride) HTTPClient {
+	if override == nil {
+		return c
+	}
+
+	setIfNotNil(&c.Timeout, override.Timeout)
+	setIfNotNil(&c.HeadersTimeout, override.HeadersTimeout)
+	setIfNotNil(&c.ConnectTimeout, override.ConnectTimeout)
+	setIfNotNil(&c.MaxConnsPerHost, override.MaxConnsPerHost)
+	setIfNotNil(&c.MaxConcurrentRequests, override.MaxConcurrentRequests)
+	if override.Proxy != nil {
+		c.Proxy = override.Proxy
+	}
+	setIfNotNil(&c.TLS.CABundle, override.TLS.CABundle)
+	setIfNotNil(&c.TLS.ClientCert, override.TLS.ClientCert)
+	setIfNotNil(&c.TLS.ClientKey, override.TLS.ClientKey)
+	setIfNotNil(&c.TLS.InsecureSkipVerify, override.TLS.InsecureSkipVerify)
+	setIfNotNil(&c.Retry.Attempts, override.Retry.Attempts)
+	setIfNotNil(&c.Retry.InitialBackoff, override.Retry.InitialBackoff)
+	setIfNotNil(&c.Retry.MaxBackoff, override.Retry.MaxBackoff)
+	setIfNotNil(&c.Retry.Budget, override.Retry.Budget)
+	if override.Retry.StatusCodes != nil {
+		c.Retry.StatusCodes = override.Retry.StatusCodes
+	}
+
+	return c
+}
+
+func setIfNotNil[T any](value *T, override *T) {
+	if override != nil {
+		*value = *override
+	}
 }
 
 func getQuota(path string, quota units.DiskQuota) (units.Bytes, error) {
@@ -91,6 +306,8 @@ func (c Cache) GetQuotaHigh() (units.Bytes, error) {
 
 type Config struct {
 	Host              string
+	PeerName          string `yaml:"peer_name"`
+	Offline           bool
 	Cache             Cache
 	HTTPClient        HTTPClient `yaml:"http"`
 	AdminInterface    string     `yaml:"admin_interface"`
@@ -119,11 +336,34 @@ func getBaseConfig(envLookup func(string) (string, bool)) *Config {
 			false,
 			units.NewDiskQuotaInPercent(10),
 			units.NewDiskQuotaInPercent(20),
+			Compression{
+				Enabled: false,
+				MinSize: units.Bytes{Bytes: 4 * 1024},
+				ContentTypes: []string{
+					"text/*",
+					"application/json",
+					"application/*+json",
+					"application/xml",
+					"application/*+xml",
+				},
+			},
 		},
 		AdminInterface: "localhost:3130",
 		EnableMetrics:  true,
-		HTTPClient:     HTTPClient{5 * time.Minute, 10 * time.Second},
-		Log:            Log{zerolog.InfoLevel, "json"},
+		HTTPClient: HTTPClient{
+			Timeout:         5 * time.Minute,
+			HeadersTimeout:  10 * time.Second,
+			ConnectTimeout:  30 * time.Second,
+			MaxConnsPerHost: 20,
+			Retry: Retry{
+				Attempts:       0,
+				StatusCodes:    []int{429, 502, 503, 504},
+				InitialBackoff: 100 * time.Millisecond,
+				MaxBackoff:     10 * time.Second,
+				Budget:         0.1,
+			},
+		},
+		Log: Log{zerolog.InfoLevel, "json"},
 	}
 }
 
@@ -149,35 +389,34 @@ func Parse(configPath string, envLookup func(string) (string, bool)) (*Config, e
 func Default(envLookup func(string) (string, bool)) (*Config, error) {
 	conf := getBaseConfig(envLookup)
 	conf.AnsibleGalaxies = []AnsibleGalaxy{
-		{"https://galaxy.ansible.com", 3147, nil},
+		{Upstream: "https://galaxy.ansible.com", Port: 3147},
 	}
 	conf.GoProxies = []GoProxy{
-		{"https://proxy.golang.org", "https://sum.golang.org/", 3143, nil},
+		{Upstream: "https://proxy.golang.org", SumDBURL: "https://sum.golang.org/", Port: 3143},
 	}
 	conf.OciRegistries = []OciRegistry{
-		{"https://registry-1.docker.io", 3131, nil},
-		{"https://gcr.io", 3132, nil},
-		{"https://quay.io", 3133, nil},
-		{"https://ghcr.io", 3134, nil},
+		{Upstream: "https://registry-1.docker.io", Port: 3131},
+		{Upstream: "https://gcr.io", Port: 3132},
+		{Upstream: "https://quay.io", Port: 3133},
+		{Upstream: "https://ghcr.io", Port: 3134},
 	}
 	conf.NpmRegistries = []NpmRegistry{
-		{"https://registry.npmjs.org/", "http", 3144, nil},
+		{Upstream: "https://registry.npmjs.org/", Scheme: "http", Port: 3144},
 	}
 	conf.PyPIRegistries = []PyPIRegistry{
-		{"https://pypi.org/", "https://files.pythonhosted.org", 3145, nil},
+		{Upstream: "https://pypi.org/", CDN: "https://files.pythonhosted.org", Port: 3145},
 	}
 	conf.Proxies = []Proxy{{
-		[]string{
+		AllowedUpstreams: []string{
 			// Debian
 			"deb.debian.org",
 			// Ubuntu
 			"archive.ubuntu.com", "security.ubuntu.com",
 		},
-		3142,
-		nil,
+		Port: 3142,
 	}}
 	conf.RubyGemRegistries = []RubyGemRegistry{
-		{"https://rubygems.org", 3146, nil},
+		{Upstream: "https://rubygems.org", Port: 3146},
 	}
 
 	err := applyOverrides(conf, envLookup)
@@ -209,6 +448,10 @@ func applyOverrides(conf *Config, envLookup func(string) (string, bool)) error {
 		conf.Host = val
 	}
 
+	if val, ok := envLookup("LOCACCEL_PEER_NAME"); ok {
+		conf.PeerName = val
+	}
+
 	if val, ok := envLookup("LOCACCEL_ADMIN_INTERFACE"); ok {
 		conf.AdminInterface = val
 	}
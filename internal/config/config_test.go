@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"testing"
 	"time"
 
@@ -31,10 +32,20 @@ cache:
   private: true
   quota_low: 1
   quota_high: 10
+  compression:
+    enabled: true
+    min_size: 1KiB
+    content_types: [text/*]
 admin_interface: localhost:8192
 http:
   timeout: 10s
   headers_timeout: 1s
+  retry:
+    attempts: 3
+    status_codes: [502]
+    initial_backoff: 50ms
+    max_backoff: 1s
+    budget: 0.5
 metrics: false
 profiling: true
 log:
@@ -44,6 +55,39 @@ oci_registries:
   - upstream: https://registry-1.docker.io
     port: 1234
     upstream_caches: [https://upstream:1234]
+    upstream_caches_policy:
+      hedging_delay: 200ms
+      order_by_latency: true
+    peers: [http://cache-1:1234, http://cache-2:1234]
+    offline: true
+    http:
+      timeout: 1m
+      max_conns_per_host: 5
+      proxy: http://proxy:3128
+      tls:
+        ca_bundle: /etc/ssl/internal.pem
+        client_cert: /etc/ssl/client.pem
+        client_key: /etc/ssl/client.key
+      retry:
+        attempts: 1
+    credentials:
+      type: oci
+      username: bot
+      password:
+        env: DOCKER_TOKEN
+      token_realms:
+        - auth.docker.io
+    caching:
+      stale_while_revalidate: 30s
+      stale_if_error:
+        max_age: 1h
+        status_codes: [502, 503]
+        allow_must_revalidate: true
+      ignore_client_no_cache: true
+      negative_ttl: 5m
+      rules:
+        - glob: /v2/**/blobs/*
+          immutable: true
 pypi_registries:
   - upstream: https://pypi.org
     cdn: https://files.pythonhosted.org
@@ -54,6 +98,8 @@ pypi_registries:
 
 	conf, err := config.Parse(configFile, func(s string) (string, bool) { return "", false })
 	require.NoError(t, err)
+
+	oneHour := time.Hour
 	require.Equal(
 		t,
 		&config.Config{
@@ -63,12 +109,29 @@ pypi_registries:
 				true,
 				units.NewDiskQuotaInBytes(units.Bytes{Bytes: 1}),
 				units.NewDiskQuotaInBytes(units.Bytes{Bytes: 10}),
+				config.Compression{
+					Enabled:      true,
+					MinSize:      units.Bytes{Bytes: 1024},
+					ContentTypes: []string{"text/*"},
+				},
 			},
 			AdminInterface:  "localhost:8192",
 			EnableMetrics:   false,
 			EnableProfiling: true,
-			HTTPClient:      config.HTTPClient{10 * time.Second, 1 * time.Second},
-			Log:             config.Log{zerolog.ErrorLevel, "console"},
+			HTTPClient: config.HTTPClient{
+				Timeout:         10 * time.Second,
+				HeadersTimeout:  1 * time.Second,
+				ConnectTimeout:  30 * time.Second,
+				MaxConnsPerHost: 20,
+				Retry: config.Retry{
+					Attempts:       3,
+					StatusCodes:    []int{502},
+					InitialBackoff: 50 * time.Millisecond,
+					MaxBackoff:     time.Second,
+					Budget:         0.5,
+				},
+			},
+			Log: config.Log{zerolog.ErrorLevel, "console"},
 			OciRegistries: []config.OciRegistry{
 				{
 					Upstream: "https://registry-1.docker.io",
@@ -76,6 +139,53 @@ pypi_registries:
 					UpstreamCaches: []config.SerializableURL{
 						{&url.URL{Scheme: "https", Host: "upstream:1234"}},
 					},
+					UpstreamCachesPolicy: config.UpstreamCachesPolicy{
+						HedgingDelay:   200 * time.Millisecond,
+						OrderByLatency: true,
+					},
+					Peers: []config.SerializableURL{
+						{&url.URL{Scheme: "http", Host: "cache-1:1234"}},
+						{&url.URL{Scheme: "http", Host: "cache-2:1234"}},
+					},
+					Offline: true,
+					HTTPClient: &config.HTTPClientOverride{
+						Timeout:         ptr(time.Minute),
+						MaxConnsPerHost: ptr(5),
+						Proxy: &config.SerializableURL{
+							&url.URL{Scheme: "http", Host: "proxy:3128"},
+						},
+						TLS: config.TLSOverride{
+							CABundle:   ptr("/etc/ssl/internal.pem"),
+							ClientCert: ptr("/etc/ssl/client.pem"),
+							ClientKey:  ptr("/etc/ssl/client.key"),
+						},
+						Retry: config.RetryOverride{Attempts: ptr(1)},
+					},
+					Credentials: &config.Credentials{
+						Type:        config.OCICredentials,
+						Username:    "bot",
+						Password:    config.Secret{Env: "DOCKER_TOKEN"},
+						TokenRealms: []string{"auth.docker.io"},
+					},
+					Caching: config.Caching{
+						StaleWhileRevalidate: 30 * time.Second,
+						StaleIfError: config.StaleIfError{
+							MaxAge:              &oneHour,
+							StatusCodes:         []int{502, 503},
+							AllowMustRevalidate: true,
+						},
+						IgnoreClientNoCache: true,
+						NegativeTTL:         5 * time.Minute,
+						Rules: []config.FreshnessRule{
+							{
+								Glob: &config.SerializableGlob{
+									Glob:   "/v2/**/blobs/*",
+									Regexp: regexp.MustCompile(`^/v2/.*/blobs/[^/]*$`),
+								},
+								Immutable: true,
+							},
+						},
+					},
 				},
 			},
 			PyPIRegistries: []config.PyPIRegistry{
@@ -153,6 +263,8 @@ func TestCanSetOverridesViaEnvironment(t *testing.T) {
 			return "cache", true
 		case "LOCACCEL_HOST":
 			return "0.0.0.0", true
+		case "LOCACCEL_PEER_NAME":
+			return "cache-1", true
 		case "LOCACCEL_ADMIN_INTERFACE":
 			return "0.0.0.0:1000", true
 		default:
@@ -164,18 +276,42 @@ func TestCanSetOverridesViaEnvironment(t *testing.T) {
 	require.Equal(
 		t,
 		&config.Config{
-			Host: "0.0.0.0",
+			Host:     "0.0.0.0",
+			PeerName: "cache-1",
 			Cache: config.Cache{
 				Path:      "cache",
 				Private:   false,
 				QuotaLow:  units.NewDiskQuotaInPercent(10),
 				QuotaHigh: units.NewDiskQuotaInPercent(20),
+				Compression: config.Compression{
+					Enabled: false,
+					MinSize: units.Bytes{Bytes: 4 * 1024},
+					ContentTypes: []string{
+						"text/*",
+						"application/json",
+						"application/*+json",
+						"application/xml",
+						"application/*+xml",
+					},
+				},
 			},
 			AdminInterface:  "0.0.0.0:1000",
 			EnableMetrics:   true,
 			EnableProfiling: true,
-			HTTPClient:      config.HTTPClient{5 * time.Minute, 10 * time.Second},
-			Log:             config.Log{Level: zerolog.DebugLevel, Format: "console"},
+			HTTPClient: config.HTTPClient{
+				Timeout:         5 * time.Minute,
+				HeadersTimeout:  10 * time.Second,
+				ConnectTimeout:  30 * time.Second,
+				MaxConnsPerHost: 20,
+				Retry: config.Retry{
+					Attempts:       0,
+					StatusCodes:    []int{429, 502, 503, 504},
+					InitialBackoff: 100 * time.Millisecond,
+					MaxBackoff:     10 * time.Second,
+					Budget:         0.1,
+				},
+			},
+			Log: config.Log{Level: zerolog.DebugLevel, Format: "console"},
 			AnsibleGalaxies: []config.AnsibleGalaxy{
 				{Upstream: "https://galaxy.ansible.com", Port: 3147},
 			},
@@ -244,3 +380,103 @@ func TestOverridingLogLevelErrorsOnInvalidLevel(t *testing.T) {
 	})
 	require.ErrorContains(t, err, "Unknown Level String")
 }
+
+func TestMergeHTTPClientOverridesOnlySetValues(t *testing.T) {
+	t.Parallel()
+
+	conf, err := config.Default(func(string) (string, bool) { return "", false })
+	require.NoError(t, err)
+
+	require.Equal(t, conf.HTTPClient, conf.HTTPClient.Merge(nil))
+
+	merged := conf.HTTPClient.Merge(&config.HTTPClientOverride{
+		Timeout:               ptr(time.Hour),
+		MaxConcurrentRequests: ptr(4),
+		// The bandwidth limit of the registry is applied on top of the global one
+		MaxBandwidth: units.Bytes{Bytes: 1024},
+		TLS:          config.TLSOverride{InsecureSkipVerify: ptr(true)},
+		Retry:        config.RetryOverride{Attempts: ptr(2)},
+	})
+
+	expected := conf.HTTPClient
+	expected.Timeout = time.Hour
+	expected.MaxConcurrentRequests = 4
+	expected.TLS.InsecureSkipVerify = true
+	expected.Retry.Attempts = 2
+	require.Equal(t, expected, merged)
+}
+
+func TestMergeHTTPClientCanOverrideWithZeroValues(t *testing.T) {
+	t.Parallel()
+
+	configFile := path.Join(t.TempDir(), "config.yml")
+	require.NoError(
+		t,
+		os.WriteFile(
+			configFile,
+			[]byte(`
+http:
+  timeout: 1m
+  headers_timeout: 10s
+  connect_timeout: 5s
+  max_conns_per_host: 10
+  max_concurrent_requests: 4
+  proxy: http://proxy:3128
+  tls:
+    ca_bundle: /etc/ssl/internal.pem
+    client_cert: /etc/ssl/client.pem
+    client_key: /etc/ssl/client.key
+    insecure_skip_verify: true
+  retry:
+    attempts: 3
+    status_codes: [502]
+    initial_backoff: 50ms
+    max_backoff: 1s
+    budget: 0.5
+proxies:
+  - port: 3131
+    http:
+      timeout: 0s
+      headers_timeout: 0s
+      connect_timeout: 0s
+      max_conns_per_host: 0
+      max_concurrent_requests: 0
+      proxy: ""
+      tls:
+        ca_bundle: ""
+        client_cert: ""
+        client_key: ""
+        insecure_skip_verify: false
+      retry:
+        attempts: 0
+        status_codes: []
+        initial_backoff: 0s
+        max_backoff: 0s
+        budget: 0
+  - port: 3132
+    http:
+      timeout: 1h`),
+			0o600,
+		),
+	)
+
+	conf, err := config.Parse(configFile, func(s string) (string, bool) { return "", false })
+	require.NoError(t, err)
+
+	require.Equal(
+		t,
+		config.HTTPClient{
+			Proxy: &config.SerializableURL{&url.URL{}},
+			Retry: config.Retry{StatusCodes: []int{}},
+		},
+		conf.HTTPClient.Merge(conf.Proxies[0].HTTPClient),
+	)
+
+	expected := conf.HTTPClient
+	expected.Timeout = time.Hour
+	require.Equal(t, expected, conf.HTTPClient.Merge(conf.Proxies[1].HTTPClient))
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
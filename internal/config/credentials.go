@@ -0,0 +1,79 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidCredentialsType = errors.New("credentials type must be one of basic, bearer or oci")
+	ErrInvalidSecret          = errors.New("secret must be read from either a file or an env var")
+	ErrSecretNotFound         = errors.New("secret not found")
+)
+
+// CredentialsType is how credentials are presented to upstream
+type CredentialsType string
+
+const (
+	// BasicCredentials are sent as a username and password
+	BasicCredentials CredentialsType = "basic"
+	// BearerCredentials are sent as a static token
+	BearerCredentials CredentialsType = "bearer"
+	// OCICredentials are exchanged for short-lived tokens, as OCI registries expect
+	OCICredentials CredentialsType = "oci"
+)
+
+func (c *CredentialsType) UnmarshalYAML(node *yaml.Node) error {
+	switch CredentialsType(node.Value) {
+	case BasicCredentials, BearerCredentials, OCICredentials:
+		*c = CredentialsType(node.Value)
+		return nil
+	default:
+		return fmt.Errorf("%w, not '%s'", ErrInvalidCredentialsType, node.Value)
+	}
+}
+
+// Secret is read from a file or an environment variable, which keeps it out of
+// the configuration
+type Secret struct {
+	File string
+	Env  string
+}
+
+// Read returns the value of the secret, without surrounding whitespace
+func (s Secret) Read(envLookup func(string) (string, bool)) (string, error) {
+	switch {
+	case s.File != "" && s.Env != "":
+		return "", ErrInvalidSecret
+	case s.File != "":
+		value, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret: %w", err)
+		}
+		return strings.TrimSpace(string(value)), nil
+	case s.Env != "":
+		value, ok := envLookup(s.Env)
+		if !ok {
+			return "", fmt.Errorf("%w: env var %s is not set", ErrSecretNotFound, s.Env)
+		}
+		return strings.TrimSpace(value), nil
+	default:
+		return "", ErrInvalidSecret
+	}
+}
+
+// Credentials authenticate the requests sent to upstream, on behalf of the clients
+type Credentials struct {
+	Type     CredentialsType
+	Username string
+	// Password is the password of basic and oci credentials, or the token of
+	// bearer ones
+	Password Secret
+	// TokenRealms are the hosts, other than the upstream's, to which oci
+	// credentials can be sent to obtain tokens
+	TokenRealms []string `yaml:"token_realms"`
+}
@@ -0,0 +1,51 @@
+package config_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/benjaminschubert/locaccel/internal/config"
+)
+
+func TestCredentialsTypeMustBeKnown(t *testing.T) {
+	t.Parallel()
+
+	credentials := config.Credentials{}
+	err := yaml.Unmarshal([]byte("type: digest"), &credentials)
+	require.ErrorIs(t, err, config.ErrInvalidCredentialsType)
+
+	require.NoError(t, yaml.Unmarshal([]byte("type: bearer"), &credentials))
+	require.Equal(t, config.BearerCredentials, credentials.Type)
+}
+
+func TestSecretCanBeReadFromFileOrEnv(t *testing.T) {
+	t.Parallel()
+
+	file := path.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+
+	envLookup := func(name string) (string, bool) {
+		if name == "SECRET" {
+			return "from-env", true
+		}
+		return "", false
+	}
+
+	value, err := config.Secret{File: file}.Read(envLookup)
+	require.NoError(t, err)
+	require.Equal(t, "from-file", value)
+
+	value, err = config.Secret{Env: "SECRET"}.Read(envLookup)
+	require.NoError(t, err)
+	require.Equal(t, "from-env", value)
+
+	_, err = config.Secret{Env: "MISSING"}.Read(envLookup)
+	require.ErrorIs(t, err, config.ErrSecretNotFound)
+
+	_, err = config.Secret{File: file, Env: "SECRET"}.Read(envLookup)
+	require.ErrorIs(t, err, config.ErrInvalidSecret)
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrPatternMustBeScalar = errors.New("pattern must be a scalar")
+	ErrInvalidRule         = errors.New("invalid freshness rule")
+)
+
+// SerializableRegexp is a regular expression, matching anywhere in a path
+type SerializableRegexp struct {
+	Regexp *regexp.Regexp
+}
+
+func (s *SerializableRegexp) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return ErrPatternMustBeScalar
+	}
+
+	parsed, err := regexp.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+
+	s.Regexp = parsed
+	return nil
+}
+
+func (s SerializableRegexp) MarshalYAML() (any, error) {
+	return s.Regexp.String(), nil
+}
+
+// SerializableGlob is a glob matching a whole path. `*` matches any sequence of
+// characters within a path segment, `**` any sequence of characters, including
+// `/`, and `?` a single character within a path segment.
+type SerializableGlob struct {
+	Glob   string
+	Regexp *regexp.Regexp
+}
+
+func (s *SerializableGlob) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return ErrPatternMustBeScalar
+	}
+
+	parsed, err := regexp.Compile(globToRegexp(node.Value))
+	if err != nil {
+		return err
+	}
+
+	s.Glob = node.Value
+	s.Regexp = parsed
+	return nil
+}
+
+func (s SerializableGlob) MarshalYAML() (any, error) {
+	return s.Glob, nil
+}
+
+func globToRegexp(glob string) string {
+	builder := strings.Builder{}
+	builder.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			builder.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			builder.WriteString("[^/]*")
+		case glob[i] == '?':
+			builder.WriteString("[^/]")
+		default:
+			builder.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+
+	builder.WriteString("$")
+	return builder.String()
+}
+
+// FreshnessRule overrides the freshness of the responses whose upstream path
+// matches either the glob or the regular expression
+type FreshnessRule struct {
+	Glob  *SerializableGlob
+	Regex *SerializableRegexp
+	// TTL is how long responses are fresh, regardless of their headers
+	TTL *time.Duration
+	// Immutable responses are never revalidated
+	Immutable bool
+	// NoStore responses are neither stored nor served from the cache
+	NoStore bool `yaml:"no_store"`
+}
+
+func (r *FreshnessRule) UnmarshalYAML(node *yaml.Node) error {
+	type rawFreshnessRule FreshnessRule
+	if err := node.Decode((*rawFreshnessRule)(r)); err != nil {
+		return err
+	}
+
+	if (r.Glob == nil) == (r.Regex == nil) {
+		return fmt.Errorf("%w: exactly one of glob or regex is required", ErrInvalidRule)
+	}
+
+	if r.NoStore && (r.TTL != nil || r.Immutable) {
+		return fmt.Errorf("%w: no_store can't be combined with ttl or immutable", ErrInvalidRule)
+	}
+
+	if r.TTL != nil && *r.TTL <= 0 {
+		return fmt.Errorf("%w: ttl must be positive", ErrInvalidRule)
+	}
+
+	if !r.NoStore && r.TTL == nil && !r.Immutable {
+		return fmt.Errorf("%w: one of ttl, immutable or no_store is required", ErrInvalidRule)
+	}
+
+	return nil
+}
+
+// Matcher returns the regular expression matching the paths the rule applies to
+func (r FreshnessRule) Matcher() *regexp.Regexp {
+	if r.Glob != nil {
+		return r.Glob.Regexp
+	}
+	return r.Regex.Regexp
+}
@@ -0,0 +1,105 @@
+package config_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/benjaminschubert/locaccel/internal/config"
+)
+
+func TestGlobsMatchPaths(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		glob     string
+		path     string
+		expected bool
+	}{
+		{"/v2/**/blobs/sha256:*", "/v2/library/ubuntu/blobs/sha256:1234", true},
+		{"/v2/**/blobs/sha256:*", "/v2/library/ubuntu/manifests/latest", false},
+		{"/-/*.tgz", "/-/package-1.0.0.tgz", true},
+		{"/-/*.tgz", "/-/nested/package-1.0.0.tgz", false},
+		{"/**/@v/*.zip", "/github.com/user/repo/@v/v1.0.0.zip", true},
+		{"/**/@v/*.zip", "/github.com/user/repo/@v/list", false},
+		{"/pool/**.deb", "/pool/main/h/hello/hello_2.10-3_amd64.deb", true},
+		{"/file?.txt", "/file1.txt", true},
+		{"/file?.txt", "/file/.txt", false},
+		{"/file.txt", "/fileatxt", false},
+	} {
+		t.Run(tc.glob+" "+tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			rule := config.FreshnessRule{}
+			err := yaml.NewDecoder(
+				bytes.NewBufferString("glob: '" + tc.glob + "'\nimmutable: true"),
+			).Decode(&rule)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rule.Matcher().MatchString(tc.path))
+		})
+	}
+}
+
+func TestRegexesMatchPaths(t *testing.T) {
+	t.Parallel()
+
+	rule := config.FreshnessRule{}
+	err := yaml.NewDecoder(
+		bytes.NewBufferString("regex: '\\.(mod|zip)$'\nttl: 1h"),
+	).Decode(&rule)
+	require.NoError(t, err)
+	assert.True(t, rule.Matcher().MatchString("/github.com/user/repo/@v/v1.0.0.mod"))
+	assert.False(t, rule.Matcher().MatchString("/github.com/user/repo/@v/list"))
+}
+
+func TestReportErrorsOnInvalidFreshnessRules(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description string
+		rule        string
+		expected    error
+	}{
+		{"no-pattern", "ttl: 1h", config.ErrInvalidRule},
+		{"both-patterns", "glob: /a\nregex: /a\nttl: 1h", config.ErrInvalidRule},
+		{"no-action", "glob: /a", config.ErrInvalidRule},
+		{"no-store-and-ttl", "glob: /a\nno_store: true\nttl: 1h", config.ErrInvalidRule},
+		{"negative-ttl", "glob: /a\nttl: -1h", config.ErrInvalidRule},
+		{"non-scalar-pattern", "glob: []\nttl: 1h", config.ErrPatternMustBeScalar},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			rule := config.FreshnessRule{}
+			err := yaml.NewDecoder(bytes.NewBufferString(tc.rule)).Decode(&rule)
+			require.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestReportErrorsOnInvalidRegex(t *testing.T) {
+	t.Parallel()
+
+	rule := config.FreshnessRule{}
+	err := yaml.NewDecoder(bytes.NewBufferString("regex: '('\nttl: 1h")).Decode(&rule)
+	require.ErrorContains(t, err, "missing closing )")
+}
+
+func TestCanConvertFreshnessRulesToYaml(t *testing.T) {
+	t.Parallel()
+
+	for _, rule := range []string{
+		"glob: /**/*.deb\nregex: null\nttl: null\nimmutable: true\nno_store: false\n",
+		"glob: null\nregex: ^/simple/\nttl: 5m0s\nimmutable: false\nno_store: false\n",
+	} {
+		parsed := config.FreshnessRule{}
+		require.NoError(t, yaml.NewDecoder(bytes.NewBufferString(rule)).Decode(&parsed))
+
+		buf := bytes.NewBufferString("")
+		require.NoError(t, yaml.NewEncoder(buf).Encode(parsed))
+		assert.Equal(t, rule, buf.String())
+	}
+}
@@ -1,7 +1,9 @@
 package database
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net/http"
@@ -22,6 +24,14 @@ var (
 	ErrConflict    = errors.New("trying to update an entry that got updated already")
 )
 
+// metadataKeyPrefix prefixes the keys the database keeps for itself. They are
+// not entries, and are thus hidden from statistics, listings and iterations.
+var metadataKeyPrefix = []byte("!locaccel/")
+
+func isMetadataKey(key []byte) bool {
+	return bytes.HasPrefix(key, metadataKeyPrefix)
+}
+
 type encodable interface {
 	msgp.Marshaler
 }
@@ -155,7 +165,13 @@ func (d *Database[T, TPtr]) Delete(key []byte, entry *Entry[T]) error {
 	return nil
 }
 
-func (d *Database[T, TPtr]) GetStatistics() (count int64, totalSize units.Bytes, err error) {
+// GetStatistics returns the number of entries, the size of their keys and
+// values, and the space they use, as estimated by the database
+func (d *Database[T, TPtr]) GetStatistics() (
+	count int64,
+	contentSize, totalSize units.Bytes,
+	err error,
+) {
 	err = d.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
@@ -163,13 +179,43 @@ func (d *Database[T, TPtr]) GetStatistics() (count int64, totalSize units.Bytes,
 		defer it.Close()
 
 		for it.Rewind(); it.Valid(); it.Next() {
+			if isMetadataKey(it.Item().Key()) {
+				continue
+			}
 			count++
+			contentSize.Bytes += int64(len(it.Item().Key())) + it.Item().ValueSize()
 			totalSize.Bytes += it.Item().EstimatedSize()
 		}
 		return nil
 	})
 
-	return count, totalSize, err
+	return count, contentSize, totalSize, err
+}
+
+// Keys returns all the keys starting with the prefix
+func (d *Database[T, TPtr]) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+
+	err := d.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if isMetadataKey(it.Item().Key()) {
+				continue
+			}
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list keys: %w", err)
+	}
+
+	return keys, nil
 }
 
 func (d *Database[T, TPtr]) Iterate(
@@ -179,6 +225,9 @@ func (d *Database[T, TPtr]) Iterate(
 ) error {
 	stream := d.db.NewStream()
 	stream.LogPrefix = logId
+	stream.ChooseKey = func(item *badger.Item) bool {
+		return !isMetadataKey(item.Key())
+	}
 
 	stream.Send = func(buf *z.Buffer) error {
 		list, err := badger.BufferToKVList(buf)
@@ -202,6 +251,36 @@ func (d *Database[T, TPtr]) Iterate(
 	return stream.Orchestrate(ctx)
 }
 
+// Secret returns the random secret of the given size stored under the name,
+// generating it the first time it is requested. It lives as long as the
+// database does.
+func (d *Database[T, TPtr]) Secret(name string, size int) ([]byte, error) {
+	key := append(bytes.Clone(metadataKeyPrefix), name...)
+	var secret []byte
+
+	err := d.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == nil {
+			secret, err = item.ValueCopy(nil)
+			return err
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		secret = make([]byte, size)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return txn.Set(key, secret)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to load secret %s: %w", name, err)
+	}
+
+	return secret, nil
+}
+
 func (d *Database[T, TPtr]) unmarshal(val []byte, value TPtr) error {
 	if _, err := value.UnmarshalMsg(val); err != nil {
 		return fmt.Errorf(
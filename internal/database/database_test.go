@@ -82,8 +82,9 @@ func TestCanRetrieveStatistics(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	count, totalSize, err := db.GetStatistics()
+	count, contentSize, totalSize, err := db.GetStatistics()
 	assert.Equal(t, int64(5), count)
+	assert.Equal(t, units.Bytes{Bytes: 78}, contentSize)
 	assert.Equal(t, units.Bytes{Bytes: 78}, totalSize)
 	require.NoError(t, err)
 }
@@ -128,6 +129,27 @@ func TestCanIterateOverEntries(t *testing.T) {
 	)
 }
 
+func TestCanListKeysWithPrefix(t *testing.T) {
+	t.Parallel()
+
+	db, err := database.NewDatabase[dbtestutils.TestObj](t.TempDir(), testutils.TestLogger(t, nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+
+	for _, value := range []string{"one", "two", "three", "thirty"} {
+		err = db.New([]byte(value), dbtestutils.TestObj{Value: value})
+		require.NoError(t, err)
+	}
+
+	keys, err := db.Keys([]byte("th"))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, [][]byte{[]byte("three"), []byte("thirty")}, keys)
+
+	keys, err = db.Keys([]byte("four"))
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
 func TestCanDeleteEntry(t *testing.T) {
 	t.Parallel()
 
@@ -146,3 +168,51 @@ func TestCanDeleteEntry(t *testing.T) {
 	// No error when not found
 	require.NoError(t, db.Delete([]byte("one"), val))
 }
+
+func TestSecretsArePersistedAndHiddenFromEntries(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir()
+	db, err := database.NewDatabase[dbtestutils.TestObj](path, testutils.TestLogger(t, nil))
+	require.NoError(t, err)
+
+	secret, err := db.Secret("test", 32)
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	require.NoError(t, db.New([]byte("one"), dbtestutils.TestObj{Value: "one"}))
+
+	count, _, _, err := db.GetStatistics()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	keys, err := db.Keys(nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("one")}, keys)
+
+	collectedKeys := []string{}
+	err = db.Iterate(
+		t.Context(),
+		func(key []byte, entry *database.Entry[dbtestutils.TestObj]) error {
+			collectedKeys = append(collectedKeys, string(key))
+			return nil
+		},
+		"test",
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one"}, collectedKeys)
+
+	require.NoError(t, db.Close())
+
+	db, err = database.NewDatabase[dbtestutils.TestObj](path, testutils.TestLogger(t, nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+
+	reloaded, err := db.Secret("test", 32)
+	require.NoError(t, err)
+	assert.Equal(t, secret, reloaded)
+
+	other, err := db.Secret("other", 32)
+	require.NoError(t, err)
+	assert.NotEqual(t, secret, other)
+}
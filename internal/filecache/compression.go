@@ -0,0 +1,313 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+)
+
+// compressedSuffix is appended to the name of the files stored compressed. Their
+// hash is still the one of their uncompressed content.
+const compressedSuffix = ".zst"
+
+// CompressedEncoding is the content encoding of the files stored compressed
+const CompressedEncoding = "zstd"
+
+var (
+	encoderPool = sync.Pool{
+		New: func() any {
+			encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				panic(err)
+			}
+			return encoder
+		},
+	}
+	decoderPool = sync.Pool{
+		New: func() any {
+			decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				panic(err)
+			}
+			return decoder
+		},
+	}
+)
+
+// CompressedFile is a file stored compressed in the cache, which is decompressed
+// while being read.
+//
+// It can be seeked, which decompresses the content up to the new offset when
+// reading from it. Seeking back restarts decompressing from the beginning.
+type CompressedFile struct {
+	file    *os.File
+	decoder *zstd.Decoder
+	// size is the size of the content, -1 until known if the file doesn't
+	// record it
+	size int64
+	// decoded is how much of the content the decoder returned already, and
+	// offset where the next read starts
+	decoded int64
+	offset  int64
+}
+
+func openCompressed(fp *os.File) (*CompressedFile, error) {
+	size, known, err := frameContentSize(fp)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		size = -1
+	}
+	return &CompressedFile{file: fp, size: size}, nil
+}
+
+func (c *CompressedFile) Read(p []byte) (int, error) {
+	if c.decoder == nil || c.offset < c.decoded {
+		if err := c.rewind(); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.offset > c.decoded {
+		n, err := io.CopyN(io.Discard, c.decoder, c.offset-c.decoded)
+		c.decoded += n
+		if errors.Is(err, io.EOF) {
+			// Reading past the end of the content
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.decoder.Read(p)
+	c.decoded += int64(n)
+	c.offset = c.decoded
+	return n, err
+}
+
+// rewind restarts decompressing the file from the beginning
+func (c *CompressedFile) rewind() error {
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if c.decoder == nil {
+		c.decoder = decoderPool.Get().(*zstd.Decoder)
+	}
+	if err := c.decoder.Reset(c.file); err != nil {
+		decoderPool.Put(c.decoder)
+		c.decoder = nil
+		return err
+	}
+	c.decoded = 0
+	return nil
+}
+
+// Seek moves the offset of the next read in the content. Nothing is
+// decompressed until then.
+func (c *CompressedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		size, err := c.Size()
+		if err != nil {
+			return c.offset, err
+		}
+		offset += size
+	default:
+		return c.offset, fmt.Errorf("%w: unknown whence %d", errInvalidSeek, whence)
+	}
+
+	if offset < 0 {
+		return c.offset, fmt.Errorf("%w: negative offset %d", errInvalidSeek, offset)
+	}
+
+	c.offset = offset
+	return offset, nil
+}
+
+// Size returns the size of the content. It is recorded in the file, unless it
+// was stored by something else, in which case it is decompressed to count it.
+func (c *CompressedFile) Size() (int64, error) {
+	if c.size >= 0 {
+		return c.size, nil
+	}
+
+	if err := c.rewind(); err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(io.Discard, c.decoder)
+	c.decoded = size
+	if err != nil {
+		return 0, err
+	}
+	c.size = size
+	return size, nil
+}
+
+func (c *CompressedFile) Close() error {
+	if c.decoder != nil {
+		// Resetting without input releases the file
+		_ = c.decoder.Reset(nil)
+		decoderPool.Put(c.decoder)
+		c.decoder = nil
+	}
+	return c.file.Close()
+}
+
+// Encoded returns the file as stored, along with its content encoding, so it
+// can be sent as is to clients accepting it. It can't be used once the file
+// started being read decompressed.
+func (c *CompressedFile) Encoded() (*os.File, string) {
+	return c.file, CompressedEncoding
+}
+
+// Wait blocks until the files being compressed in the background are stored
+func (f *FileCache) Wait() {
+	f.compressions.Wait()
+}
+
+// compressInBackground replaces the stored file by a compressed copy, if that
+// makes it smaller, without blocking whoever stored it
+func (f *FileCache) compressInBackground(filename string, size int64, logger *zerolog.Logger) {
+	f.compressions.Add(1)
+
+	go func() {
+		defer f.compressions.Done()
+
+		if err := f.compressStored(filename, size, logger); err != nil {
+			logger.Warn().Err(err).Msg("unable to compress file, keeping it as is")
+		}
+	}()
+}
+
+// compressStored replaces the stored file by a compressed copy. The copy is
+// moved in place before the file is removed, so it is always found by Open, and
+// readers that opened the file already keep reading it as it was.
+func (f *FileCache) compressStored(filename string, size int64, logger *zerolog.Logger) error {
+	src, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed from the cache already
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	compressed, err := f.compress(src, size, logger)
+	if cErr := src.Close(); cErr != nil {
+		logger.Debug().Err(cErr).Msg("error closing file after compressing it")
+	}
+	if err != nil || compressed == "" {
+		return err
+	}
+
+	if err := os.Rename(compressed, filename+compressedSuffix); err != nil {
+		if rmErr := os.Remove(compressed); rmErr != nil {
+			logger.Error().Err(rmErr).Msg("error removing temporary compressed file.")
+		}
+		return err
+	}
+
+	err = os.Remove(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The file was removed from the cache while being compressed, the copy
+		// must not outlive it
+		err = os.Remove(filename + compressedSuffix)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// compress writes a compressed copy of the first size bytes of the file to a
+// new temporary file, and returns its path. Nothing is written, and the path is
+// empty, if compressing the file does not make it smaller.
+func (f *FileCache) compress(src *os.File, size int64, logger *zerolog.Logger) (string, error) {
+	dest, err := os.CreateTemp(f.tmpdir, "compress-XXX")
+	if err != nil {
+		return "", err
+	}
+
+	encoder := encoderPool.Get().(*zstd.Encoder)
+	defer encoderPool.Put(encoder)
+
+	// The size is written in the header, so the logical size is known cheaply
+	encoder.ResetContentSize(dest, size)
+	_, err = io.Copy(encoder, io.NewSectionReader(src, 0, size))
+	err = errors.Join(err, encoder.Close())
+
+	var compressedSize int64
+	if err == nil {
+		compressedSize, err = dest.Seek(0, io.SeekCurrent)
+	}
+	err = errors.Join(err, dest.Close())
+
+	if err != nil || compressedSize >= size {
+		if rmErr := os.Remove(dest.Name()); rmErr != nil {
+			logger.Error().Err(rmErr).Msg("error removing temporary compressed file.")
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to compress file: %w", err)
+		}
+
+		logger.Debug().Int64("size", size).Msg("compressing the file does not make it smaller")
+		return "", nil
+	}
+
+	logger.Debug().
+		Int64("size", size).
+		Int64("compressedSize", compressedSize).
+		Msg("file compressed for storage")
+	return dest.Name(), nil
+}
+
+// logicalSize returns the size of the content of a stored file, which is larger
+// than the space it uses if it is compressed.
+func logicalSize(filename string, info fs.FileInfo) (int64, error) {
+	if !strings.HasSuffix(filename, compressedSuffix) {
+		return info.Size(), nil
+	}
+
+	fp, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close() //nolint:errcheck
+
+	size, known, err := frameContentSize(fp)
+	if err != nil || !known {
+		// Files are compressed with their size, but better not fail on it
+		return info.Size(), err
+	}
+	return size, nil
+}
+
+// frameContentSize returns the size of the content of a compressed file, as
+// recorded in its header, if it is, without moving its offset.
+func frameContentSize(fp *os.File) (size int64, known bool, err error) {
+	header := make([]byte, zstd.HeaderMaxSize)
+	n, err := fp.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, false, err
+	}
+
+	var frame zstd.Header
+	if err := frame.Decode(header[:n]); err != nil {
+		return 0, false, fmt.Errorf("invalid compressed file %s: %w", fp.Name(), err)
+	}
+	if !frame.HasFCS {
+		return 0, false, nil
+	}
+	return int64(frame.FrameContentSize), true, nil //nolint:gosec
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,6 +40,8 @@ type FileCache struct {
 	quotaLow  int64
 	quotaHigh int64
 	logger    *zerolog.Logger
+	// compressions tracks the files being compressed in the background
+	compressions sync.WaitGroup
 }
 
 func NewFileCache(
@@ -71,7 +75,13 @@ func NewFileCache(
 		}
 	}
 
-	return &FileCache{root, tmpdir, quotaLow, quotaHigh, logger}, nil
+	return &FileCache{
+		root:      root,
+		tmpdir:    tmpdir,
+		quotaLow:  quotaLow,
+		quotaHigh: quotaHigh,
+		logger:    logger,
+	}, nil
 }
 
 func (f *FileCache) SetupIngestion(
@@ -80,19 +90,34 @@ func (f *FileCache) SetupIngestion(
 	onCleanup func(),
 	logger *zerolog.Logger,
 ) io.ReadCloser {
+	reader, _ := f.SetupSharedIngestion(src, onIngest, onCleanup, logger)
+	return reader
+}
+
+// SetupSharedIngestion works like SetupIngestion, but additionally returns an
+// Ingestion that allows other readers to follow the file while it is being
+// written. The returned Ingestion is nil if the ingestion could not be set up.
+func (f *FileCache) SetupSharedIngestion(
+	src io.ReadCloser,
+	onIngest func(hash string),
+	onCleanup func(),
+	logger *zerolog.Logger,
+) (io.ReadCloser, *Ingestion) {
 	dest, err := os.CreateTemp(f.tmpdir, "ingest-XXX")
 	if err != nil {
 		logger.Error().Err(err).Msg("Unable to create temporary file")
-		return src
+		onCleanup()
+		return src, nil
 	}
 
 	hasher := hashPool.Get().(*blake3.Hasher)
 	hasher.Reset()
 	wasCalled := false
+	ingestion := newIngestion(f, dest.Name())
 
 	return teereader.New(
 		src,
-		io.MultiWriter(dest, hasher),
+		io.MultiWriter(&ingestionWriter{dest, ingestion}, hasher),
 		func(totalread int, readErr, writeErr error) error {
 			if wasCalled {
 				return ErrAlreadyClosed
@@ -104,6 +129,8 @@ func (f *FileCache) SetupIngestion(
 
 			if totalread > (int(f.quotaHigh) / 2) {
 				logger.Warn().Int("size", totalread).Msg("File is too big for the cache. Skipping")
+				// The file is complete, readers following it can still finish reading it
+				ingestion.complete()
 				return f.cleanup(src, dest, logger)
 			}
 
@@ -119,6 +146,7 @@ func (f *FileCache) SetupIngestion(
 					Str("reason", reason).
 					Err(err).
 					Msg("an error happened ingesting the file")
+				ingestion.abort()
 				return f.cleanup(src, dest, logger)
 			}
 
@@ -128,16 +156,18 @@ func (f *FileCache) SetupIngestion(
 				logger.Error().
 					Err(err).
 					Msg("The file to ingest was not read fully before closing. Skipping ingestion")
+				ingestion.abort()
 				return f.cleanup(src, dest, logger)
 			}
 
 			hash := hex.EncodeToString(hasher.Sum(nil))
 
-			if err := os.Rename(
-				dest.Name(),
-				path.Join(f.root, hash[:2], hash[2:]),
-			); err != nil {
+			target := f.filePath(hash)
+			if err := ingestion.commit(hash, func() error {
+				return os.Rename(dest.Name(), target)
+			}); err != nil {
 				logger.Error().Err(err).Msg("unable to rename file for ingestion")
+				ingestion.abort()
 				return f.cleanup(src, dest, logger)
 			}
 
@@ -146,10 +176,15 @@ func (f *FileCache) SetupIngestion(
 				return src.Close()
 			}
 
+			// Compressing large files takes a while, nobody needs to wait for it
+			if minSize, ok := ingestion.compression(); ok && int64(totalread) >= minSize {
+				f.compressInBackground(target, int64(totalread), logger)
+			}
+
 			onIngest(hash)
 			return src.Close()
 		},
-	)
+	), ingestion
 }
 
 func (f *FileCache) cleanup(src io.ReadCloser, dest *os.File, logger *zerolog.Logger) error {
@@ -163,25 +198,76 @@ func (f *FileCache) cleanup(src io.ReadCloser, dest *os.File, logger *zerolog.Lo
 	return src.Close()
 }
 
+// TempDir returns the directory for temporary files, on the same filesystem as
+// the cache. Whatever is left in it is removed when the cache is opened again.
+func (f *FileCache) TempDir() string {
+	return f.tmpdir
+}
+
+func (f *FileCache) filePath(hash string) string {
+	return path.Join(f.root, hash[:2], hash[2:])
+}
+
+// Open returns the content of the file. Files stored compressed are returned as
+// a CompressedFile, decompressing them while they are read.
 func (f *FileCache) Open(hash string, logger *zerolog.Logger) (io.ReadCloser, error) {
-	fp, err := os.Open(path.Join(f.root, hash[:2], hash[2:]))
+	compressed := false
+	fp, err := os.Open(f.filePath(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		compressed = true
+		fp, err = os.Open(f.filePath(hash) + compressedSuffix)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w", ErrCannotOpen, err)
 	}
 	if err := os.Chtimes(fp.Name(), time.Time{}, time.Now()); err != nil {
 		logger.Warn().Err(err).Msg("unable to update mtime for cached file")
 	}
+
+	if compressed {
+		file, err := openCompressed(fp)
+		if err != nil {
+			_ = fp.Close()
+			return nil, fmt.Errorf("%w: %w", ErrCannotOpen, err)
+		}
+		return file, nil
+	}
 	return fp, nil
 }
 
+// Stat returns the information about the file as stored, which might be
+// compressed
 func (f *FileCache) Stat(hash string) (os.FileInfo, error) {
-	return os.Stat(path.Join(f.root, hash[:2], hash[2:]))
+	info, err := os.Stat(f.filePath(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.Stat(f.filePath(hash) + compressedSuffix)
+	}
+	return info, err
 }
 
-func (f *FileCache) GetStatistics() (count int64, totalSize units.Bytes, err error) {
+// Size returns the size of the content of the file, and the space it uses on
+// disk, which is smaller if it is stored compressed
+func (f *FileCache) Size(hash string) (contentSize, diskSize int64, err error) {
+	info, err := f.Stat(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	contentSize, err = logicalSize(path.Join(f.root, hash[:2], info.Name()), info)
+	return contentSize, info.Size(), err
+}
+
+// GetStatistics returns the number of files in the cache, the size of their
+// content, and the space they use on disk, which is smaller for those stored
+// compressed
+func (f *FileCache) GetStatistics() (
+	count int64,
+	contentSize, diskSize units.Bytes,
+	err error,
+) {
 	dirs, err := os.ReadDir(f.root)
 	if err != nil {
-		return count, totalSize, err
+		return count, contentSize, diskSize, err
 	}
 
 	var files []os.DirEntry
@@ -192,9 +278,11 @@ func (f *FileCache) GetStatistics() (count int64, totalSize units.Bytes, err err
 			continue
 		}
 
-		files, err = os.ReadDir(path.Join(f.root, dir.Name()))
+		fullPath := path.Join(f.root, dir.Name())
+
+		files, err = os.ReadDir(fullPath)
 		if err != nil {
-			return count, totalSize, err
+			return count, contentSize, diskSize, err
 		}
 
 		count += int64(len(files))
@@ -202,20 +290,28 @@ func (f *FileCache) GetStatistics() (count int64, totalSize units.Bytes, err err
 		for _, fp := range files {
 			fileInfo, err = fp.Info()
 			if err != nil {
-				return count, totalSize, err
+				return count, contentSize, diskSize, err
+			}
+
+			size, err := logicalSize(path.Join(fullPath, fp.Name()), fileInfo)
+			if err != nil {
+				return count, contentSize, diskSize, err
 			}
 
-			totalSize.Bytes += fileInfo.Size()
+			contentSize.Bytes += size
+			diskSize.Bytes += fileInfo.Size()
 		}
 	}
 
-	return count, totalSize, err
+	return count, contentSize, diskSize, err
 }
 
 func (f *FileCache) Prune(logger *zerolog.Logger) (int64, error) {
 	logger.Info().Msg("Pruning cache")
 
-	totalSize, files, err := f.getFilesAndTimestamps()
+	// The quota applies to the disk usage, compressed files only count for the
+	// space they use
+	totalSize, contentSize, files, err := f.getFilesAndTimestamps()
 	if err != nil {
 		return 0, fmt.Errorf(
 			"%s: %w",
@@ -227,6 +323,7 @@ func (f *FileCache) Prune(logger *zerolog.Logger) (int64, error) {
 	if totalSize < f.quotaHigh {
 		logger.Info().
 			Int64("diskUsage", totalSize).
+			Int64("contentSize", contentSize).
 			Int64("maxQuota", f.quotaHigh).
 			Msg("No need to evict files, under threshold")
 		return 0, ErrGCleanupNotRequired
@@ -234,6 +331,7 @@ func (f *FileCache) Prune(logger *zerolog.Logger) (int64, error) {
 
 	logger.Info().
 		Int64("diskUsage", totalSize).
+		Int64("contentSize", contentSize).
 		Int64("maxQuota", f.quotaHigh).
 		Msg("Disk usage above the required quota. Cleaning up")
 
@@ -262,24 +360,42 @@ outer:
 			}
 
 			size := fileInfo.Size()
+			content, err := logicalSize(filename, fileInfo)
+			if err != nil {
+				logger.Warn().
+					Err(err).
+					Str("filename", filename).
+					Msg("unable to read the size of the content")
+				content = size
+			}
+
 			if err := os.Remove(filename); err != nil {
 				logger.Error().Err(err).Msg("An unexpected error happened trying to remove file, skipping")
 			} else {
 				logger.Debug().Str("filename", filename).Int64("size", size).Msg("Removed file from cache")
 				totalSize -= size
+				contentSize -= content
 				removed += 1
 			}
 		}
 	}
 
-	logger.Info().Int64("files", removed).Int64("diskUsage", totalSize).Msg("Removed files")
+	logger.Info().
+		Int64("files", removed).
+		Int64("diskUsage", totalSize).
+		Int64("contentSize", contentSize).
+		Msg("Removed files")
 	return removed, nil
 }
 
-func (f *FileCache) getFilesAndTimestamps() (totalSize int64, timestampToFiles map[int64][]string, err error) {
+func (f *FileCache) getFilesAndTimestamps() (
+	totalSize, contentSize int64,
+	timestampToFiles map[int64][]string,
+	err error,
+) {
 	dirs, err := os.ReadDir(f.root)
 	if err != nil {
-		return 0, nil, err
+		return 0, 0, nil, err
 	}
 
 	timestampToFiles = make(map[int64][]string, 1000)
@@ -295,26 +411,30 @@ func (f *FileCache) getFilesAndTimestamps() (totalSize int64, timestampToFiles m
 
 		files, err := os.ReadDir(fullPath)
 		if err != nil {
-			return 0, nil, err
+			return 0, 0, nil, err
 		}
 
 		for _, fp := range files {
 			fileInfo, err = fp.Info()
 			if err != nil {
-				return 0, nil, err
+				return 0, 0, nil, err
+			}
+
+			filename := path.Join(fullPath, fp.Name())
+			size, err := logicalSize(filename, fileInfo)
+			if err != nil {
+				return 0, 0, nil, err
 			}
 
 			timestamp := fileInfo.ModTime().UTC().Unix()
 
-			timestampToFiles[timestamp] = append(
-				timestampToFiles[timestamp],
-				path.Join(fullPath, fp.Name()),
-			)
+			timestampToFiles[timestamp] = append(timestampToFiles[timestamp], filename)
 			totalSize += fileInfo.Size()
+			contentSize += size
 		}
 	}
 
-	return totalSize, timestampToFiles, nil
+	return totalSize, contentSize, timestampToFiles, nil
 }
 
 func (f *FileCache) GetAllHashes() ([]string, error) {
@@ -336,7 +456,7 @@ func (f *FileCache) GetAllHashes() ([]string, error) {
 		}
 
 		for _, fp := range files {
-			hashes = append(hashes, dir.Name()+fp.Name())
+			hashes = append(hashes, dir.Name()+strings.TrimSuffix(fp.Name(), compressedSuffix))
 		}
 	}
 
@@ -344,5 +464,15 @@ func (f *FileCache) GetAllHashes() ([]string, error) {
 }
 
 func (f *FileCache) Delete(hash string, logger *zerolog.Logger) error {
-	return os.Remove(path.Join(f.root, hash[:2], hash[2:]))
+	err := os.Remove(f.filePath(hash))
+
+	// The file might have been stored both compressed and not
+	compressedErr := os.Remove(f.filePath(hash) + compressedSuffix)
+	if err == nil && errors.Is(compressedErr, fs.ErrNotExist) {
+		return nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return compressedErr
+	}
+	return errors.Join(err, compressedErr)
 }
@@ -6,9 +6,12 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"os"
+	"strings"
 	"testing"
 	"testing/iotest"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -233,9 +236,10 @@ func TestCanGetStatistics(t *testing.T) {
 	cache, err := filecache.NewFileCache(t.TempDir(), 100, 1000, logger)
 	require.NoError(t, err)
 
-	count, totalSize, err := cache.GetStatistics()
+	count, contentSize, diskSize, err := cache.GetStatistics()
 	assert.Equal(t, int64(0), count)
-	assert.Equal(t, units.Bytes{Bytes: 0}, totalSize)
+	assert.Equal(t, units.Bytes{Bytes: 0}, contentSize)
+	assert.Equal(t, units.Bytes{Bytes: 0}, diskSize)
 	require.NoError(t, err)
 
 	for _, content := range []string{"one", "two", "three", "four", "five"} {
@@ -249,9 +253,10 @@ func TestCanGetStatistics(t *testing.T) {
 	require.NoError(t, err)
 	t.Cleanup(func() { require.NoError(t, reader.Close()) })
 
-	count, totalSize, err = cache.GetStatistics()
+	count, contentSize, diskSize, err = cache.GetStatistics()
 	assert.Equal(t, int64(5), count)
-	assert.Equal(t, units.Bytes{Bytes: 19}, totalSize)
+	assert.Equal(t, units.Bytes{Bytes: 19}, contentSize)
+	assert.Equal(t, units.Bytes{Bytes: 19}, diskSize)
 	require.NoError(t, err)
 }
 
@@ -286,9 +291,10 @@ func TestCanGetAllHashes(t *testing.T) {
 	cache, err := filecache.NewFileCache(t.TempDir(), 100, 1000, logger)
 	require.NoError(t, err)
 
-	count, totalSize, err := cache.GetStatistics()
+	count, contentSize, diskSize, err := cache.GetStatistics()
 	assert.Equal(t, int64(0), count)
-	assert.Equal(t, units.Bytes{Bytes: 0}, totalSize)
+	assert.Equal(t, units.Bytes{Bytes: 0}, contentSize)
+	assert.Equal(t, units.Bytes{Bytes: 0}, diskSize)
 	require.NoError(t, err)
 
 	for _, content := range []string{"one", "two"} {
@@ -327,6 +333,147 @@ func TestCanDelete(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCanStoreFilesCompressed(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(t, nil)
+	cache, err := filecache.NewFileCache(t.TempDir(), 100, 1000, logger)
+	require.NoError(t, err)
+
+	ingestCompressed := func(content string) string {
+		t.Helper()
+
+		var hash string
+		reader, ingestion := cache.SetupSharedIngestion(
+			io.NopCloser(bytes.NewBufferString(content)),
+			func(h string) { hash = h },
+			func() {},
+			logger,
+		)
+		require.NotNil(t, ingestion)
+		ingestion.CompressAbove(20)
+
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, content, string(data))
+		return hash
+	}
+
+	content := strings.Repeat(testData, 30)
+	compressedHash := ingestCompressed(content)
+	// Too small to be compressed
+	plainHash := ingestCompressed(testData)
+	// Files are compressed in the background
+	cache.Wait()
+
+	fp, err := cache.Open(compressedHash, logger)
+	require.NoError(t, err)
+	require.IsType(t, &filecache.CompressedFile{}, fp)
+	data, err := io.ReadAll(fp)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+	assert.Equal(t, content, string(data))
+
+	fp, err = cache.Open(compressedHash, logger)
+	require.NoError(t, err)
+	encoded, encoding := fp.(*filecache.CompressedFile).Encoded()
+	assert.Equal(t, "zstd", encoding)
+	decoder, err := zstd.NewReader(encoded)
+	require.NoError(t, err)
+	data, err = io.ReadAll(decoder)
+	decoder.Close()
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+	assert.Equal(t, content, string(data))
+
+	fp, err = cache.Open(plainHash, logger)
+	require.NoError(t, err)
+	require.IsType(t, &os.File{}, fp)
+	require.NoError(t, fp.Close())
+
+	contentSize, diskSize, err := cache.Size(compressedHash)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), contentSize)
+	assert.Less(t, diskSize, contentSize)
+
+	count, totalContentSize, totalDiskSize, err := cache.GetStatistics()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, int64(len(content)+len(testData)), totalContentSize.Bytes)
+	assert.Equal(t, diskSize+int64(len(testData)), totalDiskSize.Bytes)
+
+	hashes, err := cache.GetAllHashes()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{compressedHash, plainHash}, hashes)
+
+	require.NoError(t, cache.Delete(compressedHash, logger))
+	_, err = cache.Stat(compressedHash)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestCanSeekInFilesStoredCompressed(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(t, nil)
+	cache, err := filecache.NewFileCache(t.TempDir(), 1000, 10000, logger)
+	require.NoError(t, err)
+
+	content := strings.Repeat(testData, 30) + "end"
+	var hash string
+	reader, ingestion := cache.SetupSharedIngestion(
+		io.NopCloser(bytes.NewBufferString(content)),
+		func(h string) { hash = h },
+		func() {},
+		logger,
+	)
+	require.NotNil(t, ingestion)
+	ingestion.CompressAbove(0)
+	_, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	cache.Wait()
+
+	fp, err := cache.Open(hash, logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, fp.Close()) })
+	file := fp.(*filecache.CompressedFile)
+
+	size, err := file.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	offset, err := file.Seek(-3, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)-3), offset)
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, "end", string(data))
+
+	// Seeking back restarts from the beginning
+	_, err = file.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	data = make([]byte, 10)
+	_, err = io.ReadFull(file, data)
+	require.NoError(t, err)
+	assert.Equal(t, "6789012345", string(data))
+
+	offset, err = file.Seek(-5, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), offset)
+	_, err = io.ReadFull(file, data)
+	require.NoError(t, err)
+	assert.Equal(t, "1234567890", string(data))
+
+	_, err = file.Seek(int64(len(content)+10), io.SeekStart)
+	require.NoError(t, err)
+	_, err = file.Read(data)
+	require.ErrorIs(t, err, io.EOF)
+
+	_, err = file.Seek(-1, io.SeekStart)
+	require.Error(t, err)
+}
+
 func BenchmarkFileIngestion(b *testing.B) {
 	for _, size := range []string{"10KiB", "100KiB", "1MiB", "10MiB", "100MiB", "1GiB"} {
 		b.Run(size, func(b *testing.B) {
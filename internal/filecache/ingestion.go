@@ -0,0 +1,248 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrIngestionAborted = errors.New("the ingestion was aborted")
+	errInvalidSeek      = errors.New("invalid seek")
+)
+
+// Ingestion tracks a file while it is being written to the cache, and allows
+// other readers to follow its content as it grows, instead of waiting for it
+// to be committed.
+type Ingestion struct {
+	lock    sync.Mutex
+	cache   *FileCache
+	tmpPath string
+	written int64
+	hash    string
+	done    bool
+	err     error
+	update  chan struct{}
+	// compressAbove is the size from which the file is stored compressed, if
+	// it should be
+	compressAbove int64
+}
+
+func newIngestion(cache *FileCache, tmpPath string) *Ingestion {
+	return &Ingestion{cache: cache, tmpPath: tmpPath, compressAbove: -1}
+}
+
+// CompressAbove stores the file compressed once ingested, if it is at least of
+// the given size. Readers get its content decompressed either way.
+func (i *Ingestion) CompressAbove(size int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.compressAbove = max(size, 0)
+}
+
+// compression returns the size from which the file is stored compressed, and
+// whether it should be at all
+func (i *Ingestion) compression() (int64, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.compressAbove, i.compressAbove >= 0
+}
+
+// NewReader returns a reader over the content of the file being ingested.
+//
+// The reader blocks while waiting for more data to be written, and returns
+// io.EOF once the ingestion is complete. If the ingestion is aborted, the
+// reader returns ErrIngestionAborted.
+func (i *Ingestion) NewReader(ctx context.Context, logger *zerolog.Logger) (io.ReadCloser, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.err != nil {
+		return nil, i.err
+	}
+
+	if i.done {
+		if i.hash == "" {
+			// The file was fully written, but not kept in the cache
+			return nil, ErrIngestionAborted
+		}
+		return i.cache.Open(i.hash, logger)
+	}
+
+	fp, err := os.Open(i.tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ingestionReader{ingestion: i, fp: fp, ctx: ctx}, nil
+}
+
+func (i *Ingestion) state(offset int64) (written int64, done bool, wait chan struct{}, err error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.err != nil {
+		return i.written, i.done, nil, i.err
+	}
+
+	if !i.done && offset >= i.written {
+		if i.update == nil {
+			i.update = make(chan struct{})
+		}
+		wait = i.update
+	}
+
+	return i.written, i.done, wait, nil
+}
+
+func (i *Ingestion) notify() {
+	if i.update != nil {
+		close(i.update)
+		i.update = nil
+	}
+}
+
+func (i *Ingestion) advance(n int) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.written += int64(n)
+	i.notify()
+}
+
+// commit runs the given function, which is expected to move the temporary file
+// to its final location, while ensuring no new reader tries to open it.
+func (i *Ingestion) commit(hash string, move func() error) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if err := move(); err != nil {
+		return err
+	}
+
+	i.hash = hash
+	i.done = true
+	i.notify()
+	return nil
+}
+
+// complete marks the file as fully written, even though it is not kept in the
+// cache. Readers that are already following it can read it until the end.
+func (i *Ingestion) complete() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.done = true
+	i.notify()
+}
+
+func (i *Ingestion) abort() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.err = ErrIngestionAborted
+	i.done = true
+	i.notify()
+}
+
+type ingestionWriter struct {
+	dest      *os.File
+	ingestion *Ingestion
+}
+
+func (w *ingestionWriter) Write(p []byte) (int, error) {
+	n, err := w.dest.Write(p)
+	w.ingestion.advance(n)
+	return n, err
+}
+
+type ingestionReader struct {
+	ingestion *Ingestion
+	fp        *os.File
+	offset    int64
+	ctx       context.Context //nolint:containedctx
+}
+
+func (r *ingestionReader) Read(p []byte) (int, error) {
+	for {
+		written, done, wait, err := r.ingestion.state(r.offset)
+		if err != nil {
+			return 0, err
+		}
+
+		if written > r.offset {
+			toRead := min(int64(len(p)), written-r.offset)
+			n, err := r.fp.ReadAt(p[:toRead], r.offset)
+			r.offset += int64(n)
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return n, err
+		}
+
+		if done {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-wait:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// Seek moves the offset of the next read. Seeking relative to the end waits
+// until the ingestion is done, as the size is not known before.
+func (r *ingestionReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		size, err := r.waitForSize()
+		if err != nil {
+			return r.offset, err
+		}
+		offset += size
+	default:
+		return r.offset, fmt.Errorf("%w: unknown whence %d", errInvalidSeek, whence)
+	}
+
+	if offset < 0 {
+		return r.offset, fmt.Errorf("%w: negative offset %d", errInvalidSeek, offset)
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *ingestionReader) waitForSize() (int64, error) {
+	for {
+		written, done, wait, err := r.ingestion.state(math.MaxInt64)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			return written, nil
+		}
+
+		select {
+		case <-wait:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *ingestionReader) Close() error {
+	return r.fp.Close()
+}
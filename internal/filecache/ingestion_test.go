@@ -0,0 +1,240 @@
+package filecache_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/benjaminschubert/locaccel/internal/filecache"
+	"github.com/benjaminschubert/locaccel/internal/testutils"
+)
+
+func readAsync(t *testing.T, reader io.ReadCloser) <-chan []byte {
+	t.Helper()
+
+	result := make(chan []byte, 1)
+	go func() {
+		data, err := io.ReadAll(reader)
+		assert.NoError(t, reader.Close())
+		if assert.NoError(t, err) {
+			result <- data
+		}
+		close(result)
+	}()
+	return result
+}
+
+func TestCanFollowIngestionUntilCommitted(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(t, nil)
+	cache, err := filecache.NewFileCache(t.TempDir(), 100, 1000, logger)
+	require.NoError(t, err)
+
+	src, srcWriter := io.Pipe()
+	reader, ingestion := cache.SetupSharedIngestion(src, func(string) {}, func() {}, logger)
+	require.NotNil(t, ingestion)
+
+	go func() {
+		_, err := srcWriter.Write([]byte("12345"))
+		assert.NoError(t, err)
+		_, err = srcWriter.Write([]byte("67890"))
+		assert.NoError(t, err)
+		assert.NoError(t, srcWriter.Close())
+	}()
+
+	// Read part of the data, to ensure the follower attaches mid-way
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+
+	follower, err := ingestion.NewReader(t.Context(), logger)
+	require.NoError(t, err)
+	result := readAsync(t, follower)
+
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, testData, string(buf)+string(rest))
+
+	select {
+	case data := <-result:
+		assert.Equal(t, testData, string(data))
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "follower did not finish reading")
+	}
+
+	// New readers after the commit get the cached file
+	afterCommit, err := ingestion.NewReader(t.Context(), logger)
+	require.NoError(t, err)
+	data, err := io.ReadAll(afterCommit)
+	require.NoError(t, err)
+	require.NoError(t, afterCommit.Close())
+	assert.Equal(t, testData, string(data))
+}
+
+func TestFollowersGetAnErrorWhenIngestionIsAborted(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(
+		t,
+		[]string{"The file to ingest was not read fully before closing. Skipping ingestion"},
+	)
+	cache, err := filecache.NewFileCache(t.TempDir(), 100, 1000, logger)
+	require.NoError(t, err)
+
+	src, srcWriter := io.Pipe()
+	reader, ingestion := cache.SetupSharedIngestion(src, func(string) {
+		assert.Fail(t, "Hash should not have been called")
+	}, func() {}, logger)
+
+	go func() {
+		_, err := srcWriter.Write([]byte("12345"))
+		assert.NoError(t, err)
+		// Never close, the client disconnects before the end
+	}()
+
+	_, err = io.ReadFull(reader, make([]byte, 5))
+	require.NoError(t, err)
+
+	follower, err := ingestion.NewReader(t.Context(), logger)
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(follower)
+		errs <- err
+	}()
+
+	require.NoError(t, srcWriter.CloseWithError(io.ErrUnexpectedEOF))
+	require.NoError(t, reader.Close())
+
+	select {
+	case err := <-errs:
+		require.ErrorIs(t, err, filecache.ErrIngestionAborted)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "follower was not notified of the abort")
+	}
+	require.NoError(t, follower.Close())
+
+	_, err = ingestion.NewReader(t.Context(), logger)
+	require.ErrorIs(t, err, filecache.ErrIngestionAborted)
+}
+
+func TestFollowersCanFinishReadingFilesTooBigForTheCache(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(t, nil)
+	cache, err := filecache.NewFileCache(t.TempDir(), 2, 4, logger)
+	require.NoError(t, err)
+
+	src, srcWriter := io.Pipe()
+	reader, ingestion := cache.SetupSharedIngestion(src, func(string) {
+		assert.Fail(t, "Hash should not have been called")
+	}, func() {}, logger)
+
+	follower, err := ingestion.NewReader(t.Context(), logger)
+	require.NoError(t, err)
+	result := readAsync(t, follower)
+
+	go func() {
+		_, err := srcWriter.Write([]byte(testData))
+		assert.NoError(t, err)
+		assert.NoError(t, srcWriter.Close())
+	}()
+
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, testData, string(data))
+
+	select {
+	case data := <-result:
+		assert.Equal(t, testData, string(data))
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "follower did not finish reading")
+	}
+
+	_, err = ingestion.NewReader(t.Context(), logger)
+	require.ErrorIs(t, err, filecache.ErrIngestionAborted)
+}
+
+func TestFollowersStopWaitingWhenContextIsCancelled(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(t, nil)
+	cache, err := filecache.NewFileCache(t.TempDir(), 100, 1000, logger)
+	require.NoError(t, err)
+
+	src, srcWriter := io.Pipe()
+	reader, ingestion := cache.SetupSharedIngestion(src, func(string) {}, func() {}, logger)
+	t.Cleanup(func() {
+		assert.NoError(t, srcWriter.Close())
+		assert.NoError(t, reader.Close())
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	follower, err := ingestion.NewReader(ctx, logger)
+	require.NoError(t, err)
+
+	cancel()
+	_, err = follower.Read(make([]byte, 1))
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, follower.Close())
+}
+
+func TestFollowersCanSeekWhileIngesting(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(t, nil)
+	cache, err := filecache.NewFileCache(t.TempDir(), 100, 1000, logger)
+	require.NoError(t, err)
+
+	src, srcWriter := io.Pipe()
+	reader, ingestion := cache.SetupSharedIngestion(src, func(string) {}, func() {}, logger)
+
+	follower, err := ingestion.NewReader(t.Context(), logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, follower.Close()) })
+	seeker, ok := follower.(io.ReadSeeker)
+	require.True(t, ok)
+
+	// Seeking past the data written so far waits for it
+	offset, err := seeker.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), offset)
+
+	sizes := make(chan int64, 1)
+	go func() {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		assert.NoError(t, err)
+		sizes <- size
+	}()
+
+	go func() {
+		_, err := srcWriter.Write([]byte(testData))
+		assert.NoError(t, err)
+		assert.NoError(t, srcWriter.Close())
+	}()
+
+	_, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	select {
+	case size := <-sizes:
+		assert.Equal(t, int64(len(testData)), size)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "seeking to the end did not return once the ingestion was done")
+	}
+
+	_, err = seeker.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	data, err := io.ReadAll(seeker)
+	require.NoError(t, err)
+	assert.Equal(t, testData[5:], string(data))
+}
@@ -2,9 +2,11 @@ package admin
 
 import (
 	"embed"
+	"encoding/json"
 	"errors"
 	"html/template"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/hlog"
@@ -28,9 +30,15 @@ type indexData struct {
 	Version         string
 	CacheStats      httpclient.CacheStatistics
 	MiddlewareStats *middleware.Statistics
+	Upstreams       []httpclient.UpstreamHealth
 	Conf            string
 }
 
+type offlineStatus struct {
+	Global     bool            `json:"global"`
+	Registries map[string]bool `json:"registries"`
+}
+
 type hostnameData struct {
 	Hostname string
 	Entries  httpclient.CacheList
@@ -39,12 +47,15 @@ type hostnameData struct {
 func RegisterHandler(
 	handler *http.ServeMux,
 	cache *httpclient.Cache,
+	client *httpclient.Client,
+	offline httpclient.OfflineModes,
 	conf *config.Config,
 	middlewareStats *middleware.Statistics,
 ) error {
 	funcs := template.FuncMap{
 		"asBytes": units.PrettyBytes[uint64],
 		"join":    strings.Join,
+		"percent": func(rate float64) string { return strconv.FormatFloat(rate*100, 'f', 1, 64) },
 	}
 	templates, err := template.New("index").Funcs(funcs).ParseFS(templatesFS, "templates/*.tmpl")
 	if err != nil {
@@ -101,6 +112,68 @@ func RegisterHandler(
 		w.WriteHeader(http.StatusNoContent)
 	})
 
+	handler.HandleFunc(
+		"DELETE /hostname/{hostname}/negative",
+		func(w http.ResponseWriter, r *http.Request) {
+			id, _ := hlog.IDFromRequest(r)
+			logger := hlog.FromRequest(r)
+
+			removed, err := cache.RemoveNegativeEntries(
+				r.Context(),
+				r.PathValue("hostname"),
+				id.String(),
+			)
+			if err != nil {
+				logger.Error().Err(err).Msg("Unable to remove negative entries from cache")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info().Int64("removed", removed).Msg("Removed negative entries from cache")
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+
+	handler.HandleFunc("GET /offline", func(w http.ResponseWriter, r *http.Request) {
+		status := offlineStatus{offline.Global.IsSet(), map[string]bool{}}
+		for name, mode := range offline.Registries {
+			status.Registries[name] = mode.IsSet()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			hlog.FromRequest(r).Panic().Err(err).Msg("error returning an answer")
+		}
+	})
+
+	for method, enabled := range map[string]bool{http.MethodPut: true, http.MethodDelete: false} {
+		handler.HandleFunc(method+" /offline", func(w http.ResponseWriter, r *http.Request) {
+			offline.Global.Set(enabled)
+			hlog.FromRequest(r).Warn().Bool("offline", enabled).Msg("Changed global offline mode")
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		handler.HandleFunc(
+			method+" /offline/{registry}",
+			func(w http.ResponseWriter, r *http.Request) {
+				registry := r.PathValue("registry")
+				mode, ok := offline.Registries[registry]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				mode.Set(enabled)
+				hlog.FromRequest(r).
+					Warn().
+					Str("registry", registry).
+					Bool("offline", enabled).
+					Msg("Changed registry offline mode")
+				w.WriteHeader(http.StatusNoContent)
+			},
+		)
+	}
+
 	handler.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		id, _ := hlog.IDFromRequest(r)
 
@@ -118,7 +191,13 @@ func RegisterHandler(
 		err = templates.ExecuteTemplate(
 			w,
 			"index.html.tmpl",
-			indexData{version.Get(), stats, middlewareStats, renderedConfig},
+			indexData{
+				version.Get(),
+				stats,
+				middlewareStats,
+				client.UpstreamHealth(),
+				renderedConfig,
+			},
 		)
 		if err != nil {
 			hlog.FromRequest(r).Panic().Err(err).Msg("error sending the index.html")
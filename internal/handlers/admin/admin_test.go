@@ -35,6 +35,7 @@ func getAdminServer(
 		path.Join(t.TempDir(), "cache"),
 		units.Bytes{Bytes: 100},
 		units.Bytes{Bytes: 1000},
+		httpclient.Compression{},
 		logger,
 	)
 	require.NoError(t, err)
@@ -45,9 +46,22 @@ func getAdminServer(
 	conf, err := config.Default(func(s string) (string, bool) { return "", false })
 	require.NoError(t, err)
 
+	global := httpclient.NewOfflineMode(false, nil)
+	registry := httpclient.NewOfflineMode(false, global)
+
 	require.NoError(
 		t,
-		admin.RegisterHandler(handler, cache, conf, &middleware.Statistics{}),
+		admin.RegisterHandler(
+			handler,
+			cache,
+			testutils.NewClient(t, false, logger),
+			httpclient.OfflineModes{
+				Global:     global,
+				Registries: map[string]*httpclient.OfflineMode{"3142": registry},
+			},
+			conf,
+			&middleware.Statistics{},
+		),
 	)
 	server := httptest.NewServer(
 		middleware.ApplyAllMiddlewares(
@@ -206,6 +220,62 @@ func TestCanListEntriesPerHostname(t *testing.T) {
 	require.Contains(t, string(body), "<td>http://locaccel.test/admin2</td>")
 }
 
+func TestHidesPartitionsOfEntries(t *testing.T) {
+	t.Parallel()
+
+	key := "GET+http://locaccel.test/private"
+
+	server, cache := getAdminServer(t, nil)
+	require.NoError(
+		t,
+		cache.New([]byte(key), httpclient.CachedResponses{{ContentHash: "123"}}),
+	)
+	require.NoError(
+		t,
+		cache.New(
+			[]byte(key+"#partition=0123456789abcdef"),
+			httpclient.CachedResponses{{ContentHash: "456"}},
+		),
+	)
+
+	entries, err := cache.List(t.Context(), "locaccel.test", "test")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Len(t, entries["http://locaccel.test/private"]["GET"], 2)
+
+	req, err := http.NewRequestWithContext(
+		t.Context(),
+		http.MethodGet,
+		server.URL+"/hostname/"+url.PathEscape("locaccel.test"),
+		nil,
+	)
+	require.NoError(t, err)
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, resp.Body.Close())
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "0123456789abcdef")
+
+	req, err = http.NewRequestWithContext(
+		t.Context(),
+		http.MethodDelete,
+		server.URL+"/cache/"+url.PathEscape(key),
+		nil,
+	)
+	require.NoError(t, err)
+	resp, err = server.Client().Do(req)
+	require.NoError(t, err)
+
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	entries, err = cache.List(t.Context(), "locaccel.test", "test")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
 func TestRespondsForHealthcheck(t *testing.T) {
 	t.Parallel()
 
@@ -226,3 +296,103 @@ func TestRespondsForHealthcheck(t *testing.T) {
 	require.NoError(t, err)
 	require.Contains(t, string(data), "healthy")
 }
+
+func TestCanPurgeNegativeEntriesPerHostname(t *testing.T) {
+	t.Parallel()
+
+	server, cache := getAdminServer(t, nil)
+	require.NoError(
+		t,
+		cache.New(
+			[]byte("GET+http://locaccel.test/missing"),
+			httpclient.CachedResponses{{ContentHash: "123", StatusCode: http.StatusNotFound}},
+		),
+	)
+	require.NoError(
+		t,
+		cache.New(
+			[]byte("GET+http://locaccel.test/mixed"),
+			httpclient.CachedResponses{
+				{ContentHash: "123", StatusCode: http.StatusGone},
+				{ContentHash: "456", StatusCode: http.StatusOK},
+			},
+		),
+	)
+	require.NoError(
+		t,
+		cache.New(
+			[]byte("GET+http://other.test/missing"),
+			httpclient.CachedResponses{{ContentHash: "123", StatusCode: http.StatusNotFound}},
+		),
+	)
+
+	req, err := http.NewRequestWithContext(
+		t.Context(),
+		http.MethodDelete,
+		server.URL+"/hostname/locaccel.test/negative",
+		nil,
+	)
+	require.NoError(t, err)
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	entries, err := cache.List(t.Context(), "locaccel.test", "test")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Len(t, entries["http://locaccel.test/mixed"]["GET"], 1)
+	assert.Equal(t, "456", entries["http://locaccel.test/mixed"]["GET"][0].ContentHash)
+
+	entries, err = cache.List(t.Context(), "other.test", "test")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestCanToggleOfflineModes(t *testing.T) {
+	t.Parallel()
+
+	server, _ := getAdminServer(t, nil)
+
+	send := func(method, path string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(t.Context(), method, server.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := server.Client().Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	getStatus := func() string {
+		t.Helper()
+
+		resp := send(http.MethodGet, "/offline")
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, resp.Body.Close())
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	assert.JSONEq(t, `{"global": false, "registries": {"3142": false}}`, getStatus())
+
+	resp := send(http.MethodPut, "/offline/3142")
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `{"global": false, "registries": {"3142": true}}`, getStatus())
+
+	resp = send(http.MethodPut, "/offline")
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `{"global": true, "registries": {"3142": true}}`, getStatus())
+
+	resp = send(http.MethodDelete, "/offline/3142")
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `{"global": true, "registries": {"3142": false}}`, getStatus())
+
+	resp = send(http.MethodPut, "/offline/1234")
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -22,3 +22,22 @@ document.querySelector('#cacheEntries tbody').addEventListener('click', async (e
         alert(`Could not delete entry: ${err}`)
     }
 });
+
+document.querySelector('#purgeNegativeEntries').addEventListener('click', async (e) => {
+    const hostname = e.target.dataset.hostname;
+
+    if (!confirm(`Delete all entries for missing resources on ${hostname}?`)) {
+        return;
+    }
+
+    try {
+        const resp = await fetch(`/hostname/${encodeURIComponent(hostname)}/negative`, { method: 'DELETE' });
+        if (!resp.ok) {
+            throw new Error(`server returned: ${resp.status}`);
+        }
+        location.reload()
+    } catch (err) {
+        console.error(err);
+        alert(`Could not delete entries: ${err}`)
+    }
+});
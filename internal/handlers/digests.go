@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/hlog"
+
+	"github.com/benjaminschubert/locaccel/internal/httpclient"
+)
+
+// maxRememberedDigests bounds the number of files for which digests are kept
+const maxRememberedDigests = 50_000
+
+// Digests remembers the digests that the indexes of a registry promise for the
+// files they reference, so they can be verified when the files are requested.
+// Only the most recent ones are kept, indexes being requested again before the
+// files they reference in practice.
+type Digests struct {
+	mutex   sync.Mutex
+	digests map[string][]httpclient.Digest
+	// paths are the paths in the order they were added, as a ring buffer
+	paths []string
+	next  int
+}
+
+func NewDigests() *Digests {
+	return &Digests{digests: map[string][]httpclient.Digest{}}
+}
+
+// Set remembers the digests of the file served at the path
+func (d *Digests) Set(path string, digests ...httpclient.Digest) {
+	if len(digests) == 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.digests[path]; !ok {
+		if len(d.paths) < maxRememberedDigests {
+			d.paths = append(d.paths, path)
+		} else {
+			delete(d.digests, d.paths[d.next])
+			d.paths[d.next] = path
+			d.next = (d.next + 1) % maxRememberedDigests
+		}
+	}
+	d.digests[path] = digests
+}
+
+// Get returns the digests of the file served at the path, if known
+func (d *Digests) Get(path string) []httpclient.Digest {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.digests[path]
+}
+
+// Expect returns the request, expecting the response to match the digests of
+// the file it is for. Nil digests expect nothing, which avoids remembering them
+// when they are not verified.
+//
+// Digests are only remembered in memory, from the indexes that were served. If
+// they are not known anymore, for example after a restart, the file is
+// downloaded without being verified, which is logged.
+func (d *Digests) Expect(r *http.Request) *http.Request {
+	if d == nil {
+		return r
+	}
+
+	if digests := d.Get(r.URL.Path); len(digests) != 0 {
+		return r.WithContext(httpclient.WithExpectedDigests(r.Context(), digests...))
+	}
+
+	// Files served from the cache don't need to be verified again
+	return r.WithContext(httpclient.WithExpectedDigestsLookup(
+		r.Context(),
+		func() []httpclient.Digest {
+			hlog.FromRequest(r).
+				Warn().
+				Msg("the digests of the file are unknown, storing it without verifying it")
+			return nil
+		},
+	))
+}
@@ -3,14 +3,22 @@ package goproxy
 import (
 	"net/http"
 	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/hlog"
+	"golang.org/x/mod/module"
 
 	"github.com/benjaminschubert/locaccel/internal/handlers"
 	"github.com/benjaminschubert/locaccel/internal/httpclient"
 )
 
+// RegisterHandler registers the handlers proxying the Go modules from upstream,
+// and the checksum database, whose answers must be signed by the given key to
+// be used to verify the modules.
 func RegisterHandler(
 	upstream string,
 	sumdb string,
+	sumdbKey string,
 	handler *http.ServeMux,
 	client *httpclient.Client,
 	upstreamCaches []*url.URL,
@@ -39,7 +47,18 @@ func RegisterHandler(
 		)
 	})
 
+	// The checksum database never changes what it has, its answers are kept
+	var digests *handlers.Digests
+	if client.VerifiesDigests() {
+		digests = handlers.NewDigests()
+	}
+	checksumDB := newChecksumDatabase(sumdb, sumdbKey)
+
 	handler.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
+		if client.VerifiesDigests() {
+			r = expectDigests(r, client, checksumDB, sumdbCaches, digests)
+		}
+
 		handlers.Forward(
 			w,
 			r,
@@ -51,3 +70,90 @@ func RegisterHandler(
 		)
 	})
 }
+
+// expectDigests returns the request, expecting the response to match the hash
+// the checksum database has for it. Cached files were verified already, so the
+// database is only looked up for the ones downloaded.
+func expectDigests(
+	r *http.Request,
+	client *httpclient.Client,
+	sumdb *checksumDatabase,
+	caches httpclient.UpstreamCache,
+	digests *handlers.Digests,
+) *http.Request {
+	if digests.Get(r.URL.Path) != nil {
+		return digests.Expect(r)
+	}
+
+	return r.WithContext(httpclient.WithExpectedDigestsLookup(
+		r.Context(),
+		func() []httpclient.Digest {
+			digest, ok := lookupDigest(r, client, sumdb, caches)
+			if !ok {
+				return nil
+			}
+			digests.Set(r.URL.Path, digest)
+			return []httpclient.Digest{digest}
+		},
+	))
+}
+
+// lookupDigest returns the hash that the checksum database has for the module
+// zip or go.mod file requested, as found in go.sum files. Modules not in the
+// checksum database, like private ones, have none, and neither do ones whose
+// answer could not be verified against the database's key and log.
+func lookupDigest(
+	r *http.Request,
+	client *httpclient.Client,
+	sumdb *checksumDatabase,
+	caches httpclient.UpstreamCache,
+) (httpclient.Digest, bool) {
+	escapedModule, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@v/")
+	if !ok {
+		return httpclient.Digest{}, false
+	}
+	escapedVersion, isGoMod := strings.CutSuffix(file, ".mod")
+	if !isGoMod {
+		if escapedVersion, ok = strings.CutSuffix(file, ".zip"); !ok {
+			return httpclient.Digest{}, false
+		}
+	}
+
+	logger := hlog.FromRequest(r)
+
+	modulePath, err := module.UnescapePath(escapedModule)
+	if err != nil {
+		logger.Debug().Err(err).Msg("invalid module path, not verifying it")
+		return httpclient.Digest{}, false
+	}
+	version, err := module.UnescapeVersion(escapedVersion)
+	if err != nil {
+		logger.Debug().Err(err).Msg("invalid module version, not verifying it")
+		return httpclient.Digest{}, false
+	}
+	if isGoMod {
+		version += "/go.mod"
+	}
+
+	// Lines are `<module> <version> <hash>` and `<module> <version>/go.mod <hash>`
+	lines, err := sumdb.lookup(r.Context(), client, caches, logger, modulePath, version)
+	if err != nil {
+		logger.Warn().
+			Err(err).
+			Msg("unable to lookup the module in the checksum database, not verifying it")
+		return httpclient.Digest{}, false
+	}
+
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			digest, err := httpclient.ParseGoSumHash(fields[2], isGoMod)
+			if err != nil {
+				logger.Warn().Err(err).Msg("invalid hash in the checksum database")
+			}
+			return digest, err == nil
+		}
+	}
+
+	logger.Debug().Msg("module not found in the checksum database, not verifying it")
+	return httpclient.Digest{}, false
+}
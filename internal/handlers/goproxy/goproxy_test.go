@@ -1,13 +1,26 @@
 package goproxy_test
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/fs"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
 
 	"github.com/benjaminschubert/locaccel/internal/handlers/goproxy"
 	"github.com/benjaminschubert/locaccel/internal/handlers/testutils"
@@ -24,6 +37,7 @@ func TestInstallGoPackages(t *testing.T) {
 			goproxy.RegisterHandler(
 				"https://proxy.golang.org",
 				"https://sum.golang.org",
+				goproxy.DefaultSumDBKey,
 				handler,
 				client,
 				upstreamCaches,
@@ -62,3 +76,213 @@ func TestInstallGoPackages(t *testing.T) {
 		nil,
 	)
 }
+
+// newChecksumDatabase starts a checksum database knowing of the go.mod of a
+// module, and returns its URL, its key, and the number of lookups it got
+func newChecksumDatabase(
+	t *testing.T,
+	goModSum string,
+	caching string,
+) (uri, key string, lookups *atomic.Int32) {
+	t.Helper()
+
+	signer, verifier, err := note.GenerateKey(rand.Reader, "sumdb.test")
+	require.NoError(t, err)
+
+	server := sumdb.NewServer(sumdb.NewTestServer(
+		signer,
+		func(path, vers string) ([]byte, error) {
+			if path != "example.com/mod" || vers != "v1.0.0" {
+				return nil, fs.ErrNotExist
+			}
+			return []byte(path + " " + vers + "/go.mod " + goModSum + "\n"), nil
+		},
+	))
+
+	lookups = &atomic.Int32{}
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/lookup/") {
+				lookups.Add(1)
+			}
+			w.Header().Add("Cache-Control", caching)
+			server.ServeHTTP(w, r)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	return srv.URL, verifier, lookups
+}
+
+func goModSum(goMod string) string {
+	fileSum := sha256.Sum256([]byte(goMod))
+	sum := sha256.Sum256([]byte(hex.EncodeToString(fileSum[:]) + "  go.mod\n"))
+	return "h1:" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestOnlyLooksUpTheChecksumDatabaseForDownloads(t *testing.T) {
+	t.Parallel()
+
+	goMod := "module example.com/mod\n"
+
+	upstream := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Cache-Control", "public, max-age=3600")
+			_, err := w.Write([]byte(goMod))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(upstream.Close)
+
+	for _, tc := range []struct {
+		description     string
+		sumdbCaching    string
+		files           []string
+		expectedLookups int32
+		expectedMisses  uint64
+	}{
+		// Cached files were verified already
+		{"uncached", "no-store", []string{"v1.0.0.mod", "v1.0.0.mod"}, 1, 1},
+		// Lookups served from the cache are not the request's own state
+		{
+			"cached",
+			"public, max-age=3600",
+			[]string{"v1.0.0.zip", "v1.0.0.mod", "v1.0.0.mod"},
+			1,
+			2,
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			sumdbURL, sumdbKey, lookups := newChecksumDatabase(t, goModSum(goMod), tc.sumdbCaching)
+
+			logger := testutils.TestLogger(t, nil)
+			client := testutils.NewClient(t, false, logger)
+			handler := http.NewServeMux()
+			goproxy.RegisterHandler(
+				upstream.URL,
+				sumdbURL,
+				sumdbKey,
+				handler,
+				client.WithOptions(httpclient.Options{VerifyDigests: true}),
+				nil,
+			)
+			srv, stats := testutils.NewServer(
+				t,
+				handler,
+				"goproxy",
+				"upstream",
+				testutils.NewRequestCounterMiddleware(t),
+				logger,
+			)
+
+			for _, file := range tc.files {
+				req, err := http.NewRequestWithContext(
+					t.Context(),
+					http.MethodGet,
+					srv.URL+"/example.com/mod/@v/"+file,
+					nil,
+				)
+				require.NoError(t, err)
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				_, err = io.Copy(io.Discard, resp.Body)
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+
+			assert.Equal(t, tc.expectedLookups, lookups.Load())
+			assert.Equal(t, tc.expectedMisses, stats.CacheMisses.Load())
+			assert.Equal(t, uint64(len(tc.files))-tc.expectedMisses, stats.CacheHits.Load())
+		})
+	}
+}
+
+func TestOnlyTrustsTheChecksumDatabaseSignedByItsKey(t *testing.T) {
+	t.Parallel()
+
+	failure := []string{
+		"Response from upstream failed verification",
+		"an error happened ingesting the file",
+		"Error sending response to client",
+	}
+
+	for _, tc := range []struct {
+		description       string
+		trusted           bool
+		expectedDownloads int32
+		expectedErrors    []string
+	}{
+		// The tampered file is never stored
+		{"trusted", true, 2, slices.Concat(failure, failure)},
+		// Nothing is known about the file, which is stored as is
+		{"forged", false, 1, nil},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			downloads := atomic.Int32{}
+			upstream := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					downloads.Add(1)
+					w.Header().Add("Cache-Control", "public, max-age=3600")
+					_, err := w.Write([]byte("module example.com/tampered\n"))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(upstream.Close)
+
+			sumdbURL, sumdbKey, _ := newChecksumDatabase(
+				t,
+				goModSum("module example.com/mod\n"),
+				"no-store",
+			)
+			if !tc.trusted {
+				_, otherKey, err := note.GenerateKey(rand.Reader, "sumdb.test")
+				require.NoError(t, err)
+				sumdbKey = otherKey
+			}
+
+			logger := testutils.TestLogger(t, tc.expectedErrors)
+			handler := http.NewServeMux()
+			goproxy.RegisterHandler(
+				upstream.URL,
+				sumdbURL,
+				sumdbKey,
+				handler,
+				testutils.NewClient(t, false, logger).
+					WithOptions(httpclient.Options{VerifyDigests: true}),
+				nil,
+			)
+			srv, _ := testutils.NewServer(
+				t,
+				handler,
+				"goproxy",
+				"upstream",
+				testutils.NewRequestCounterMiddleware(t),
+				logger,
+			)
+
+			for range 2 {
+				req, err := http.NewRequestWithContext(
+					t.Context(),
+					http.MethodGet,
+					srv.URL+"/example.com/mod/@v/v1.0.0.mod",
+					nil,
+				)
+				require.NoError(t, err)
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					_, err = io.Copy(io.Discard, resp.Body)
+					require.NoError(t, resp.Body.Close())
+				}
+				// The tampered file is never served as a complete response
+				assert.Equal(t, tc.trusted, err != nil)
+			}
+
+			assert.Equal(t, tc.expectedDownloads, downloads.Load())
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/mod/sumdb"
+
+	"github.com/benjaminschubert/locaccel/internal/httpclient"
+)
+
+// DefaultSumDBKey is the key of sum.golang.org, which the go command trusts by
+// default
+const DefaultSumDBKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ppq+kMDJFrNeZGLB"
+
+// maxRemoteSize bounds the size of the answers of the checksum database, which
+// are either a few lines or a tile of hashes
+const maxRemoteSize = 64 * 1024
+
+var errUnexpectedStatus = errors.New("unexpected status from the checksum database")
+
+// checksumDatabase verifies the answers of a checksum database like the go
+// command does: they must be signed by its key, and be part of a log
+// consistent with the one seen before.
+type checksumDatabase struct {
+	url string
+	key string
+
+	// latest is the latest signed tree head seen, which newer ones must be
+	// consistent with. It is only kept in memory.
+	mutex  sync.Mutex
+	latest []byte
+}
+
+func newChecksumDatabase(url, key string) *checksumDatabase {
+	return &checksumDatabase{url: url, key: key}
+}
+
+// lookup returns the go.sum lines for the module version, or none if it is not
+// in the database. The requests are sent through the cache on behalf of the
+// request whose context is given, and each lookup only keeps the records and
+// tiles it needs in memory.
+func (d *checksumDatabase) lookup(
+	ctx context.Context,
+	client *httpclient.Client,
+	caches httpclient.UpstreamCache,
+	logger *zerolog.Logger,
+	modulePath, version string,
+) ([]string, error) {
+	ops := &checksumDatabaseOps{db: d, ctx: ctx, client: client, caches: caches, logger: logger}
+	lines, err := sumdb.NewClient(ops).Lookup(modulePath, version)
+	if err != nil && ops.notFound {
+		return nil, nil
+	}
+	return lines, err
+}
+
+// checksumDatabaseOps implements sumdb.ClientOps for a single lookup
+type checksumDatabaseOps struct {
+	db     *checksumDatabase
+	ctx    context.Context //nolint:containedctx
+	client *httpclient.Client
+	caches httpclient.UpstreamCache
+	logger *zerolog.Logger
+	// notFound is whether the database doesn't know of the module
+	notFound bool
+}
+
+// ReadRemote fetches records and tiles through the cache. They are verified
+// whether they come from the cache or not.
+func (o *checksumDatabaseOps) ReadRemote(path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(o.ctx, http.MethodGet, o.db.url+path[1:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.client.DoInternal(req, o.caches)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			o.logger.Debug().Err(err).Msg("error closing the checksum database answer")
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		o.notFound = true
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d for %s", errUnexpectedStatus, resp.StatusCode, path)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxRemoteSize))
+}
+
+func (o *checksumDatabaseOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.db.key), nil
+	}
+
+	// The only other configuration is the latest tree head
+	o.db.mutex.Lock()
+	defer o.db.mutex.Unlock()
+	return o.db.latest, nil
+}
+
+func (o *checksumDatabaseOps) WriteConfig(file string, old, new []byte) error {
+	o.db.mutex.Lock()
+	defer o.db.mutex.Unlock()
+
+	if !bytes.Equal(o.db.latest, old) {
+		return sumdb.ErrWriteConflict
+	}
+	o.db.latest = new
+	return nil
+}
+
+// ReadCache never finds anything, as the answers are cached as responses
+func (o *checksumDatabaseOps) ReadCache(file string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (o *checksumDatabaseOps) WriteCache(file string, data []byte) {}
+
+func (o *checksumDatabaseOps) Log(msg string) {
+	o.logger.Debug().Msg(msg)
+}
+
+func (o *checksumDatabaseOps) SecurityError(msg string) {
+	o.logger.Error().Str("details", msg).Msg("The checksum database answer failed verification")
+}
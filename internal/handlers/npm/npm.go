@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/benjaminschubert/locaccel/internal/handlers"
@@ -57,18 +58,29 @@ func RegisterHandler(
 		upstream = upstream[:len(upstream)-1]
 	}
 
-	upstreamCacheUrls := make([]string, 0, len(upstreamCaches))
-	for _, upstream := range upstreamCaches {
-		upstreamCacheUrls = append(upstreamCacheUrls, upstream.String())
+	// Upstream caches and peers are locaccel instances, and rewrite the tarballs
+	// to point to themselves
+	peers := client.Peers()
+	upstreamCacheUrls := make([]string, 0, len(upstreamCaches)+len(peers))
+	for _, upstream := range slices.Concat(upstreamCaches, peers) {
+		upstreamCacheUrls = append(upstreamCacheUrls, strings.TrimSuffix(upstream.String(), "/"))
 	}
 	caches := httpclient.UpstreamCache{Uris: upstreamCaches, Proxy: false}
 
+	// The packuments give the digests of the tarballs they reference
+	var digests *handlers.Digests
+	if client.VerifiesDigests() {
+		digests = handlers.NewDigests()
+	}
+
 	handler.HandleFunc("GET /{pkg}/-/{path}", func(w http.ResponseWriter, r *http.Request) {
+		r = digests.Expect(r)
 		handlers.Forward(w, r, upstream+r.URL.RequestURI(), client, nil, nil, caches)
 	})
 	handler.HandleFunc(
 		"GET /{namespace}/{pkg}/-/{path}",
 		func(w http.ResponseWriter, r *http.Request) {
+			r = digests.Expect(r)
 			handlers.Forward(w, r, upstream+r.URL.RequestURI(), client, nil, nil, caches)
 		},
 	)
@@ -82,7 +94,15 @@ func RegisterHandler(
 			func(body []byte, resp *http.Response, handler *handlers.JSONHandler) error {
 				switch resp.Header.Get("Content-Type") {
 				case "application/vnd.npm.install-v1+json":
-					return rewriteJson(body, r, upstream, scheme, upstreamCacheUrls, handler)
+					return rewriteJson(
+						body,
+						r,
+						upstream,
+						scheme,
+						upstreamCacheUrls,
+						digests,
+						handler,
+					)
 				default:
 					return fmt.Errorf(
 						"%w: %s",
@@ -102,6 +122,7 @@ func rewriteJson(
 	r *http.Request,
 	upstream, scheme string,
 	upstreamCaches []string,
+	digests *handlers.Digests,
 	handler *handlers.JSONHandler,
 ) error {
 	if _, err := handler.Buffer.Write(body); err != nil {
@@ -133,12 +154,33 @@ func rewriteJson(
 			}
 		}
 
-		version.Dist.Tarball = scheme + "://" + r.Host + strings.TrimPrefix(
-			version.Dist.Tarball,
-			remote,
-		)
+		path := strings.TrimPrefix(version.Dist.Tarball, remote)
+		version.Dist.Tarball = scheme + "://" + r.Host + path
+
+		if digests != nil {
+			digests.Set(path, distDigests(version.Dist)...)
+		}
 	}
 
 	handler.Buffer.Reset()
 	return handler.Encoder.Encode(data)
 }
+
+// distDigests returns the digests promised for the tarball of a version. Unknown
+// algorithms are skipped.
+func distDigests(dist Dist) []httpclient.Digest {
+	digests := make([]httpclient.Digest, 0, 2)
+
+	for integrity := range strings.FieldsSeq(dist.Integrity) {
+		if digest, err := httpclient.ParseSRI(integrity); err == nil {
+			digests = append(digests, digest)
+		}
+	}
+	if dist.Shasum != "" {
+		if digest, err := httpclient.ParseHexDigest("sha1", dist.Shasum); err == nil {
+			digests = append(digests, digest)
+		}
+	}
+
+	return digests
+}
@@ -1,16 +1,22 @@
 package npm
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/benjaminschubert/locaccel/internal/handlers"
 	"github.com/benjaminschubert/locaccel/internal/handlers/testutils"
 	"github.com/benjaminschubert/locaccel/internal/httpclient"
+	"github.com/benjaminschubert/locaccel/internal/middleware"
 )
 
 var npmInfo []byte = nil
@@ -59,6 +65,83 @@ func TestInstallNpmPackages(t *testing.T) {
 	)
 }
 
+func TestServesPackagesOwnedByPeers(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Cache-Control", "public, max-age=60")
+
+			if r.URL.Path == "/pkg/-/pkg-1.0.0.tgz" {
+				_, err := w.Write([]byte("tarball"))
+				assert.NoError(t, err)
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/vnd.npm.install-v1+json")
+			_, err := fmt.Fprintf(
+				w,
+				`{"name":"pkg","versions":{"1.0.0":{"version":"1.0.0",`+
+					`"dist":{"tarball":"http://%s/pkg/-/pkg-1.0.0.tgz"}}}}`,
+				r.Host,
+			)
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(upstream.Close)
+
+	logger := testutils.TestLogger(t, nil)
+	servers := make([]*httptest.Server, 0, 2)
+	muxes := make([]*http.ServeMux, 0, 2)
+	peers := make([]*url.URL, 0, 2)
+	for range 2 {
+		handler := http.NewServeMux()
+		srv := httptest.NewUnstartedServer(middleware.ApplyAllMiddlewares(
+			handler,
+			"npm",
+			logger,
+			prometheus.NewPedanticRegistry(),
+			&middleware.Statistics{},
+		))
+		t.Cleanup(srv.Close)
+		servers = append(servers, srv)
+		muxes = append(muxes, handler)
+		peers = append(peers, &url.URL{Scheme: "http", Host: srv.Listener.Addr().String()})
+	}
+
+	for i, srv := range servers {
+		client := testutils.NewClient(t, false, logger).WithOptions(httpclient.Options{
+			PeerGroup: httpclient.PeerGroup{Peers: peers, Self: peers[i]},
+		})
+		RegisterHandler(upstream.URL, "http", muxes[i], client, nil)
+		srv.Start()
+	}
+
+	get := func(uri string) string {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, uri, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		return string(body)
+	}
+
+	// Whichever owns the package, both instances serve it
+	for _, srv := range servers {
+		data := NpmProject{}
+		require.NoError(t, json.Unmarshal([]byte(get(srv.URL+"/pkg")), &data))
+
+		tarball := data.Versions["1.0.0"].Dist.Tarball
+		assert.Equal(t, srv.URL+"/pkg/-/pkg-1.0.0.tgz", tarball)
+		assert.Equal(t, "tarball", get(tarball))
+	}
+}
+
 func BenchmarkJSONRewrite(b *testing.B) {
 	if npmInfo == nil {
 		req, err := http.NewRequestWithContext(
@@ -84,7 +167,15 @@ func BenchmarkJSONRewrite(b *testing.B) {
 	jsonHandler := handlers.NewJSONHandler()
 
 	for b.Loop() {
-		err := rewriteJson(npmInfo, r, "https://registry.npmjs.org/", "https", nil, jsonHandler)
+		err := rewriteJson(
+			npmInfo,
+			r,
+			"https://registry.npmjs.org/",
+			"https",
+			nil,
+			nil,
+			jsonHandler,
+		)
 		require.NoError(b, err)
 		jsonHandler.Buffer.Reset()
 	}
@@ -3,6 +3,7 @@ package oci
 import (
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/benjaminschubert/locaccel/internal/handlers"
 	"github.com/benjaminschubert/locaccel/internal/httpclient"
@@ -28,7 +29,32 @@ func RegisterHandler(
 					return nil
 				}, caches)
 		} else {
+			if digest, ok := expectedDigest(r.PathValue("path")); ok {
+				r = r.WithContext(httpclient.WithExpectedDigests(r.Context(), digest))
+			}
 			handlers.Forward(w, r, registry+r.URL.RequestURI(), client, nil, nil, caches)
 		}
 	})
 }
+
+// expectedDigest returns the digest of the blob or manifest, when referenced by
+// digest, which its content must match
+func expectedDigest(path string) (httpclient.Digest, bool) {
+	for _, kind := range []string{"/blobs/", "/manifests/"} {
+		idx := strings.LastIndex(path, kind)
+		if idx == -1 {
+			continue
+		}
+
+		// Manifests can also be referenced by tag, which can't contain `:`
+		reference := path[idx+len(kind):]
+		if !strings.Contains(reference, ":") {
+			return httpclient.Digest{}, false
+		}
+
+		digest, err := httpclient.ParseOCIDigest(reference)
+		return digest, err == nil
+	}
+
+	return httpclient.Digest{}, false
+}
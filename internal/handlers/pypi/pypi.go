@@ -66,6 +66,12 @@ func RegisterHandler(
 	caches := httpclient.UpstreamCache{Uris: upstreamCaches, Proxy: false}
 	cachesWithCDN := httpclient.UpstreamCache{Uris: upstreamCachesWithCDN, Proxy: false}
 
+	// The indexes give the digests of the files they reference
+	var digests *handlers.Digests
+	if client.VerifiesDigests() {
+		digests = handlers.NewDigests()
+	}
+
 	// Index files
 	handler.HandleFunc("GET /simple/", func(w http.ResponseWriter, r *http.Request) {
 		handlers.Forward(
@@ -76,7 +82,7 @@ func RegisterHandler(
 			func(body []byte, resp *http.Response, jsonHandler *handlers.JSONHandler) error {
 				switch resp.Header.Get("Content-Type") {
 				case "application/vnd.pypi.simple.v1+json":
-					return rewriteJsonV1(body, expectedCDN, encodedCDN, jsonHandler)
+					return rewriteJsonV1(body, expectedCDN, encodedCDN, digests, jsonHandler)
 				default:
 					return fmt.Errorf(
 						"%w: %s",
@@ -93,6 +99,7 @@ func RegisterHandler(
 	handler.HandleFunc(
 		"GET "+encodedCDN+"/{path...}",
 		func(w http.ResponseWriter, r *http.Request) {
+			r = digests.Expect(r)
 			handlers.Forward(
 				w,
 				r,
@@ -109,6 +116,7 @@ func RegisterHandler(
 func rewriteJsonV1(
 	body []byte,
 	expectedCDN, encodedCDN string,
+	digests *handlers.Digests,
 	handler *handlers.JSONHandler,
 ) error {
 	if _, err := handler.Buffer.Write(body); err != nil {
@@ -152,8 +160,29 @@ func rewriteJsonV1(
 		uri.Path = encodedCDN + uri.Path
 
 		data.Files[i].Url = uri.String()
+
+		if digests != nil {
+			digests.Set(uri.Path, fileDigests(data.Files[i])...)
+		}
 	}
 
 	handler.Buffer.Reset()
 	return handler.Encoder.Encode(data)
 }
+
+// fileDigests returns the digests promised for a file. Unknown algorithms are
+// skipped.
+func fileDigests(file File) []httpclient.Digest {
+	hashes := map[string]string{}
+	if err := json.Unmarshal(file.Hashes, &hashes); err != nil {
+		return nil
+	}
+
+	digests := make([]httpclient.Digest, 0, len(hashes))
+	for algorithm, value := range hashes {
+		if digest, err := httpclient.ParseHexDigest(algorithm, value); err == nil {
+			digests = append(digests, digest)
+		}
+	}
+	return digests
+}
@@ -82,7 +82,7 @@ func BenchmarkJSONRewrite(b *testing.B) {
 	jsonHandler := handlers.NewJSONHandler()
 
 	for b.Loop() {
-		err := rewriteJsonV1(pytestInfo, cdn, encodedCDN, jsonHandler)
+		err := rewriteJsonV1(pytestInfo, cdn, encodedCDN, nil, jsonHandler)
 		require.NoError(b, err)
 		jsonHandler.Buffer.Reset()
 	}
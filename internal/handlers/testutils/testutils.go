@@ -80,6 +80,7 @@ func NewClientWithUnderlyingClient(
 		path.Join(tb.TempDir(), "cache"),
 		units.Bytes{Bytes: 100 * 1024 * 1024},
 		units.Bytes{Bytes: 1000 * 1024 * 1024},
+		httpclient.Compression{},
 		logger,
 	)
 	require.NoError(tb, err)
@@ -87,7 +88,7 @@ func NewClientWithUnderlyingClient(
 		assert.NoError(tb, cache.Close())
 	})
 
-	return httpclient.New(
+	cachingClient = httpclient.New(
 		client,
 		cache,
 		logger,
@@ -95,7 +96,11 @@ func NewClientWithUnderlyingClient(
 		notify,
 		time.Now,
 		time.Since,
-	), client
+	)
+	// Ensure requests in the background are done before closing the cache
+	tb.Cleanup(cachingClient.Wait)
+
+	return cachingClient, client
 }
 
 func NewServer(
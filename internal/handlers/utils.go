@@ -3,16 +3,20 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"maps"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"sync"
 
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog/hlog"
 
+	"github.com/benjaminschubert/locaccel/internal/filecache"
 	"github.com/benjaminschubert/locaccel/internal/httpclient"
 	"github.com/benjaminschubert/locaccel/internal/httpheaders"
 )
@@ -44,6 +48,24 @@ var (
 			return gzip.NewWriter(nil)
 		},
 	}
+	zstdReaderPool = sync.Pool{
+		New: func() any {
+			reader, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				panic(err)
+			}
+			return reader
+		},
+	}
+	zstdWriterPool = sync.Pool{
+		New: func() any {
+			writer, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				panic(err)
+			}
+			return writer
+		},
+	}
 )
 
 type JSONHandler struct {
@@ -88,13 +110,15 @@ func Forward(
 			}
 		}
 
-		if uerr, ok := err.(*url.Error); ok {
-			if uerr.Timeout() {
-				w.WriteHeader(http.StatusGatewayTimeout)
-			} else {
-				w.WriteHeader(http.StatusBadGateway)
-			}
-		} else {
+		uerr, isURLError := err.(*url.Error)
+		switch {
+		case isURLError && uerr.Timeout():
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case isURLError:
+			w.WriteHeader(http.StatusBadGateway)
+		case errors.Is(err, httpclient.ErrLoopDetected):
+			w.WriteHeader(http.StatusLoopDetected)
+		default:
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		hlog.FromRequest(r).
@@ -120,6 +144,13 @@ func Forward(
 		return
 	}
 
+	if modify == nil && r.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+		if content, ok := seekableContent(r, resp); ok {
+			serveContent(w, r, resp, content)
+			return
+		}
+	}
+
 	if modify != nil {
 		buffer := bufferPool.Get().(*bytes.Buffer)
 		defer func() {
@@ -148,22 +179,54 @@ func Forward(
 		struct{ io.Reader }{resp.Body},
 		*buf,
 	); err != nil {
-		if closer, ok := w.(io.Closer); ok {
-			if err2 := closer.Close(); err2 != nil {
-				hlog.FromRequest(r).
-					Panic().
-					Errs("errors", []error{err, err2}).
-					Msg("Error closing the body of the upstream request after having a problem sending it the data")
-			}
-		}
 		hlog.FromRequest(r).
 			Error().
 			Err(err).
 			Int64("written", n).
 			Msg("Error sending response to client")
+		// The headers are already sent, resetting the connection is the only way
+		// to tell the client the response is not complete
+		panic(http.ErrAbortHandler)
 	}
 }
 
+// seekableContent returns the body of the response if it can be served with
+// http.ServeContent. Cached files always can, which lets the kernel send them
+// directly, or decompresses only the ranges asked for if they are stored
+// compressed. Other seekable bodies only can when serving ranges, as finding
+// their size might require waiting for them to be fully downloaded.
+func seekableContent(r *http.Request, resp *http.Response) (io.ReadSeeker, bool) {
+	switch file := resp.Body.(type) {
+	case *os.File:
+		return file, true
+	case *filecache.CompressedFile:
+		return file, true
+	}
+
+	if r.Header.Get("Range") == "" {
+		return nil, false
+	}
+	content, ok := resp.Body.(io.ReadSeeker)
+	return content, ok
+}
+
+// serveContent answers the request from a full response, handling ranges,
+// including multipart and If-Range ones, and conditional requests
+func serveContent(
+	w http.ResponseWriter,
+	r *http.Request,
+	resp *http.Response,
+	content io.ReadSeeker,
+) {
+	maps.Copy(w.Header(), resp.Header)
+	// The length is computed from the content, and for the ranges served
+	w.Header().Del("Content-Length")
+
+	// An invalid or missing date is ignored
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", lastModified, content)
+}
+
 func modifyBody(
 	resp *http.Response,
 	r *http.Request,
@@ -171,6 +234,7 @@ func modifyBody(
 	buffer *bytes.Buffer,
 ) (err error) {
 	isGzipped := resp.Header.Get("Content-Encoding") == "gzip"
+	isZstd := resp.Header.Get("Content-Encoding") == "zstd"
 	body := resp.Body
 
 	if isGzipped {
@@ -182,6 +246,17 @@ func modifyBody(
 		body = gb
 	}
 
+	var zb *zstd.Decoder
+	if isZstd {
+		zb = zstdReaderPool.Get().(*zstd.Decoder)
+		if err := zb.Reset(body); err != nil {
+			zstdReaderPool.Put(zb)
+			return err
+		}
+		// Closing the decoder would make it unusable
+		body = io.NopCloser(zb)
+	}
+
 	_, err = io.Copy(buffer, body)
 
 	if isGzipped {
@@ -194,6 +269,12 @@ func modifyBody(
 		gzipReaderPool.Put(body)
 	}
 
+	if isZstd {
+		// Resetting without input releases the body
+		_ = zb.Reset(nil)
+		zstdReaderPool.Put(zb)
+	}
+
 	if cErr := resp.Body.Close(); cErr != nil {
 		hlog.FromRequest(r).
 			Error().
@@ -219,7 +300,8 @@ func modifyBody(
 
 	buffer.Reset()
 
-	if isGzipped {
+	switch {
+	case isGzipped:
 		writer := gzipWriterPool.Get().(*gzip.Writer)
 		writer.Reset(buffer)
 		_, err := writer.Write(jsonHandler.Buffer.Bytes())
@@ -232,7 +314,20 @@ func modifyBody(
 			return err
 		}
 		gzipWriterPool.Put(writer)
-	} else {
+	case isZstd:
+		writer := zstdWriterPool.Get().(*zstd.Encoder)
+		writer.Reset(buffer)
+		_, err := writer.Write(jsonHandler.Buffer.Bytes())
+		if err != nil {
+			zstdWriterPool.Put(writer)
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			zstdWriterPool.Put(writer)
+			return err
+		}
+		zstdWriterPool.Put(writer)
+	default:
 		buffer.Write(jsonHandler.Buffer.Bytes())
 	}
 
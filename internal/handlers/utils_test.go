@@ -6,11 +6,16 @@ import (
 	"crypto/rand"
 	"errors"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -146,6 +151,34 @@ func TestReturnsBadGatewayWhenUnableToContactUpstream(t *testing.T) {
 	assert.Empty(t, string(body))
 }
 
+func TestReturnsLoopDetectedWhenRequestAlreadyWentThroughThisInstance(t *testing.T) {
+	t.Parallel()
+
+	testReq := testRequest(t)
+	testReq.Header.Add("Via", "1.1 locaccel:3131")
+
+	recorder := httptest.NewRecorder()
+
+	handlers.Forward(
+		recorder,
+		testReq,
+		testEndpoint(t),
+		testutils.NewClientWithNotify(
+			t,
+			false,
+			func(r *http.Request, s string) {},
+			testutils.TestLogger(t, nil),
+		).WithOptions(httpclient.Options{Name: "locaccel:3131"}),
+		nil,
+		nil,
+		httpclient.UpstreamCache{},
+	)
+
+	result := recorder.Result()
+	require.NoError(t, result.Body.Close())
+	assert.Equal(t, http.StatusLoopDetected, result.StatusCode)
+}
+
 func TestReturnsErrorOnTimeoutFromUpstream(t *testing.T) {
 	t.Parallel()
 
@@ -363,6 +396,61 @@ func TestHandledModifyingGzippedRequestsTransparently(t *testing.T) {
 	assert.Equal(t, "Hello!", string(body))
 }
 
+func TestHandledModifyingZstdRequestsTransparently(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Encoding", "zstd")
+			w.WriteHeader(http.StatusOK)
+
+			zw, err := zstd.NewWriter(w)
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = zw.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+			assert.NoError(t, zw.Close())
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	recorder := httptest.NewRecorder()
+
+	req := testRequest(t)
+	req.Header.Add("Accept-Encoding", "zstd")
+
+	handlers.Forward(
+		recorder,
+		req,
+		srv.URL,
+		testutils.NewClientWithNotify(
+			t,
+			false,
+			func(r *http.Request, s string) {},
+			testutils.TestLogger(t, nil),
+		),
+		func(body []byte, resp *http.Response, jsonHandler *handlers.JSONHandler) error {
+			assert.Equal(t, "Hello!", string(body))
+			jsonHandler.Buffer.Write(body)
+			return nil
+		},
+		nil,
+		httpclient.UpstreamCache{},
+	)
+
+	result := recorder.Result()
+	zr, err := zstd.NewReader(result.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	zr.Close()
+	require.NoError(t, result.Body.Close())
+
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "Hello!", string(body))
+}
+
 func BenchmarkHandlingOfGzipResponses(b *testing.B) {
 	for _, size := range []units.Bytes{{Bytes: 1024 * 16}, {Bytes: 1024 * 1024}, {Bytes: 1024 * 1024 * 16}, {Bytes: 1024 * 1024 * 100}} {
 		b.Run("size="+size.String(), func(b *testing.B) {
@@ -426,3 +514,415 @@ func BenchmarkHandlingOfGzipResponses(b *testing.B) {
 		})
 	}
 }
+
+func TestAbortsResponsesFailingVerification(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description string
+		chunked     bool
+	}{
+		{"with-length", false},
+		{"chunked", true},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			// The end is only sent once the client got the headers
+			content := bytes.Repeat([]byte("tampered"), 16*1024)
+			release := make(chan struct{})
+			upstream := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("Cache-Control", "max-age=100")
+					if !tc.chunked {
+						w.Header().Add("Content-Length", strconv.Itoa(len(content)))
+					}
+					_, err := w.Write(content[:len(content)/2])
+					assert.NoError(t, err)
+					w.(http.Flusher).Flush()
+					<-release
+					_, err = w.Write(content[len(content)/2:])
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(upstream.Close)
+
+			logger := testutils.TestLogger(t, []string{
+				"Response from upstream failed verification",
+				"an error happened ingesting the file",
+				"Error sending response to client",
+			})
+			client := testutils.NewClientWithNotify(
+				t,
+				false,
+				func(r *http.Request, s string) {},
+				logger,
+			).WithOptions(httpclient.Options{VerifyDigests: true})
+
+			digest, err := httpclient.ParseOCIDigest(
+				"sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx := httpclient.WithExpectedDigests(logger.WithContext(r.Context()), digest)
+					r = r.WithContext(ctx)
+					handlers.Forward(w, r, upstream.URL, client, nil, nil, httpclient.UpstreamCache{})
+				}),
+			)
+			t.Cleanup(srv.Close)
+
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL, nil)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			close(release)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, resp.Body.Close())
+
+			// The client must not be able to mistake the response for a complete one
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			assert.Less(t, len(body), len(content))
+			client.Wait()
+		})
+	}
+}
+
+func TestServesRangesFromFullResponses(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description          string
+		headers              http.Header
+		expectedStatus       int
+		expectedContentRange string
+		expectedBody         string
+	}{
+		{
+			"single-range",
+			http.Header{"Range": []string{"bytes=1-3"}},
+			http.StatusPartialContent,
+			"bytes 1-3/6",
+			"ell",
+		},
+		{
+			"suffix-range",
+			http.Header{"Range": []string{"bytes=-2"}},
+			http.StatusPartialContent,
+			"bytes 4-5/6",
+			"o!",
+		},
+		{
+			"matching-if-range",
+			http.Header{"Range": []string{"bytes=1-3"}, "If-Range": []string{`"v1"`}},
+			http.StatusPartialContent,
+			"bytes 1-3/6",
+			"ell",
+		},
+		{
+			"outdated-if-range",
+			http.Header{"Range": []string{"bytes=1-3"}, "If-Range": []string{`"v0"`}},
+			http.StatusOK,
+			"",
+			"Hello!",
+		},
+		{
+			"unsatisfiable-range",
+			http.Header{"Range": []string{"bytes=10-"}},
+			http.StatusRequestedRangeNotSatisfiable,
+			"bytes */6",
+			"",
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				assert.Empty(t, r.Header.Get("Range"))
+				w.Header().Add("Etag", `"v1"`)
+				w.Header().Add("Cache-Control", "max-age=100")
+				_, err := w.Write([]byte("Hello!"))
+				assert.NoError(t, err)
+			}))
+			t.Cleanup(srv.Close)
+
+			client := testutils.NewClientWithNotify(
+				t,
+				false,
+				func(r *http.Request, s string) {},
+				testutils.TestLogger(t, nil),
+			)
+
+			// The first request is a miss, the second one served from the cache
+			for range 2 {
+				req := testRequest(t)
+				req.Header = tc.headers.Clone()
+
+				recorder := httptest.NewRecorder()
+				handlers.Forward(
+					recorder,
+					req,
+					srv.URL,
+					client,
+					nil,
+					nil,
+					httpclient.UpstreamCache{},
+				)
+
+				result := recorder.Result()
+				body, err := io.ReadAll(result.Body)
+				require.NoError(t, err)
+				require.NoError(t, result.Body.Close())
+
+				assert.Equal(t, tc.expectedStatus, result.StatusCode)
+				assert.Equal(t, tc.expectedContentRange, result.Header.Get("Content-Range"))
+				if tc.expectedStatus != http.StatusRequestedRangeNotSatisfiable {
+					assert.Equal(t, tc.expectedBody, string(body))
+				}
+
+				client.Wait()
+			}
+
+			assert.Equal(t, int32(1), requests.Load())
+		})
+	}
+}
+
+func TestServesRangesFromFilesStoredCompressed(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("Hello, compressed world! "), 20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Etag", `"v1"`)
+		w.Header().Add("Cache-Control", "max-age=100")
+		w.Header().Add("Content-Type", "text/plain")
+		// Sent chunked, without a length
+		_, err := w.Write(content[:100])
+		assert.NoError(t, err)
+		w.(http.Flusher).Flush()
+		_, err = w.Write(content[100:])
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	logger := testutils.TestLogger(t, nil)
+	cache, err := httpclient.NewCache(
+		t.TempDir(),
+		units.Bytes{Bytes: 100 * 1024},
+		units.Bytes{Bytes: 1000 * 1024},
+		httpclient.Compression{Enabled: true},
+		logger,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, cache.Close()) })
+	client := httpclient.New(
+		&http.Client{Transport: &http.Transport{}},
+		cache,
+		logger,
+		false,
+		func(r *http.Request, s string) {},
+		time.Now,
+		time.Since,
+	)
+
+	forward := func(method string, headers http.Header) (*http.Response, string) {
+		req := testRequest(t)
+		req.Method = method
+		req.Header = headers
+
+		recorder := httptest.NewRecorder()
+		handlers.Forward(recorder, req, srv.URL, client, nil, nil, httpclient.UpstreamCache{})
+
+		result := recorder.Result()
+		body, err := io.ReadAll(result.Body)
+		require.NoError(t, err)
+		require.NoError(t, result.Body.Close())
+		return result, string(body)
+	}
+
+	_, body := forward(http.MethodGet, http.Header{}) //nolint:bodyclose
+	assert.Equal(t, string(content), body)
+	// Files are compressed in the background
+	client.Wait()
+
+	result, body := forward( //nolint:bodyclose
+		http.MethodGet,
+		http.Header{"Range": []string{"bytes=7-16"}, "If-Range": []string{`"v1"`}},
+	)
+	assert.Equal(t, http.StatusPartialContent, result.StatusCode)
+	assert.Equal(t, "bytes 7-16/500", result.Header.Get("Content-Range"))
+	assert.Equal(t, "compressed", body)
+
+	result, body = forward(http.MethodGet, http.Header{}) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "500", result.Header.Get("Content-Length"))
+	assert.Equal(t, string(content), body)
+
+	result, _ = forward(http.MethodHead, http.Header{}) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "500", result.Header.Get("Content-Length"))
+}
+
+func TestServesRangesFromInFlightDownloads(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Add("Cache-Control", "max-age=100")
+		w.Header().Add("Content-Length", "12")
+		_, err := w.Write([]byte("Hello "))
+		assert.NoError(t, err)
+		w.(http.Flusher).Flush()
+		close(started)
+
+		<-release
+		_, err = w.Write([]byte("world!"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := testutils.NewClientWithNotify(
+		t,
+		false,
+		func(r *http.Request, s string) {},
+		testutils.TestLogger(t, nil),
+	)
+
+	forward := func(headers http.Header) (*http.Response, string) {
+		req := testRequest(t)
+		req.Header = headers
+
+		recorder := httptest.NewRecorder()
+		handlers.Forward(recorder, req, srv.URL, client, nil, nil, httpclient.UpstreamCache{})
+
+		result := recorder.Result()
+		body, err := io.ReadAll(result.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, result.Body.Close())
+		return result, string(body)
+	}
+
+	download := make(chan string)
+	go func() {
+		_, body := forward(http.Header{}) //nolint:bodyclose
+		download <- body
+	}()
+	<-started
+
+	ranged := make(chan struct{})
+	go func() {
+		defer close(ranged)
+
+		result, body := forward(http.Header{"Range": []string{"bytes=0-4"}}) //nolint:bodyclose
+		assert.Equal(t, http.StatusPartialContent, result.StatusCode)
+		assert.Equal(t, "bytes 0-4/12", result.Header.Get("Content-Range"))
+		assert.Equal(t, "Hello", body)
+	}()
+
+	select {
+	case <-ranged:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "The range was not served before the end of the download")
+	}
+
+	close(release)
+	assert.Equal(t, "Hello world!", <-download)
+	<-ranged
+	client.Wait()
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestServesMultipartRangesFromFullResponses(t *testing.T) {
+	t.Parallel()
+
+	req := testRequest(t)
+	req.Header.Set("Range", "bytes=0-0,5-5")
+
+	recorder := httptest.NewRecorder()
+	handlers.Forward(
+		recorder,
+		req,
+		testEndpoint(t),
+		testutils.NewClientWithNotify(
+			t,
+			false,
+			func(r *http.Request, s string) {},
+			testutils.TestLogger(t, nil),
+		),
+		nil,
+		nil,
+		httpclient.UpstreamCache{},
+	)
+
+	result := recorder.Result()
+	t.Cleanup(func() { assert.NoError(t, result.Body.Close()) })
+	assert.Equal(t, http.StatusPartialContent, result.StatusCode)
+
+	mediaType, params, err := mime.ParseMediaType(result.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	parts := []string{}
+	reader := multipart.NewReader(result.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		parts = append(parts, part.Header.Get("Content-Range")+": "+string(data))
+	}
+
+	assert.Equal(t, []string{"bytes 0-0/6: H", "bytes 5-5/6: !"}, parts)
+}
+
+func TestServesCachedFilesDirectly(t *testing.T) {
+	t.Parallel()
+
+	endpoint := testEndpoint(t)
+	client := testutils.NewClientWithNotify(
+		t,
+		false,
+		func(r *http.Request, s string) {},
+		testutils.TestLogger(t, nil),
+	)
+
+	forward := func(headers http.Header) *http.Response {
+		req := testRequest(t)
+		req.Header = headers
+
+		recorder := httptest.NewRecorder()
+		handlers.Forward(recorder, req, endpoint, client, nil, nil, httpclient.UpstreamCache{})
+		return recorder.Result()
+	}
+
+	// Populate the cache, the response is streamed from upstream
+	result := forward(http.Header{})
+	_, err := io.Copy(io.Discard, result.Body)
+	require.NoError(t, err)
+	require.NoError(t, result.Body.Close())
+	assert.Empty(t, result.Header.Get("Accept-Ranges"))
+
+	result = forward(http.Header{})
+	body, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	require.NoError(t, result.Body.Close())
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "Hello!", string(body))
+	assert.Equal(t, "bytes", result.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "6", result.Header.Get("Content-Length"))
+
+	// Conditional requests are handled too
+	result = forward(http.Header{"If-Match": []string{`"other"`}})
+	require.NoError(t, result.Body.Close())
+	assert.Equal(t, http.StatusPreconditionFailed, result.StatusCode)
+}
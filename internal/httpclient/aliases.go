@@ -0,0 +1,141 @@
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/rs/zerolog"
+
+	"github.com/benjaminschubert/locaccel/internal/database"
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// expectedDigests returns the digests the response to the request must match
+func expectedDigests(req *http.Request) []Digest {
+	switch digests := req.Context().Value(expectedDigestsCtx{}).(type) {
+	case []Digest:
+		return digests
+	case *digestsLookup:
+		return digests.get()
+	default:
+		return nil
+	}
+}
+
+// aliasableDigests returns the digests strong enough to identify a content.
+// Collisions can be crafted for SHA-1, which would let a content be substituted
+// for another's.
+func aliasableDigests(digests []Digest) []Digest {
+	return slices.DeleteFunc(slices.Clone(digests), func(digest Digest) bool {
+		return digest.Algorithm == SHA1
+	})
+}
+
+// saveDigests records the stored response as matching the digests it was
+// verified against, so that requests for other URLs expecting the same content
+// can be answered with it. The aliases belong to the partition the response was
+// stored in.
+func (c *Client) saveDigests(
+	digests []Digest,
+	partition string,
+	resp CachedResponse,
+	logger *zerolog.Logger,
+) {
+	for _, digest := range aliasableDigests(digests) {
+		if err := c.cache.SaveDigest(digest, partition, resp); err != nil {
+			logger.Warn().Err(err).Stringer("digest", digest).Msg("unable to save digest alias")
+		}
+	}
+}
+
+// serveFromDigests answers the request with a stored response matching all the
+// digests it expects, even if it was stored for another URL, or from another
+// registry. Its content was verified against the digests when it was stored, and
+// is thus exactly what upstream would send, however old it is.
+//
+// Responses are looked up in the partition of the request first, then in the
+// shared cache, which is available to everyone.
+func (c *Client) serveFromDigests(req *http.Request, logger *zerolog.Logger) *http.Response {
+	if !c.opts.VerifyDigests {
+		return nil
+	}
+
+	digests := aliasableDigests(expectedDigests(req))
+	if len(digests) == 0 {
+		return nil
+	}
+
+	dbEntry := cachedResponsesPool.Get().(*database.Entry[CachedResponses])
+	defer cachedResponsesPool.Put(dbEntry)
+
+	for _, partition := range slices.Compact([]string{c.partition(req), ""}) {
+		if resp := c.serveFromDigestsIn(partition, digests, dbEntry, logger); resp != nil {
+			return resp
+		}
+	}
+
+	return nil
+}
+
+// serveFromDigestsIn answers with a response of the partition whose content was
+// verified against every one of the digests
+func (c *Client) serveFromDigestsIn(
+	partition string,
+	digests []Digest,
+	dbEntry *database.Entry[CachedResponses],
+	logger *zerolog.Logger,
+) *http.Response {
+	getByDigest := func(digest Digest) bool {
+		err := c.cache.GetByDigest(digest, partition, dbEntry)
+		if err != nil && !errors.Is(err, database.ErrKeyNotFound) {
+			logger.Debug().Err(err).Msg("unable to retrieve digest alias from database")
+		}
+		return err == nil
+	}
+
+	// The contents matching all the other digests, nil if there are none
+	var matching map[string]bool
+	for _, digest := range digests[1:] {
+		if !getByDigest(digest) {
+			return nil
+		}
+
+		hashes := make(map[string]bool, len(dbEntry.Value))
+		for _, resp := range dbEntry.Value {
+			if matching == nil || matching[resp.ContentHash] {
+				hashes[resp.ContentHash] = true
+			}
+		}
+		matching = hashes
+	}
+
+	if !getByDigest(digests[0]) {
+		return nil
+	}
+
+	for _, resp := range dbEntry.Value {
+		if matching != nil && !matching[resp.ContentHash] {
+			continue
+		}
+
+		body, err := c.cache.Open(resp.ContentHash, logger)
+		if err != nil {
+			logger.Debug().Err(err).Msg("content of the digest alias was pruned already")
+			continue
+		}
+
+		logger.Debug().Stringer("digest", digests[0]).Msg("serving response with the same digests")
+		age := httpcaching.GetCurrentAge(resp.TimeAtResponseCreation, c.since)
+		headers := resp.Headers.Clone()
+		headers.Set("Age", strconv.FormatFloat(age.Seconds(), 'f', 0, 64))
+		return &http.Response{
+			Body:       body,
+			Header:     headers,
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return nil
+}
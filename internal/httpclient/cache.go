@@ -1,6 +1,7 @@
 package httpclient
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -17,34 +18,53 @@ import (
 
 	"github.com/benjaminschubert/locaccel/internal/database"
 	"github.com/benjaminschubert/locaccel/internal/filecache"
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
 	"github.com/benjaminschubert/locaccel/internal/units"
 )
 
 type CacheStatistics struct {
-	DatabaseSize     units.Bytes
-	DatabaseEntries  int64
-	FileCacheSize    units.Bytes
-	FileCacheEntries int64
-	UsagePerHostName map[string]struct {
-		Entries int64
-		Size    units.Bytes
-	}
+	// DatabaseSize is the space used by the entries, while DatabaseContentSize
+	// is the size of their keys and values
+	DatabaseSize        units.Bytes
+	DatabaseContentSize units.Bytes
+	DatabaseEntries     int64
+	// FileCacheSize is the space used on disk, while FileCacheContentSize is
+	// the size of the files, larger if some are stored compressed
+	FileCacheSize        units.Bytes
+	FileCacheContentSize units.Bytes
+	FileCacheEntries     int64
+	UsagePerHostName     map[string]HostnameUsage
+}
+
+type HostnameUsage struct {
+	Entries int64
+	Size    units.Bytes
+	// NegativeEntries are the responses stored for missing resources
+	NegativeEntries int64
+	// ContentSize is the size of the files, larger than the space they use if
+	// some are stored compressed
+	ContentSize units.Bytes
 }
 
 type CacheList map[string]map[string]CachedResponses
 
 type Cache struct {
-	db         *database.Database[CachedResponses, *CachedResponses]
-	cache      *filecache.FileCache
-	logger     *zerolog.Logger
-	stopSignal chan struct{}
-	stopWait   *sync.WaitGroup
-	cacheLock  *sync.Mutex
+	db          *database.Database[CachedResponses, *CachedResponses]
+	cache       *filecache.FileCache
+	compression Compression
+	logger      *zerolog.Logger
+	stopSignal  chan struct{}
+	stopWait    *sync.WaitGroup
+	cacheLock   *sync.Mutex
+	// partitionSecret keys the partitions derived from credentials, so they
+	// cannot be linked back to them without access to the database
+	partitionSecret []byte
 }
 
 func NewCache(
 	cachePath string,
 	quotaLow, quotaHigh units.Bytes,
+	compression Compression,
 	logger *zerolog.Logger,
 ) (*Cache, error) {
 	fileCacheLogger := logger.With().Str("component", "filecache").Logger()
@@ -72,7 +92,21 @@ func NewCache(
 		return nil, fmt.Errorf("unable to initialize database: %w", err)
 	}
 
-	cache := Cache{db, fileCache, logger, make(chan struct{}), &sync.WaitGroup{}, &sync.Mutex{}}
+	partitionSecret, err := db.Secret("partition-secret", 32)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	cache := Cache{
+		db,
+		fileCache,
+		compression,
+		logger,
+		make(chan struct{}),
+		&sync.WaitGroup{},
+		&sync.Mutex{},
+		partitionSecret,
+	}
 	cache.stopWait.Add(1)
 	go cache.ManageCache()
 	return &cache, nil
@@ -86,29 +120,33 @@ func (c *Cache) Close() error {
 
 	close(c.stopSignal)
 	c.stopWait.Wait()
+	c.cache.Wait()
 	err := c.db.Close()
 	c.stopSignal = nil
 	return err
 }
 
 func (c *Cache) GetStatistics(ctx context.Context, logId string) (CacheStatistics, error) {
-	dbEntries, dbTotalSize, err := c.db.GetStatistics()
+	dbEntries, dbContentSize, dbTotalSize, err := c.db.GetStatistics()
 	if err != nil {
 		return CacheStatistics{}, err
 	}
 
-	fileCacheEntries, fileCacheTotalSize, err := c.cache.GetStatistics()
+	fileCacheEntries, fileCacheContentSize, fileCacheTotalSize, err := c.cache.GetStatistics()
 	if err != nil {
 		return CacheStatistics{}, err
 	}
 
-	usagePerHostname := map[string]struct {
-		Entries int64
-		Size    units.Bytes
-	}{}
+	usagePerHostname := map[string]HostnameUsage{}
 
 	err = c.db.Iterate(ctx,
 		func(key []byte, responses *database.Entry[CachedResponses]) error {
+			// Aliases only point to responses already accounted for
+			if bytes.HasPrefix(key, []byte(digestKeyPrefix)) {
+				dbEntries--
+				return nil
+			}
+
 			uri, err := url.Parse(string(key))
 			if err != nil {
 				return err
@@ -120,9 +158,14 @@ func (c *Cache) GetStatistics(ctx context.Context, logId string) (CacheStatistic
 			entry.Entries += int64(len(responses.Value))
 
 			for _, resp := range responses.Value {
-				stat, err := c.cache.Stat(resp.ContentHash)
+				if httpcaching.IsNegativeResponse(resp.StatusCode) {
+					entry.NegativeEntries += 1
+				}
+
+				contentSize, diskSize, err := c.cache.Size(resp.ContentHash)
 				if err == nil {
-					entry.Size.Bytes += stat.Size()
+					entry.Size.Bytes += diskSize
+					entry.ContentSize.Bytes += contentSize
 				} else if !errors.Is(err, fs.ErrNotExist) {
 					return err
 				}
@@ -139,7 +182,13 @@ func (c *Cache) GetStatistics(ctx context.Context, logId string) (CacheStatistic
 	}
 
 	return CacheStatistics{
-		dbTotalSize, dbEntries, fileCacheTotalSize, fileCacheEntries, usagePerHostname,
+		dbTotalSize,
+		dbContentSize,
+		dbEntries,
+		fileCacheTotalSize,
+		fileCacheContentSize,
+		fileCacheEntries,
+		usagePerHostname,
 	}, nil
 }
 
@@ -155,6 +204,40 @@ func (c *Cache) Get(key []byte, entry *database.Entry[CachedResponses]) error {
 	return c.db.Get(key, entry)
 }
 
+// digestKeyPrefix prefixes the keys of the aliases from digests to the stored
+// responses matching them. Methods are upper case, so they never clash with the
+// keys of the responses themselves.
+const digestKeyPrefix = "digest+"
+
+func digestKey(digest Digest) []byte {
+	return []byte(digestKeyPrefix + digest.String())
+}
+
+// SaveDigest records the stored response as one whose content matches the
+// digest, replacing any previous one, as they all have the same content. Aliases
+// to responses stored in a partition are only available in the same partition.
+func (c *Cache) SaveDigest(digest Digest, partition string, resp CachedResponse) error {
+	key := withPartition(digestKey(digest), partition)
+
+	entry := new(database.Entry[CachedResponses])
+	if err := c.db.Get(key, entry); err != nil && !errors.Is(err, database.ErrKeyNotFound) {
+		return err
+	}
+
+	entry.Value = CachedResponses{resp}
+	return c.db.Save(key, entry)
+}
+
+// GetByDigest loads the stored responses whose content matches the digest,
+// whichever request of the partition they were stored for.
+func (c *Cache) GetByDigest(
+	digest Digest,
+	partition string,
+	entry *database.Entry[CachedResponses],
+) error {
+	return c.db.Get(withPartition(digestKey(digest), partition), entry)
+}
+
 func (c *Cache) Open(hash string, logger *zerolog.Logger) (io.ReadCloser, error) {
 	return c.cache.Open(hash, logger)
 }
@@ -168,6 +251,15 @@ func (c *Cache) SetupIngestion(
 	return c.cache.SetupIngestion(src, onIngest, onCleanup, logger)
 }
 
+func (c *Cache) SetupSharedIngestion(
+	src io.ReadCloser,
+	onIngest func(hash string),
+	onCleanup func(),
+	logger *zerolog.Logger,
+) (io.ReadCloser, *filecache.Ingestion) {
+	return c.cache.SetupSharedIngestion(src, onIngest, onCleanup, logger)
+}
+
 func (c *Cache) List(ctx context.Context, hostname, logId string) (CacheList, error) {
 	list := make(CacheList)
 
@@ -183,11 +275,13 @@ func (c *Cache) List(ctx context.Context, hostname, logId string) (CacheList, er
 				return nil
 			}
 
+			// Partitions are not shown, they are derived from credentials
+			k, _, _ = strings.Cut(k, partitionSeparator)
 			method, path, _ := strings.Cut(k, "+")
 			if list[path] == nil {
 				list[path] = make(map[string]CachedResponses, 1)
 			}
-			list[path][method] = responses.Value
+			list[path][method] = append(list[path][method], responses.Value...)
 			return nil
 		},
 		logId,
@@ -195,7 +289,33 @@ func (c *Cache) List(ctx context.Context, hostname, logId string) (CacheList, er
 	return list, err
 }
 
+// Remove deletes the responses stored for the key, in the shared cache and in
+// all the partitions, along with their files.
 func (c *Cache) Remove(key []byte, logger *zerolog.Logger) error {
+	partitions, err := c.db.Keys([]byte(string(key) + partitionSeparator))
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, k := range append(partitions, key) {
+		err := c.remove(k, logger)
+		if errors.Is(err, database.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+
+	if !found {
+		return database.ErrKeyNotFound
+	}
+	return nil
+}
+
+func (c *Cache) remove(key []byte, logger *zerolog.Logger) error {
 	entry := new(database.Entry[CachedResponses])
 	if err := c.db.Get(key, entry); err != nil {
 		return err
@@ -218,6 +338,97 @@ func (c *Cache) Remove(key []byte, logger *zerolog.Logger) error {
 	return err
 }
 
+// Forget removes the entry from the database. Contrary to Remove, it keeps the
+// files, as they might be shared with other entries, and lets the cleanup prune
+// them if they are not.
+func (c *Cache) Forget(key []byte) error {
+	entry := new(database.Entry[CachedResponses])
+	if err := c.db.Get(key, entry); err != nil {
+		if errors.Is(err, database.ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+	return c.db.Delete(key, entry)
+}
+
+// RemoveNegativeEntries removes all the responses for missing resources stored
+// for the given hostname, and returns how many were removed.
+func (c *Cache) RemoveNegativeEntries(
+	ctx context.Context,
+	hostname, logId string,
+) (removed int64, err error) {
+	err = c.db.Iterate(ctx,
+		func(key []byte, responses *database.Entry[CachedResponses]) error {
+			uri, err := url.Parse(string(key))
+			if err != nil {
+				return err
+			}
+			if uri.Hostname() != hostname {
+				return nil
+			}
+
+			validValues := make(CachedResponses, 0, len(responses.Value))
+			for _, resp := range responses.Value {
+				if !httpcaching.IsNegativeResponse(resp.StatusCode) {
+					validValues = append(validValues, resp)
+				}
+			}
+
+			if len(validValues) == len(responses.Value) {
+				return nil
+			}
+			removed += int64(len(responses.Value) - len(validValues))
+
+			// The files are left for the cleanup to prune, they might be shared
+			if len(validValues) == 0 {
+				return c.db.Delete(key, responses)
+			}
+			responses.Value = validValues
+			return c.db.Save(key, responses)
+		},
+		logId,
+	)
+	return removed, err
+}
+
+// MarkStale makes all the responses stored for the key stale, in the shared
+// cache and in all the partitions, so they need to be revalidated before being
+// served again. They can still be served where stale responses are allowed.
+//
+// staleCreation returns the creation time making the response stale. Responses
+// already older are left untouched.
+func (c *Cache) MarkStale(key []byte, staleCreation func(CachedResponse) time.Time) error {
+	partitions, err := c.db.Keys([]byte(string(key) + partitionSeparator))
+	if err != nil {
+		return err
+	}
+
+	for _, k := range append(partitions, key) {
+		if err := c.markStale(k, staleCreation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) markStale(key []byte, staleCreation func(CachedResponse) time.Time) error {
+	entry := new(database.Entry[CachedResponses])
+	if err := c.db.Get(key, entry); err != nil {
+		if errors.Is(err, database.ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	for idx, resp := range entry.Value {
+		if created := staleCreation(resp); created.Before(resp.TimeAtResponseCreation) {
+			entry.Value[idx].TimeAtResponseCreation = created
+		}
+	}
+	return c.db.Save(key, entry)
+}
+
 func (c *Cache) CleanupOldEntries(logId string) {
 	c.cacheLock.Lock()
 	defer c.cacheLock.Unlock()
@@ -100,6 +100,7 @@ func TestCanGetStatisticsOnEmptyCache(t *testing.T) {
 		t.TempDir(),
 		units.Bytes{Bytes: 10},
 		units.Bytes{Bytes: 20},
+		Compression{},
 		testutils.TestLogger(t, nil),
 	)
 	require.NoError(t, err)
@@ -107,10 +108,19 @@ func TestCanGetStatisticsOnEmptyCache(t *testing.T) {
 
 	stats, err := cache.GetStatistics(t.Context(), "test")
 	require.NoError(t, err)
-	require.Equal(t, CacheStatistics{units.Bytes{}, 0, units.Bytes{}, 0, map[string]struct {
-		Entries int64
-		Size    units.Bytes
-	}{}}, stats)
+	require.Equal(
+		t,
+		CacheStatistics{
+			units.Bytes{},
+			units.Bytes{},
+			0,
+			units.Bytes{},
+			units.Bytes{},
+			0,
+			map[string]HostnameUsage{},
+		},
+		stats,
+	)
 }
 
 func TestCanGetStatistics(t *testing.T) {
@@ -122,6 +132,7 @@ func TestCanGetStatistics(t *testing.T) {
 		t.TempDir(),
 		units.Bytes{Bytes: 10},
 		units.Bytes{Bytes: 20},
+		Compression{},
 		testutils.TestLogger(t, nil),
 	)
 	require.NoError(t, err)
@@ -154,14 +165,51 @@ func TestCanGetStatistics(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(
 		t,
-		CacheStatistics{units.Bytes{Bytes: 528}, 4, units.Bytes{Bytes: 27}, 5, map[string]struct {
-			Entries int64
-			Size    units.Bytes
-		}{"one.test": {1, units.Bytes{Bytes: 3}}, "two.test": {2, units.Bytes{Bytes: 10}}, "three.test": {2, units.Bytes{Bytes: 14}}}},
+		CacheStatistics{
+			units.Bytes{Bytes: 528},
+			units.Bytes{Bytes: 528},
+			4,
+			units.Bytes{Bytes: 27},
+			units.Bytes{Bytes: 27},
+			5,
+			map[string]HostnameUsage{
+				"one.test":   {1, units.Bytes{Bytes: 3}, 0, units.Bytes{Bytes: 3}},
+				"two.test":   {2, units.Bytes{Bytes: 10}, 0, units.Bytes{Bytes: 10}},
+				"three.test": {2, units.Bytes{Bytes: 14}, 0, units.Bytes{Bytes: 14}},
+			},
+		},
 		stats,
 	)
 }
 
+func TestStatisticsDoNotCountDigestAliases(t *testing.T) {
+	t.Parallel()
+
+	clock := &Clock{}
+
+	cache, err := NewCache(
+		t.TempDir(),
+		units.Bytes{Bytes: 10},
+		units.Bytes{Bytes: 20},
+		Compression{},
+		testutils.TestLogger(t, nil),
+	)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, cache.Close()) }()
+
+	addEntry(t, cache, "https://one.test/hello", []string{"one"}, clock)
+
+	entry := new(database.Entry[CachedResponses])
+	require.NoError(t, cache.Get([]byte("https://one.test/hello"), entry))
+	digest := Digest{SHA256, []byte("0123456789abcdef0123456789abcdef")}
+	require.NoError(t, cache.SaveDigest(digest, "", entry.Value[0]))
+
+	stats, err := cache.GetStatistics(t.Context(), "test")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.DatabaseEntries)
+	assert.Equal(t, int64(1), stats.UsagePerHostName["one.test"].Entries)
+}
+
 func TestDoesNotCleanOldEntriesWithCacheUnderLimit(t *testing.T) {
 	t.Parallel()
 
@@ -171,6 +219,7 @@ func TestDoesNotCleanOldEntriesWithCacheUnderLimit(t *testing.T) {
 		t.TempDir(),
 		units.Bytes{Bytes: 10},
 		units.Bytes{Bytes: 20},
+		Compression{},
 		testutils.TestLogger(t, nil),
 	)
 	require.NoError(t, err)
@@ -205,6 +254,7 @@ func TestCanCleanOldEntries(t *testing.T) {
 		cachePath,
 		units.Bytes{Bytes: 10},
 		units.Bytes{Bytes: 20},
+		Compression{},
 		testutils.TestLogger(t, nil),
 	)
 	require.NoError(t, err)
@@ -0,0 +1,194 @@
+// This implements the Cache-Status header from RFC 9211, and the Via header from
+// RFC 9110, letting clients know how their requests were handled, and
+// detecting requests looping through misconfigured caches.
+//
+// See https://www.rfc-editor.org/rfc/rfc9211
+// See https://www.rfc-editor.org/rfc/rfc9110#section-7.6.3
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// viaProtocol is the protocol version under which requests are forwarded
+const viaProtocol = "1.1"
+
+var ErrLoopDetected = errors.New("the request already went through this instance")
+
+type cacheStatusCtx struct{}
+
+// cacheStatus describes how the request was handled, in addition to the state
+// notified to the client's caller
+type cacheStatus struct {
+	state string
+	// fwd is why the request was forwarded, if it was
+	fwd string
+	// fwdStatus is the status code of the forwarded request, if it is not the
+	// one of the response
+	fwdStatus int
+	stored    bool
+	// servedStale is whether a stale response was served because upstream
+	// failed to revalidate it, or could not be contacted
+	servedStale bool
+}
+
+// setCacheStatus records how the request was handled, if it is tracked
+func setCacheStatus(req *http.Request, update func(status *cacheStatus)) {
+	if status, ok := req.Context().Value(cacheStatusCtx{}).(*cacheStatus); ok && status != nil {
+		update(status)
+	}
+}
+
+// formatCacheStatusIdentifier returns the name as a structured field token, if
+// it is a valid one, or as a string otherwise
+func formatCacheStatusIdentifier(name string) string {
+	isToken := name != "" && (isAlpha(name[0]) || name[0] == '*')
+	for i := 1; isToken && i < len(name); i++ {
+		isToken = isTokenChar(name[i]) || name[i] == ':' || name[i] == '/'
+	}
+	if isToken {
+		return name
+	}
+
+	return strconv.Quote(name)
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isTokenChar(c byte) bool {
+	return isAlpha(c) || ('0' <= c && c <= '9') || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// timeToLive returns for how long the response is still fresh, or a negative
+// duration if it is stale
+func (c *Client) timeToLive(
+	req *http.Request,
+	resp *http.Response,
+	logger *zerolog.Logger,
+) time.Duration {
+	age := time.Duration(0)
+	if seconds, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil {
+		age = time.Duration(seconds) * time.Second
+	}
+
+	if httpcaching.IsNegativeResponse(resp.StatusCode) {
+		return c.opts.NegativeTTL - age
+	}
+
+	cacheControl, err := httpcaching.ParseCacheControlDirective(
+		resp.Header["Cache-Control"],
+		logger,
+	)
+	if err != nil {
+		logger.Debug().Err(err).Msg("unable to parse cache control directives")
+	}
+	cacheControl = c.freshnessRule(req).apply(cacheControl)
+
+	return -httpcaching.GetStaleness(resp.Header, cacheControl, age, logger)
+}
+
+func (c *Client) formatCacheStatus(
+	req *http.Request,
+	resp *http.Response,
+	status *cacheStatus,
+	logger *zerolog.Logger,
+) string {
+	builder := strings.Builder{}
+	builder.WriteString(formatCacheStatusIdentifier(c.opts.Name))
+
+	fwd := status.fwd
+	collapsed := false
+	hasTTL := status.stored
+
+	isHit := (status.state == "hit" || status.state == "stale") && !status.servedStale
+
+	switch {
+	case status.servedStale:
+		fwd = "stale"
+		hasTTL = true
+	case isHit:
+		builder.WriteString("; hit")
+		hasTTL = true
+	case status.state == "coalesced":
+		fwd = "miss"
+		collapsed = true
+		hasTTL = true
+	case status.state == "revalidated":
+		fwd = "stale"
+		hasTTL = true
+	case status.state == "":
+		fwd = "bypass"
+	}
+
+	if !isHit {
+		if fwd == "" {
+			fwd = "miss"
+		}
+		builder.WriteString("; fwd=")
+		builder.WriteString(fwd)
+		if status.fwdStatus != 0 {
+			builder.WriteString("; fwd-status=")
+			builder.WriteString(strconv.Itoa(status.fwdStatus))
+		}
+	}
+
+	if hasTTL {
+		builder.WriteString("; ttl=")
+		builder.WriteString(
+			strconv.FormatInt(int64(c.timeToLive(req, resp, logger)/time.Second), 10),
+		)
+	}
+	if status.stored {
+		builder.WriteString("; stored")
+	}
+	if collapsed {
+		builder.WriteString("; collapsed")
+	}
+
+	return builder.String()
+}
+
+// annotateResponse adds the Cache-Status and Via headers to a copy of the
+// response. The original headers are shared with the cache, and must not be modified
+func (c *Client) annotateResponse(
+	req *http.Request,
+	resp *http.Response,
+	status *cacheStatus,
+	logger *zerolog.Logger,
+) *http.Response {
+	annotated := *resp
+	annotated.Header = resp.Header.Clone()
+	if annotated.Header == nil {
+		annotated.Header = http.Header{}
+	}
+
+	annotated.Header.Add("Cache-Status", c.formatCacheStatus(req, resp, status, logger))
+	annotated.Header.Add("Via", viaProtocol+" "+c.opts.Name)
+
+	return &annotated
+}
+
+// isLooping returns whether the Via headers show the request already went
+// through this instance
+func (c *Client) isLooping(req *http.Request) bool {
+	for _, value := range req.Header.Values("Via") {
+		for entry := range strings.SplitSeq(value, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], c.opts.Name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
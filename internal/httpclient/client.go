@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,12 +16,14 @@ import (
 	"github.com/rs/zerolog/hlog"
 
 	"github.com/benjaminschubert/locaccel/internal/database"
+	"github.com/benjaminschubert/locaccel/internal/filecache"
 	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
 	"github.com/benjaminschubert/locaccel/internal/httpheaders"
 )
 
 var (
 	errNoMatchingEntryInCache = errors.New("no entries match Etag or Last-Modified")
+	errIngestionNotSeekable   = errors.New("the ingestion can't be seeked")
 	cachedResponsesPool       = sync.Pool{
 		New: func() any {
 			r := new(database.Entry[CachedResponses])
@@ -30,15 +33,89 @@ var (
 	}
 )
 
+// Options allows tweaking the caching behavior of a client, for example on a
+// per-registry basis.
+type Options struct {
+	// StaleWhileRevalidate is the window during which a stale response can be
+	// served while it is revalidated in the background, for responses that
+	// don't specify one themselves.
+	StaleWhileRevalidate time.Duration
+	// StaleIfError controls which stale responses can be served when upstream
+	// cannot be contacted or returns an error.
+	StaleIfError StaleIfErrorPolicy
+	// IgnoreClientNoCache makes the cache serve fresh responses even when the
+	// client asks for them to be revalidated.
+	IgnoreClientNoCache bool
+	// NegativeTTL is how long responses for missing resources are served from
+	// the cache. They are not cached if it is 0.
+	NegativeTTL time.Duration
+	// FreshnessRules override the freshness of responses for the paths they
+	// match. The first matching rule applies.
+	FreshnessRules []FreshnessRule
+	// HedgingDelay is how long to wait for an upstream cache to return
+	// headers before also sending the request to the next one, or to the
+	// upstream itself. Upstream caches are tried one after the other if 0.
+	HedgingDelay time.Duration
+	// OrderUpstreamCachesByLatency tries the fastest upstream caches first,
+	// instead of following the configured order.
+	OrderUpstreamCachesByLatency bool
+	// PeerGroup shards the requests across a group of instances. The owner of
+	// a request is tried before the upstream caches.
+	PeerGroup PeerGroup
+	// Name identifies this instance in the Cache-Status and Via headers, which
+	// are only added when it is set. Requests that already went through an
+	// instance with this name are refused.
+	Name string
+	// Offline prevents contacting upstream when enabled, serving requests from
+	// the cache only.
+	Offline *OfflineMode
+	// Retry controls how GET and HEAD requests to upstream are retried on
+	// transient errors.
+	Retry RetryPolicy
+	// Credentials authenticate the requests sent to upstream, if set.
+	Credentials *Credentials
+	// PartitionByAuthorization stores the responses to requests with an
+	// Authorization header in a partition of the cache specific to it, unless
+	// they are public. They can then be cached even if private.
+	PartitionByAuthorization bool
+	// Bandwidth limits how fast responses are downloaded from upstream. Responses
+	// served from the cache are never throttled.
+	Bandwidth *Throttle
+	// MaxConcurrentRequests bounds the number of requests in flight to each
+	// upstream, queueing the others. Unlimited if 0.
+	MaxConcurrentRequests int
+	// VerifyDigests checks that the responses match the digests the requests
+	// expect, if any, before storing them.
+	VerifyDigests bool
+}
+
 type Client struct {
-	client    *http.Client
-	cache     *Cache
-	isPrivate bool
-	notify    func(r *http.Request, status string)
-	now       func() time.Time
-	since     func(time.Time) time.Duration
+	client      *http.Client
+	cache       *Cache
+	isPrivate   bool
+	notify      func(r *http.Request, status string)
+	now         func() time.Time
+	since       func(time.Time) time.Duration
+	inflight    *inflightRequests
+	background  *sync.WaitGroup
+	health      *healthTracker
+	retries     *retryBudget
+	concurrency *concurrencyLimiter
+	shaping     *shapingStats
+	opts        Options
 }
 
+// staleMode controls whether responses that are not fresh anymore can be served
+type staleMode int
+
+const (
+	serveFreshOnly staleMode = iota
+	serveStaleWhileRevalidate
+	serveStaleIfError
+	// serveOffline serves any stored response, as upstream cannot be contacted
+	serveOffline
+)
+
 type proxyCtx struct{}
 
 type UpstreamCache struct {
@@ -55,6 +132,25 @@ func New(
 	now func() time.Time,
 	since func(time.Time) time.Duration,
 ) *Client {
+	return &Client{
+		client:      withUpstreamCacheProxy(client),
+		cache:       cache,
+		isPrivate:   isPrivate,
+		notify:      notify,
+		now:         now,
+		since:       since,
+		inflight:    newInflightRequests(),
+		background:  &sync.WaitGroup{},
+		health:      newHealthTracker(now),
+		retries:     newRetryBudget(),
+		concurrency: newConcurrencyLimiter(0),
+		shaping:     newShapingStats(),
+	}
+}
+
+// withUpstreamCacheProxy makes the client send requests through the upstream
+// caches configured as proxies
+func withUpstreamCacheProxy(client *http.Client) *http.Client {
 	transport := client.Transport.(*http.Transport)
 	originalProxy := transport.Proxy
 
@@ -69,67 +165,116 @@ func New(
 
 		return proxy.(*url.URL), nil
 	}
-	return &Client{client, cache, isPrivate, notify, now, since}
+
+	return client
+}
+
+// WithHTTPClient returns a client sharing the same cache, but sending requests
+// to upstream with the given client.
+func (c *Client) WithHTTPClient(client *http.Client) *Client {
+	clone := *c
+	clone.client = withUpstreamCacheProxy(client)
+	return &clone
+}
+
+// WithOptions returns a client sharing the same cache and connections, but
+// using the given options.
+func (c *Client) WithOptions(opts Options) *Client {
+	client := *c
+	client.opts = opts
+	client.retries = newRetryBudget()
+	client.concurrency = newConcurrencyLimiter(opts.MaxConcurrentRequests)
+	return &client
+}
+
+// Wait blocks until all the requests running in the background are done, and
+// the files they stored are compressed.
+func (c *Client) Wait() {
+	c.background.Wait()
+	c.cache.cache.Wait()
 }
 
 func buildKey(req *http.Request) []byte {
-	return []byte(req.Method + "+" + req.URL.String())
+	return buildKeyForMethod(req.Method, req.URL)
+}
+
+func buildKeyForMethod(method string, uri *url.URL) []byte {
+	return []byte(method + "+" + uri.String())
+}
+
+// responseCandidate is a stored response that can be used for a request, along
+// with how much the request prefers it
+type responseCandidate struct {
+	response CachedResponse
+	quality  float64
 }
 
 func (c *Client) selectResponseCandidates(
 	req *http.Request,
 	dbEntry *database.Entry[CachedResponses],
 	logger *zerolog.Logger,
-) CachedResponses {
-	candidates := make(CachedResponses, 0, 1)
+) []responseCandidate {
+	candidates := make([]responseCandidate, 0, 1)
 
 	for _, resp := range dbEntry.Value {
-		if httpcaching.MatchVaryHeaders(req.Header, resp.VaryHeaders, logger) {
-			candidates = append(candidates, resp)
+		quality, match := httpcaching.NegotiateVaryHeaders(
+			req.Header,
+			resp.VaryHeaders,
+			resp.Headers,
+			logger,
+		)
+		if match {
+			candidates = append(candidates, responseCandidate{resp, quality})
 		}
 	}
 
 	return candidates
 }
 
-func (c *Client) selectMostRecentCandidates(
-	candidates CachedResponses,
+// selectPreferredCandidates implements the selection from RFC 9111 section 4.1:
+// the candidates the request prefers, and if they are equally preferred, the
+// most recent ones
+//
+// See https://datatracker.ietf.org/doc/html/rfc9111#section-4.1
+func (c *Client) selectPreferredCandidates(
+	candidates []responseCandidate,
 	logger *zerolog.Logger,
 ) CachedResponses {
-	mostRecentCandidates := make(CachedResponses, 0, 1)
+	preferredCandidates := make(CachedResponses, 0, 1)
+	maxQuality := -1.0
 	maxDate := time.Time{}
 
 	for _, candidate := range candidates {
-		date, err := http.ParseTime(candidate.Headers.Get("Date"))
+		date, err := http.ParseTime(candidate.response.Headers.Get("Date"))
 		if err != nil {
 			logger.Error().
 				Err(err).
 				Msg("BUG: Date header is in an invalid format, which should not happen")
 			date = time.Time{}
 		}
-		if date.After(maxDate) {
-			mostRecentCandidates = mostRecentCandidates[:0]
-			mostRecentCandidates = append(mostRecentCandidates, candidate)
+
+		if candidate.quality > maxQuality ||
+			(candidate.quality == maxQuality && date.After(maxDate)) {
+			preferredCandidates = preferredCandidates[:0]
+			preferredCandidates = append(preferredCandidates, candidate.response)
+			maxQuality = candidate.quality
 			maxDate = date
-		} else if date.Equal(maxDate) {
-			mostRecentCandidates = append(mostRecentCandidates, candidate)
+		} else if candidate.quality == maxQuality && date.Equal(maxDate) {
+			preferredCandidates = append(preferredCandidates, candidate.response)
 		}
 	}
 
-	return mostRecentCandidates
+	return preferredCandidates
 }
 
 func (c *Client) serveFromCachedCandidates(
-	candidates CachedResponses,
-	forceStale bool,
+	candidates []responseCandidate,
+	rule *FreshnessRule,
+	mode staleMode,
+	requestCacheControl httpcaching.CacheControlRequestDirective,
 	logger *zerolog.Logger,
 ) *http.Response {
-	// FIXME: most recent is not necessarily most prefered,
-	//	      we might want to implement proper preferences
-	//		  See https://datatracker.ietf.org/doc/html/rfc9111#section-4.1
-	mostRecentCandidates := c.selectMostRecentCandidates(candidates, logger)
-
-	for _, resp := range mostRecentCandidates {
+	for _, resp := range c.selectPreferredCandidates(candidates, logger) {
 		cacheControl, err := httpcaching.ParseCacheControlDirective(
 			resp.Headers["Cache-Control"],
 			logger,
@@ -137,19 +282,16 @@ func (c *Client) serveFromCachedCandidates(
 		if err != nil {
 			logger.Warn().Err(err).Msg("unable to parse cache control directives")
 		}
+		cacheControl = rule.apply(cacheControl)
 
-		if !forceStale && (cacheControl.NoCache || cacheControl.MustRevalidate) {
+		// Whether these can be served on errors is up to the stale-if-error policy
+		if mode != serveStaleIfError && mode != serveOffline &&
+			(cacheControl.NoCache || cacheControl.MustRevalidate) {
 			continue
 		}
 
-		age, isFresh := httpcaching.IsFresh(
-			resp.Headers,
-			cacheControl,
-			resp.TimeAtResponseCreation,
-			logger,
-			c.since,
-		)
-		if isFresh || forceStale {
+		age, canServe := c.canServe(resp, cacheControl, mode, requestCacheControl, logger)
+		if canServe {
 			body, err := c.cache.Open(resp.ContentHash, logger)
 			if err != nil {
 				logger.Warn().Err(err).Msg("Entry has been pruned from the cache already")
@@ -169,10 +311,63 @@ func (c *Client) serveFromCachedCandidates(
 	return nil
 }
 
+// canServe returns the age of the stored response, and whether it can be served
+// in the given mode
+func (c *Client) canServe(
+	resp CachedResponse,
+	cacheControl httpcaching.CacheControlResponseDirective,
+	mode staleMode,
+	requestCacheControl httpcaching.CacheControlRequestDirective,
+	logger *zerolog.Logger,
+) (time.Duration, bool) {
+	if mode == serveOffline {
+		return httpcaching.GetCurrentAge(resp.TimeAtResponseCreation, c.since), true
+	}
+
+	// Responses for missing resources are only kept for the configured time,
+	// and never served stale
+	if httpcaching.IsNegativeResponse(resp.StatusCode) {
+		age := httpcaching.GetCurrentAge(resp.TimeAtResponseCreation, c.since)
+		return age, mode == serveFreshOnly &&
+			requestCacheControl.Accepts(age, age-c.opts.NegativeTTL)
+	}
+
+	age, isFresh := httpcaching.IsFresh(
+		resp.Headers,
+		cacheControl,
+		resp.TimeAtResponseCreation,
+		logger,
+		c.since,
+	)
+	switch mode {
+	case serveFreshOnly:
+		return age, requestCacheControl.Accepts(
+			age,
+			httpcaching.GetStaleness(resp.Headers, cacheControl, age, logger),
+		)
+	case serveStaleWhileRevalidate:
+		return age, isFresh || httpcaching.CanServeStaleWhileRevalidating(
+			resp.Headers,
+			cacheControl,
+			age,
+			c.opts.StaleWhileRevalidate,
+			logger,
+		)
+	case serveStaleIfError:
+		return age, isFresh || c.opts.StaleIfError.allows(
+			cacheControl,
+			httpcaching.GetStaleness(resp.Headers, cacheControl, age, logger),
+		)
+	}
+
+	return age, isFresh
+}
+
 func (c *Client) serveFromCache(
 	req *http.Request,
 	dbEntry *database.Entry[CachedResponses],
-	forceStale bool,
+	mode staleMode,
+	requestCacheControl httpcaching.CacheControlRequestDirective,
 	logger *zerolog.Logger,
 ) *http.Response {
 	candidates := c.selectResponseCandidates(req, dbEntry, logger)
@@ -181,12 +376,18 @@ func (c *Client) serveFromCache(
 		return nil
 	}
 
-	return c.serveFromCachedCandidates(candidates, forceStale, logger)
+	return c.serveFromCachedCandidates(
+		candidates,
+		c.freshnessRule(req),
+		mode,
+		requestCacheControl,
+		logger,
+	)
 }
 
-func readAndCloseUpstreamBody(resp *http.Response, logger *zerolog.Logger) {
-	n, err := io.Copy(io.Discard, resp.Body)
-	cErr := resp.Body.Close()
+func readAndCloseUpstreamBody(body io.ReadCloser, logger *zerolog.Logger) {
+	n, err := io.Copy(io.Discard, body)
+	cErr := body.Close()
 
 	if err != nil { //nolint:gocritic
 		logger.Warn().
@@ -204,16 +405,127 @@ func readAndCloseUpstreamBody(resp *http.Response, logger *zerolog.Logger) {
 }
 
 func (c *Client) Do(req *http.Request, upstreamCache UpstreamCache) (*http.Response, error) {
+	// Ranges are removed from the request while handling it
+	acceptsStoredEncoding := acceptsStoredEncoding(req)
+	stripStoredEncodingEtags(req.Header)
+
+	if c.opts.Name == "" {
+		resp, err := c.do(req, upstreamCache, c.notify, false)
+		if err == nil && acceptsStoredEncoding {
+			resp = sendStoredEncoding(resp)
+		}
+		return resp, err
+	}
+
+	if c.isLooping(req) {
+		return nil, ErrLoopDetected
+	}
+
+	status := &cacheStatus{}
+	req = req.WithContext(context.WithValue(req.Context(), cacheStatusCtx{}, status))
+
+	resp, err := c.do(req, upstreamCache, func(r *http.Request, state string) {
+		status.state = state
+		c.notify(r, state)
+	}, false)
+	if err != nil {
+		return resp, err
+	}
+	if acceptsStoredEncoding {
+		resp = sendStoredEncoding(resp)
+	}
+
+	return c.annotateResponse(req, resp, status, hlog.FromRequest(req)), nil
+}
+
+// DoInternal sends a request locaccel needs to answer a client's one, through
+// the cache. It is neither reported as the cache state of the client's request,
+// whose context it might share, nor expected to match its digests.
+func (c *Client) DoInternal(
+	req *http.Request,
+	upstreamCache UpstreamCache,
+) (*http.Response, error) {
+	ctx := context.WithValue(req.Context(), cacheStatusCtx{}, nil)
+	ctx = context.WithValue(ctx, expectedDigestsCtx{}, nil)
+	return c.do(req.WithContext(ctx), upstreamCache, func(*http.Request, string) {}, false)
+}
+
+// revalidateInBackground refreshes the cached entry for the request, without
+// blocking the caller.
+func (c *Client) revalidateInBackground(
+	req *http.Request,
+	upstreamCache UpstreamCache,
+	logger *zerolog.Logger,
+) {
+	// The original request will be done before the revalidation is, and
+	// doesn't need to know how the revalidation went
+	req = req.Clone(
+		context.WithValue(context.WithoutCancel(req.Context()), cacheStatusCtx{}, nil),
+	)
+
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+
+		resp, err := c.do(req, upstreamCache, func(*http.Request, string) {}, true)
+		if err != nil {
+			logger.Warn().Err(err).Msg("unable to revalidate stale response in the background")
+			return
+		}
+
+		// Reading the body is what stores the response in the cache
+		readAndCloseUpstreamBody(resp.Body, logger)
+		logger.Debug().
+			Int("status", resp.StatusCode).
+			Msg("stale response revalidated in the background")
+	}()
+}
+
+func (c *Client) do(
+	req *http.Request,
+	upstreamCache UpstreamCache,
+	notify func(r *http.Request, status string),
+	isRevalidation bool,
+) (*http.Response, error) {
 	logger := hlog.FromRequest(req)
 
+	if c.opts.Offline.Enabled() {
+		return c.doOffline(req, notify, logger), nil
+	}
+
 	// We only support caching GET requests
 	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		setCacheStatus(req, func(status *cacheStatus) { status.fwd = "method" })
 		resp, _, _, err := c.forwardRequest(req, logger)
-		c.notify(req, "miss")
+		notify(req, "miss")
+		if err == nil {
+			c.invalidate(req, resp, logger)
+		}
+		return resp, err
+	}
+
+	// Rules configured for the path take precedence over what upstream says
+	rule := c.freshnessRule(req)
+	if rule != nil && rule.NoStore {
+		logger.Debug().Msg("path configured to not be cached, forwarding request")
+		resp, _, _, err := c.forwardRequestWithUpstream(req, upstreamCache, logger)
+		notify(req, "N/A")
 		return resp, err
 	}
 
-	cacheKey := buildKey(req)
+	if req.Method == http.MethodHead {
+		return c.doHead(req, upstreamCache, notify, logger)
+	}
+
+	// Ranges are served from the full response, which can then be cached
+	isRangeRequest := req.Method == http.MethodGet && req.Header.Get("Range") != ""
+	if isRangeRequest {
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+	}
+
+	partition := c.partition(req)
+	cacheKey := withPartition(buildKey(req), partition)
 	dbEntry := cachedResponsesPool.Get().(*database.Entry[CachedResponses])
 	releaseDBEntry := true
 	defer func() {
@@ -222,20 +534,99 @@ func (c *Client) Do(req *http.Request, upstreamCache UpstreamCache) (*http.Respo
 		}
 	}()
 
+	requestCacheControl := c.parseRequestCacheControl(req, logger)
+
 	if err := c.cache.Get(cacheKey, dbEntry); err == nil {
-		resp := c.serveFromCache(req, dbEntry, false, logger)
-		if resp != nil {
-			logger.Debug().Msg("serving response from cache")
-			c.notify(req, "hit")
-			return resp, nil
+		if !requestCacheControl.NoCache {
+			resp := c.serveFromCache(req, dbEntry, serveFreshOnly, requestCacheControl, logger)
+			if resp != nil {
+				logger.Debug().Msg("serving response from cache")
+				notify(req, "hit")
+				return resp, nil
+			}
 		}
-	} else if !errors.Is(err, database.ErrKeyNotFound) {
+
+		// Clients with explicit freshness requirements should not get stale responses
+		if !isRevalidation && !requestCacheControl.NoCache &&
+			requestCacheControl.MaxAge == nil && requestCacheControl.MinFresh == 0 {
+			if resp := c.serveFromCache(
+				req,
+				dbEntry,
+				serveStaleWhileRevalidate,
+				requestCacheControl,
+				logger,
+			); resp != nil {
+				logger.Debug().Msg("serving stale response from cache while revalidating it")
+				c.revalidateInBackground(req, upstreamCache, logger)
+				notify(req, "stale")
+				return resp, nil
+			}
+		}
+	} else if errors.Is(err, database.ErrKeyNotFound) {
+		if partition != "" && !requestCacheControl.NoCache {
+			if resp := c.serveFromSharedCache(req, requestCacheControl, logger); resp != nil {
+				logger.Debug().Msg("serving shared response from cache")
+				notify(req, "hit")
+				return resp, nil
+			}
+		}
+		if !requestCacheControl.NoCache {
+			if resp := c.serveFromDigests(req, logger); resp != nil {
+				notify(req, "hit")
+				return resp, nil
+			}
+		}
+		setCacheStatus(req, func(status *cacheStatus) { status.fwd = "uri-miss" })
+	} else {
 		logger.Debug().Err(err).Msg("unable to retrieve entry from database, no response fresh")
 	}
 
+	if requestCacheControl.NoCache {
+		setCacheStatus(req, func(status *cacheStatus) { status.fwd = "request" })
+	}
+
+	if requestCacheControl.OnlyIfCached {
+		logger.Debug().Msg("no response in cache for a request accepting only cached ones")
+		notify(req, "miss")
+		return newGatewayTimeoutResponse(
+			"The response is not in the cache, and the client asked for only-if-cached",
+		), nil
+	}
+
+	// Coalesce concurrent requests for the same resource, only the first one
+	// should reach upstream, the others can then be served from the cache.
+	flight, isLeader := c.inflight.join(cacheKey)
+	releaseFlight := isLeader
+	defer func() {
+		if releaseFlight {
+			c.inflight.release(cacheKey, flight)
+		}
+	}()
+
+	if !isLeader {
+		if resp := c.waitForInflightRequest(
+			req,
+			flight,
+			cacheKey,
+			dbEntry,
+			requestCacheControl,
+			isRangeRequest,
+			logger,
+		); resp != nil {
+			logger.Debug().Msg("serving response from cache after waiting for in-flight request")
+			notify(req, "coalesced")
+			return resp, nil
+		}
+		logger.Debug().Msg("unable to serve from the in-flight request, contacting upstream")
+	}
+
+	// The full response needs to be fetched to be cached, and served to the
+	// requests waiting for it, even if the client goes away or only wants a range
+	upstreamReq := req.WithContext(context.WithoutCancel(req.Context()))
+
 	hasConditionalInformation := false
 	wasOriginalRequestConditional := false
-	originalRequest := req.Clone(req.Context())
+	originalRequest := upstreamReq.Clone(upstreamReq.Context())
 
 	if dbEntry.Version() != 0 {
 		hasConditionalInformation, wasOriginalRequestConditional = c.addConditionalRequestInformation(
@@ -243,39 +634,25 @@ func (c *Client) Do(req *http.Request, upstreamCache UpstreamCache) (*http.Respo
 			dbEntry,
 		)
 	}
+	if hasConditionalInformation && !requestCacheControl.NoCache {
+		setCacheStatus(req, func(status *cacheStatus) { status.fwd = "stale" })
+	}
 
 	logger.Debug().Msg("unable to serve from cache")
 
 	resp, timeAtRequestCreated, timeAtResponseReceived, err := c.forwardRequestWithUpstream(
-		req,
+		upstreamReq,
 		upstreamCache,
 		logger,
 	)
-	if err != nil || resp.StatusCode >= 500 {
-		if dbEntry.Version() != 0 {
-			if cRep := c.serveFromCache(req, dbEntry, true, logger); cRep != nil {
-				if err == nil {
-					go readAndCloseUpstreamBody(resp, logger)
-				}
-				logger.Warn().
-					Err(err).
-					Msg("unable to contact upstream, serving stale response from cache")
-				c.notify(req, "hit")
-				return cRep, nil
-			}
+	if err != nil || c.opts.StaleIfError.isError(resp.StatusCode) {
+		if cRep := c.serveStaleOnError(req, dbEntry, resp, err, logger); cRep != nil {
+			notify(req, "stale")
+			return cRep, nil
 		}
-		return resp, err
 	}
-	if resp.StatusCode == http.StatusTooManyRequests {
-		if dbEntry.Version() != 0 {
-			if cRep := c.serveFromCache(req, dbEntry, true, logger); cRep != nil {
-				go readAndCloseUpstreamBody(resp, logger)
-				logger.Warn().
-					Msg("upstream returned 429 Too Many Requests, serving stale response from cache")
-				c.notify(req, "hit")
-				return cRep, nil
-			}
-		}
+	if err != nil || resp.StatusCode >= 500 {
+		return resp, err
 	}
 
 	if hasConditionalInformation && resp.StatusCode == http.StatusNotModified {
@@ -292,12 +669,16 @@ func (c *Client) Do(req *http.Request, upstreamCache UpstreamCache) (*http.Respo
 		}
 		if cacheResp != nil {
 			logger.Debug().Msg("request re-validated, serving from cache")
-			c.notify(req, "revalidated")
+			setCacheStatus(req, func(status *cacheStatus) {
+				status.fwdStatus = http.StatusNotModified
+				status.stored = true
+			})
+			notify(req, "revalidated")
 			return cacheResp, nil
 		}
 		if wasOriginalRequestConditional {
 			logger.Debug().Msg("passing through conditional response from conditional request")
-			c.notify(req, "miss")
+			notify(req, "miss")
 			return resp, nil
 		}
 
@@ -308,45 +689,425 @@ func (c *Client) Do(req *http.Request, upstreamCache UpstreamCache) (*http.Respo
 			upstreamCache,
 			logger,
 		)
-		if err != nil || resp.StatusCode >= 500 {
-			if dbEntry.Version() != 0 {
-				if cRep := c.serveFromCache(req, dbEntry, true, logger); cRep != nil {
-					logger.Warn().
-						Err(err).
-						Msg("unable to contact upstream, serving stale response from cache")
-					c.notify(req, "hit")
-					return cRep, nil
-				}
+		if err != nil || c.opts.StaleIfError.isError(resp.StatusCode) {
+			if cRep := c.serveStaleOnError(req, dbEntry, resp, err, logger); cRep != nil {
+				notify(req, "stale")
+				return cRep, nil
 			}
+		}
+		if err != nil || resp.StatusCode >= 500 {
 			return resp, err
 		}
 	}
 
-	c.notify(req, "miss")
+	notify(req, "miss")
+	verifiedDigests := c.verifyDigests(req, resp, logger)
 
-	if isCacheable, explicitlyConfigured := httpcaching.IsCacheable(
+	if httpcaching.IsNegativeResponse(resp.StatusCode) && c.opts.NegativeTTL != 0 {
+		if !httpcaching.IsNegativeResponseCacheable(
+			resp,
+			c.isPrivate || partition != "",
+			logger,
+		) {
+			logger.Debug().Msg("response for missing resource is not cacheable")
+			return resp, nil
+		}
+	} else if isCacheable, explicitlyConfigured := httpcaching.IsCacheable(
 		resp,
-		c.isPrivate,
+		// Partitions are private to whoever made the request
+		c.isPrivate || partition != "",
 		logger,
 	); !isCacheable &&
 		explicitlyConfigured {
 		logger.Debug().Msg("request is not cacheable")
 		return resp, nil
+	} else if !explicitlyConfigured && rule.overridesFreshness() {
+		// Rules only give a freshness to responses without one, they never
+		// allow storing responses that forbid it
+		logger.Debug().Msg("response cacheable as configured for the path")
+	}
+
+	if requestCacheControl.NoStore {
+		logger.Debug().Msg("client asked for the response not to be stored")
+		return resp, nil
 	}
 
 	releaseDBEntry = false
-	resp.Body = c.setupIngestion(
+	// The in-flight request will be released once the ingestion is done
+	onIngestionDone := func() {}
+	if releaseFlight {
+		releaseFlight = false
+		onIngestionDone = func() { c.inflight.release(cacheKey, flight) }
+	}
+
+	// Public responses are the same for everyone, and can go to the shared cache
+	storageKey := cacheKey
+	storagePartition := partition
+	if partition != "" && isPublic(resp, logger) {
+		storageKey = buildKey(req)
+		storagePartition = ""
+		if err := c.cache.Get(storageKey, dbEntry); err != nil &&
+			!errors.Is(err, database.ErrKeyNotFound) {
+			logger.Debug().Err(err).Msg("unable to retrieve shared entry from database")
+		}
+	}
+
+	var ingestion *filecache.Ingestion
+	resp.Body, ingestion = c.setupIngestion(
 		req,
 		resp,
 		timeAtRequestCreated,
 		timeAtResponseReceived,
-		cacheKey,
+		storageKey,
 		dbEntry,
+		verifiedDigests,
+		storagePartition,
+		onIngestionDone,
 		logger,
 	)
+
+	if ingestion != nil {
+		setCacheStatus(req, func(status *cacheStatus) { status.stored = true })
+	}
+
+	if isLeader && ingestion != nil &&
+		c.isShareable(resp, rule, timeAtRequestCreated, timeAtResponseReceived, logger) {
+		flight.share(resp, httpcaching.ExtractVaryHeaders(req.Header, resp.Header), ingestion)
+	}
+
+	if ingestion != nil {
+		c.ingestInBackground(req.Context(), resp, ingestion, logger)
+	}
+
+	return resp, nil
+}
+
+func (c *Client) parseRequestCacheControl(
+	req *http.Request,
+	logger *zerolog.Logger,
+) httpcaching.CacheControlRequestDirective {
+	requestCacheControl, err := httpcaching.ParseCacheControlRequestDirective(
+		req.Header["Cache-Control"],
+		req.Header["Pragma"],
+		logger,
+	)
+	if err != nil {
+		logger.Warn().Err(err).Msg("unable to parse request cache control directives")
+	}
+	if requestCacheControl.NoCache && c.opts.IgnoreClientNoCache {
+		logger.Debug().Msg("ignoring no-cache directive from the client")
+		requestCacheControl.NoCache = false
+	}
+
+	return requestCacheControl
+}
+
+// doHead answers HEAD requests from the cached responses to GET requests, as
+// they share the same metadata. Responses to HEAD requests are not stored, they
+// would only duplicate what a GET response provides.
+func (c *Client) doHead(
+	req *http.Request,
+	upstreamCache UpstreamCache,
+	notify func(r *http.Request, status string),
+	logger *zerolog.Logger,
+) (*http.Response, error) {
+	requestCacheControl := c.parseRequestCacheControl(req, logger)
+
+	dbEntry := cachedResponsesPool.Get().(*database.Entry[CachedResponses])
+	defer cachedResponsesPool.Put(dbEntry)
+
+	if err := c.getStoredResponses(req, dbEntry); err == nil {
+		if !requestCacheControl.NoCache {
+			resp := c.serveFromCache(req, dbEntry, serveFreshOnly, requestCacheControl, logger)
+			if resp != nil {
+				logger.Debug().Msg("serving response from the cached GET response")
+				notify(req, "hit")
+				return toHeadResponse(req, resp, logger), nil
+			}
+		}
+	} else if !errors.Is(err, database.ErrKeyNotFound) {
+		logger.Debug().Err(err).Msg("unable to retrieve entry from database, no response fresh")
+	} else if !requestCacheControl.NoCache {
+		if resp := c.serveFromDigests(req, logger); resp != nil {
+			notify(req, "hit")
+			return toHeadResponse(req, resp, logger), nil
+		}
+	}
+
+	if requestCacheControl.OnlyIfCached {
+		logger.Debug().Msg("no response in cache for a request accepting only cached ones")
+		notify(req, "miss")
+		return newGatewayTimeoutResponse(
+			"The response is not in the cache, and the client asked for only-if-cached",
+		), nil
+	}
+
+	logger.Debug().Msg("unable to serve from cache")
+
+	resp, _, _, err := c.forwardRequestWithUpstream(req, upstreamCache, logger)
+	if err != nil || c.opts.StaleIfError.isError(resp.StatusCode) {
+		if cRep := c.serveStaleOnError(req, dbEntry, resp, err, logger); cRep != nil {
+			notify(req, "stale")
+			return toHeadResponse(req, cRep, logger), nil
+		}
+	}
+	if err != nil {
+		return resp, err
+	}
+
+	notify(req, "miss")
 	return resp, nil
 }
 
+// toHeadResponse strips the body from a cached response, keeping its length,
+// and the encoding the GET request would get it with
+func toHeadResponse(req *http.Request, resp *http.Response, logger *zerolog.Logger) *http.Response {
+	if acceptsStoredEncoding(req) {
+		resp = sendStoredEncoding(resp)
+	}
+
+	if resp.Header.Get("Content-Length") == "" {
+		if size, ok := cachedContentLength(resp.Body, logger); ok {
+			resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+	}
+
+	if err := resp.Body.Close(); err != nil {
+		logger.Warn().Err(err).Msg("unable to close the cached response body")
+	}
+	resp.Body = http.NoBody
+	return resp
+}
+
+// ingestInBackground reads the response in the background, so it gets fully
+// ingested, and replaces its body by a seekable reader following the ingestion.
+// The download then doesn't depend on the client, which might go away while
+// other requests are streaming from it, or only want a range of it.
+func (c *Client) ingestInBackground(
+	ctx context.Context,
+	resp *http.Response,
+	ingestion *filecache.Ingestion,
+	logger *zerolog.Logger,
+) {
+	body, err := followIngestion(ctx, ingestion, resp.Header, logger)
+	if err != nil {
+		logger.Debug().Err(err).Msg("unable to follow the ingestion, serving the full response")
+		return
+	}
+
+	download := &backgroundDownload{done: make(chan struct{})}
+	upstreamBody := resp.Body
+	resp.Body = &backgroundIngestionBody{ReadSeekCloser: body, download: download}
+
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		defer close(download.done)
+
+		n, err := io.Copy(io.Discard, upstreamBody)
+		if cErr := upstreamBody.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+
+		if err != nil {
+			logger.Warn().Int64("read", n).Err(err).Msg("An error occured downloading the response")
+			download.err = err
+		} else {
+			logger.Debug().Int64("read", n).Msg("Successfully downloaded the response")
+		}
+	}()
+}
+
+// backgroundDownload tracks the download of a response happening in the
+// background. err is only safe to read once done is closed.
+type backgroundDownload struct {
+	done chan struct{}
+	err  error
+}
+
+// backgroundIngestionBody follows the ingestion of a response downloaded in the
+// background. It reports the errors of the download, and waits for the response
+// to be stored once fully read, as reading the response directly would.
+type backgroundIngestionBody struct {
+	io.ReadSeekCloser
+	download *backgroundDownload
+	eof      bool
+}
+
+func (b *backgroundIngestionBody) Read(p []byte) (int, error) {
+	n, err := b.ReadSeekCloser.Read(p)
+
+	switch {
+	case errors.Is(err, io.EOF):
+		b.eof = true
+	case errors.Is(err, filecache.ErrIngestionAborted):
+		<-b.download.done
+		if b.download.err != nil {
+			err = b.download.err
+		}
+	}
+
+	return n, err
+}
+
+func (b *backgroundIngestionBody) Close() error {
+	err := b.ReadSeekCloser.Close()
+	if b.eof {
+		<-b.download.done
+	}
+	return err
+}
+
+// followIngestion returns a reader following the ingestion of the response with
+// the given headers. It can be seeked without waiting for the end of the
+// ingestion if the size of the response is known.
+func followIngestion(
+	ctx context.Context,
+	ingestion *filecache.Ingestion,
+	headers http.Header,
+	logger *zerolog.Logger,
+) (io.ReadSeekCloser, error) {
+	follower, err := ingestion.NewReader(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	body, ok := follower.(io.ReadSeekCloser)
+	if !ok {
+		_ = follower.Close()
+		return nil, errIngestionNotSeekable
+	}
+
+	if size, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64); err == nil {
+		// Avoid waiting for the end of the ingestion to know the size
+		return &sizedReadSeekCloser{body, size}, nil
+	}
+	return body, nil
+}
+
+// serveStaleOnError returns a stale response from the cache in place of the
+// upstream error, if the stale-if-error policy allows it.
+func (c *Client) serveStaleOnError(
+	req *http.Request,
+	dbEntry *database.Entry[CachedResponses],
+	resp *http.Response,
+	err error,
+	logger *zerolog.Logger,
+) *http.Response {
+	if dbEntry.Version() == 0 {
+		return nil
+	}
+
+	cRep := c.serveFromCache(
+		req,
+		dbEntry,
+		serveStaleIfError,
+		httpcaching.CacheControlRequestDirective{},
+		logger,
+	)
+	if cRep == nil {
+		return nil
+	}
+
+	if err != nil {
+		logger.Warn().Err(err).Msg("unable to contact upstream, serving stale response from cache")
+		resp = nil
+	} else {
+		go readAndCloseUpstreamBody(resp.Body, logger)
+		logger.Warn().
+			Int("status", resp.StatusCode).
+			Msg("upstream returned an error, serving stale response from cache")
+	}
+
+	markServedStale(req, cRep, resp)
+	return cRep
+}
+
+// isShareable returns whether the response is fresh, and can thus be shared
+// with other requests while it is being ingested.
+func (c *Client) isShareable(
+	resp *http.Response,
+	rule *FreshnessRule,
+	timeAtRequestCreated, timeAtResponseReceived time.Time,
+	logger *zerolog.Logger,
+) bool {
+	cacheControl, err := httpcaching.ParseCacheControlDirective(
+		resp.Header["Cache-Control"],
+		logger,
+	)
+	cacheControl = rule.apply(cacheControl)
+	if err != nil || cacheControl.NoCache {
+		return false
+	}
+
+	_, isFresh := httpcaching.IsFresh(
+		resp.Header,
+		cacheControl,
+		httpcaching.GetEstimatedResponseCreation(
+			resp.Header,
+			timeAtRequestCreated,
+			timeAtResponseReceived,
+			logger,
+			c.now,
+		),
+		logger,
+		c.since,
+	)
+	return isFresh
+}
+
+func (c *Client) waitForInflightRequest(
+	req *http.Request,
+	flight *inflightRequest,
+	cacheKey []byte,
+	dbEntry *database.Entry[CachedResponses],
+	requestCacheControl httpcaching.CacheControlRequestDirective,
+	isRangeRequest bool,
+	logger *zerolog.Logger,
+) *http.Response {
+	logger.Debug().Msg("request for the same resource already in flight, waiting for it")
+
+	select {
+	case <-flight.ready:
+	case <-req.Context().Done():
+		return nil
+	}
+
+	if flight.ingestion != nil &&
+		httpcaching.MatchVaryHeaders(req.Header, flight.varyHeaders, logger) {
+		body, err := followIngestion(req.Context(), flight.ingestion, flight.headers, logger)
+		if err == nil {
+			logger.Debug().Msg("streaming response from in-flight request")
+			return &http.Response{
+				Body:       body,
+				Header:     flight.headers.Clone(),
+				StatusCode: flight.statusCode,
+			}
+		}
+		logger.Debug().Err(err).Msg("unable to follow in-flight ingestion")
+	}
+
+	// Ranges are expected quickly, they don't wait for the whole response
+	if isRangeRequest {
+		return nil
+	}
+
+	select {
+	case <-flight.done:
+	case <-req.Context().Done():
+		return nil
+	}
+
+	if err := c.cache.Get(cacheKey, dbEntry); err != nil {
+		if !errors.Is(err, database.ErrKeyNotFound) {
+			logger.Debug().Err(err).Msg("unable to retrieve entry from database after waiting")
+		}
+		return nil
+	}
+
+	return c.serveFromCache(req, dbEntry, serveFreshOnly, requestCacheControl, logger)
+}
+
 func (c *Client) addConditionalRequestInformation(
 	req *http.Request,
 	dbEntry *database.Entry[CachedResponses],
@@ -358,6 +1119,10 @@ func (c *Client) addConditionalRequestInformation(
 	originalIfModifiedSince := req.Header["If-Modified-Since"]
 
 	for _, entry := range dbEntry.Value {
+		// Responses for missing resources can't be refreshed by a Not Modified answer
+		if httpcaching.IsNegativeResponse(entry.StatusCode) {
+			continue
+		}
 		etags = append(etags, entry.Headers["Etag"]...)
 		lastModified = append(lastModified, entry.Headers["Last-Modified"]...)
 
@@ -425,27 +1190,107 @@ func (c *Client) forwardRequestWithUpstream(
 		}
 	}
 
-	for _, upstream := range upstreamCache.Uris {
-		logger.Debug().Stringer("upstream", upstream).Msg("Trying upstream first")
-		resp, timeAtRequestCreated, timeAtResponseReceived, err = c.forwardRequest(
+	upstreams := upstreamCache.Uris
+	if c.opts.OrderUpstreamCachesByLatency {
+		upstreams = c.health.orderByLatency(upstreams)
+	}
+	if owner := c.peerOwner(req); owner != nil {
+		logger.Debug().Stringer("owner", owner).Msg("Fetching through the owning peer")
+		upstreams = append(
+			[]*url.URL{owner},
+			slices.DeleteFunc(slices.Clone(upstreams), func(upstream *url.URL) bool {
+				return upstream.String() == owner.String()
+			})...,
+		)
+	}
+
+	// Requests with side effects can't be sent multiple times
+	if c.opts.HedgingDelay > 0 && len(upstreams) != 0 && isSafeMethod(req.Method) {
+		return c.forwardRequestHedged(req, upstreams, buildUpstreamRequest, logger).unpack()
+	}
+
+	for _, upstream := range upstreams {
+		if !c.health.allow(upstream.String()) {
+			logger.Debug().Stringer("upstream", upstream).Msg("Skipping unhealthy upstream")
+			continue
+		}
+
+		attempt := c.forwardRequestToUpstreamCache(
 			buildUpstreamRequest(req, upstream),
+			upstream,
 			logger,
 		)
-		if err != nil {
-			logger.Debug().Stringer("upstream", upstream).Msg("Upstream returned an error")
-		} else {
-			return resp, timeAtRequestCreated, timeAtResponseReceived, err
+		// If the client went away, there is no need to try further
+		if attempt.usable || req.Context().Err() != nil {
+			return attempt.unpack()
 		}
 	}
 
-	return c.forwardRequest(req, logger)
+	return c.forwardRequestWithRetries(req, logger)
+}
+
+// upstreamAttempt is the outcome of forwarding a request to an upstream
+type upstreamAttempt struct {
+	resp                   *http.Response
+	timeAtRequestCreated   time.Time
+	timeAtResponseReceived time.Time
+	err                    error
+	// usable is whether the response can be returned to the client
+	usable bool
+}
+
+func (a upstreamAttempt) unpack() (*http.Response, time.Time, time.Time, error) {
+	return a.resp, a.timeAtRequestCreated, a.timeAtResponseReceived, a.err
+}
+
+func (c *Client) forwardRequestToUpstreamCache(
+	req *http.Request,
+	upstream *url.URL,
+	logger *zerolog.Logger,
+) upstreamAttempt {
+	upstreamKey := upstream.String()
+
+	logger.Debug().Stringer("upstream", upstream).Msg("Trying upstream first")
+	resp, timeAtRequestCreated, timeAtResponseReceived, err := c.forwardRequest(req, logger)
+	latency := timeAtResponseReceived.Sub(timeAtRequestCreated)
+
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		// The request was cancelled, this says nothing about the upstream
+		c.health.release(upstreamKey)
+	case err != nil:
+		c.health.record(upstreamKey, false, latency)
+		logger.Debug().Err(err).Stringer("upstream", upstream).Msg("Upstream returned an error")
+	case isUpstreamFailure(resp):
+		c.health.record(upstreamKey, false, latency)
+		logger.Debug().
+			Stringer("upstream", upstream).
+			Int("status", resp.StatusCode).
+			Msg("Upstream is unable to serve the request")
+		readAndCloseUpstreamBody(resp.Body, logger)
+		resp = nil
+	default:
+		c.health.record(upstreamKey, true, latency)
+		return upstreamAttempt{resp, timeAtRequestCreated, timeAtResponseReceived, nil, true}
+	}
+
+	return upstreamAttempt{resp, timeAtRequestCreated, timeAtResponseReceived, err, false}
 }
 
 func (c *Client) forwardRequest(
 	req *http.Request,
 	logger *zerolog.Logger,
 ) (resp *http.Response, timeAtRequestCreated, timeAtResponseReceived time.Time, err error) {
+	// The request can be stored or sent again, its headers must not be modified
+	req = req.Clone(req.Context())
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
 	removeHopByHopHeaders(req.Header)
+	if c.opts.Name != "" {
+		req.Header.Add("Via", viaProtocol+" "+c.opts.Name)
+	}
 
 	if logger.Trace().Enabled() { //nolint:zerologlint
 		headers := req.Header.Clone()
@@ -457,9 +1302,15 @@ func (c *Client) forwardRequest(
 			Msg("Sending request to upstream")
 	}
 
+	shape, err := c.shapeTraffic(req)
+	if err != nil {
+		return nil, timeAtRequestCreated, timeAtResponseReceived, err
+	}
+
 	timeAtRequestCreated = c.now().UTC()
-	resp, err = c.client.Do(req) //nolint:gosec
+	resp, err = c.send(req, logger)
 	timeAtResponseReceived = c.now().UTC()
+	shape(resp, err)
 
 	if err != nil {
 		return resp, timeAtRequestCreated, timeAtResponseReceived, err
@@ -490,9 +1341,12 @@ func (c *Client) setupIngestion(
 	timeAtRequestCreated, timeAtResponseReceived time.Time,
 	cacheKey []byte,
 	dbEntry *database.Entry[CachedResponses],
+	digests []Digest,
+	partition string,
+	onDone func(),
 	logger *zerolog.Logger,
-) io.ReadCloser {
-	return c.cache.SetupIngestion(
+) (io.ReadCloser, *filecache.Ingestion) {
+	body, ingestion := c.cache.SetupSharedIngestion(
 		resp.Body,
 		func(hash string) {
 			var err error
@@ -538,11 +1392,25 @@ func (c *Client) setupIngestion(
 				logger.Error().Err(err).Msg("Error saving entry in the database")
 			} else {
 				logger.Debug().Msg("request saved in the database")
+				// The content was verified against the digests before being stored
+				c.saveDigests(digests, partition, cacheResp, logger)
+			}
+
+			// HEAD requests are answered from this response now, older
+			// versions might have stored them separately
+			if err := c.cache.Forget(buildKeyForMethod(http.MethodHead, req.URL)); err != nil {
+				logger.Warn().Err(err).Msg("unable to remove the outdated HEAD entry")
 			}
 		},
-		func() { cachedResponsesPool.Put(dbEntry) },
+		func() {
+			cachedResponsesPool.Put(dbEntry)
+			onDone()
+		},
 		logger,
 	)
+
+	c.cache.compressAtRest(ingestion, resp.Header)
+	return body, ingestion
 }
 
 func (c *Client) updateCache(
@@ -640,6 +1508,17 @@ func (c *Client) refreshResponseAndServe(
 	return r
 }
 
+func newGatewayTimeoutResponse(reason string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusGatewayTimeout,
+		Header: http.Header{
+			"Content-Length": []string{strconv.Itoa(len(reason))},
+			"Content-Type":   []string{"text/plain; charset=utf-8"},
+		},
+		Body: io.NopCloser(strings.NewReader(reason)),
+	}
+}
+
 func removeHopByHopHeaders(headers http.Header) {
 	// Implements RFC 9111 section 3.1
 
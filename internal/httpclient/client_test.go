@@ -1,17 +1,25 @@
 package httpclient
 
 import (
+	"cmp"
+	"context"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -47,18 +55,29 @@ func setup(
 	require.NoError(t, err)
 	clock = &Clock{testTime}
 
-	cache, err := NewCache(cachePath, units.Bytes{Bytes: 100}, units.Bytes{Bytes: 1000}, logger)
+	cache, err := NewCache(
+		cachePath,
+		units.Bytes{Bytes: 100},
+		units.Bytes{Bytes: 1000},
+		Compression{},
+		logger,
+	)
 	require.NoError(t, err)
 	t.Cleanup(func() { assert.NoError(t, cache.Close()) })
 
 	hits := []string{}
+	hitsLock := sync.Mutex{}
 
 	return New(
 			&http.Client{Transport: &http.Transport{}},
 			cache,
 			logger,
 			false,
-			func(r *http.Request, status string) { hits = append(hits, status) },
+			func(r *http.Request, status string) {
+				hitsLock.Lock()
+				defer hitsLock.Unlock()
+				hits = append(hits, status)
+			},
 			clock.Now,
 			clock.Since,
 		),
@@ -66,7 +85,11 @@ func setup(
 		func(expectedResponses map[string]CachedResponses, expectedHashes []string) {
 			validateCache(t, cache, expectedResponses, expectedHashes)
 		},
-		func(expected []string) { assert.Equal(t, expected, hits) }
+		func(expected []string) {
+			hitsLock.Lock()
+			defer hitsLock.Unlock()
+			assert.Equal(t, expected, hits)
+		}
 }
 
 func makeRequest(
@@ -638,6 +661,7 @@ func TestClientReturnsResponseFromCacheIfDisconnected(t *testing.T) {
 			t.Parallel()
 
 			client, clock, _, validateQueries := setup(t)
+			client = client.WithOptions(Options{Name: "locaccel"})
 
 			wasCalled := false
 
@@ -674,11 +698,13 @@ func TestClientReturnsResponseFromCacheIfDisconnected(t *testing.T) {
 				t,
 				http.Header{
 					"Cache-Control":  []string{"public, max-age=0"},
+					"Cache-Status":   []string{"locaccel; fwd=uri-miss; ttl=0; stored"},
 					"Content-Length": []string{"6"},
 					"Content-Type":   []string{"text/plain; charset=utf-8"},
 					"Date": []string{
 						clock.Now().Add(-time.Second).Format(http.TimeFormat),
 					},
+					"Via": []string{"1.1 locaccel"},
 				},
 				resp.Header,
 			)
@@ -697,13 +723,18 @@ func TestClientReturnsResponseFromCacheIfDisconnected(t *testing.T) {
 			assert.Equal(
 				t,
 				http.Header{
-					"Age":            []string{"1"},
-					"Cache-Control":  []string{"public, max-age=0"},
+					"Age":           []string{"1"},
+					"Cache-Control": []string{"public, max-age=0"},
+					"Cache-Status": []string{
+						"locaccel; fwd=stale; fwd-status=" + strconv.Itoa(tc.status) + "; ttl=-1",
+					},
 					"Content-Length": []string{"6"},
 					"Content-Type":   []string{"text/plain; charset=utf-8"},
 					"Date": []string{
 						clock.Now().Add(-time.Second).Format(http.TimeFormat),
 					},
+					"Via":     []string{"1.1 locaccel"},
+					"Warning": []string{`111 - "Revalidation Failed"`},
 				},
 				resp.Header,
 			)
@@ -728,16 +759,19 @@ func TestClientReturnsResponseFromCacheIfDisconnected(t *testing.T) {
 				http.Header{
 					"Age":            []string{"2"},
 					"Cache-Control":  []string{"public, max-age=0"},
+					"Cache-Status":   []string{"locaccel; fwd=stale; ttl=-2"},
 					"Content-Length": []string{"6"},
 					"Content-Type":   []string{"text/plain; charset=utf-8"},
 					"Date": []string{
 						clock.Now().Add(-2 * time.Second).Format(http.TimeFormat),
 					},
+					"Via":     []string{"1.1 locaccel"},
+					"Warning": []string{`111 - "Revalidation Failed"`},
 				},
 				resp.Header,
 			)
 
-			validateQueries([]string{"miss", "hit", "hit"})
+			validateQueries([]string{"miss", "stale", "stale"})
 		})
 	}
 }
@@ -1055,6 +1089,7 @@ func TestClientAddsConditionalQueriesInformation(t *testing.T) {
 				t.TempDir(),
 				units.Bytes{Bytes: 100},
 				units.Bytes{Bytes: 1000},
+				Compression{},
 				logger,
 			)
 			require.NoError(t, err)
@@ -1231,5 +1266,2409 @@ func TestDoesntReturnCachedEntryFromNonExplicitlyCacheableEntriesUnlessDisconnec
 			},
 		},
 	}, []string{"0c182ae20fca17b0e8c3e79cacdd80dbc1f84b55d379191ff7ecaf860d9bf2fd", "20206e4354b041abf0cfd09f5094762ecfd6b61313f53ee4b93fc98410ed400b"})
-	validateQueries([]string{"miss", "miss", "hit", "hit"})
+	validateQueries([]string{"miss", "miss", "stale", "stale"})
+}
+
+func TestClientCoalescesConcurrentRequestsForTheSameResource(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description      string
+		cacheControl     string
+		cancelFirst      bool
+		expectedRequests int32
+		expectedQueries  []string
+	}{
+		{"cacheable", "public, max-age=60", false, 1, []string{"miss", "coalesced", "coalesced", "coalesced", "coalesced"}},
+		{"uncacheable", "no-store", false, 5, []string{"miss", "miss", "miss", "miss", "miss"}},
+		// The others are still served once the first client goes away
+		{"first-cancelled", "public, max-age=60", true, 1, []string{"miss", "coalesced", "coalesced", "coalesced", "coalesced"}},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, validateQueries := setup(t)
+
+			var requests atomic.Int32
+			received := make(chan struct{}, 5)
+			release := make(chan struct{})
+			date := clock.Now().Format(http.TimeFormat)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				received <- struct{}{}
+
+				w.Header().Add("Date", date)
+				w.Header().Add("Cache-Control", tc.cacheControl)
+				_, err := w.Write([]byte("Hello"))
+				assert.NoError(t, err)
+				w.(http.Flusher).Flush()
+
+				<-release
+				_, err = w.Write([]byte("!"))
+				assert.NoError(t, err)
+			}))
+			t.Cleanup(srv.Close)
+
+			// Responses are only complete once released, so all the requests
+			// get their headers while the first one is still in flight
+			headers := make(chan struct{}, 5)
+			wg := sync.WaitGroup{}
+			doRequest := func(ctx context.Context, cancelled bool) {
+				defer wg.Done()
+
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+				req = req.WithContext(testutils.TestLogger(t, nil).WithContext(req.Context()))
+
+				resp, err := client.Do(req, UpstreamCache{})
+				headers <- struct{}{}
+				if !assert.NoError(t, err) {
+					return
+				}
+				body, err := io.ReadAll(resp.Body)
+				assert.NoError(t, resp.Body.Close())
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				if cancelled {
+					assert.ErrorIs(t, err, context.Canceled)
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, "Hello!", string(body))
+			}
+
+			// Start the first request, and wait for it to reach upstream
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			wg.Add(1)
+			go doRequest(ctx, tc.cancelFirst)
+			<-received
+
+			wg.Add(4)
+			for range 4 {
+				go doRequest(t.Context(), false)
+			}
+
+			for range 5 {
+				<-headers
+			}
+			if tc.cancelFirst {
+				cancel()
+			}
+			close(release)
+			wg.Wait()
+
+			assert.Equal(t, tc.expectedRequests, requests.Load())
+			validateQueries(tc.expectedQueries)
+		})
+	}
+}
+
+func TestClientStreamsInFlightResponsesToConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	date := clock.Now().Format(http.TimeFormat)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		w.Header().Add("Date", date)
+		w.Header().Add("Cache-Control", "public, max-age=60")
+		_, err := w.Write([]byte("Hello"))
+		assert.NoError(t, err)
+		w.(http.Flusher).Flush()
+
+		<-release
+		_, err = w.Write([]byte(" world!"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	doRequest := func() *http.Response {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		req = req.WithContext(testutils.TestLogger(t, nil).WithContext(req.Context()))
+
+		resp, err := client.Do(req, UpstreamCache{})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	leader := doRequest()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(leader.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf))
+
+	// The follower gets the data already downloaded before upstream is done
+	follower := doRequest()
+	_, err = io.ReadFull(follower.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf))
+
+	close(release)
+
+	for _, resp := range []*http.Response{leader, follower} {
+		rest, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, " world!", string(rest))
+	}
+
+	assert.Equal(t, int32(1), requests.Load())
+	validateQueries([]string{"miss", "coalesced"})
+}
+
+func TestClientKeepsStreamingInFlightResponsesWhenTheFirstClientLeaves(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	date := clock.Now().Format(http.TimeFormat)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		w.Header().Add("Date", date)
+		w.Header().Add("Cache-Control", "public, max-age=60")
+		_, err := w.Write([]byte("Hello"))
+		assert.NoError(t, err)
+		w.(http.Flusher).Flush()
+
+		<-release
+		_, err = w.Write([]byte(" world!"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	doRequest := func() *http.Response {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		req = req.WithContext(testutils.TestLogger(t, nil).WithContext(req.Context()))
+
+		resp, err := client.Do(req, UpstreamCache{})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	leader := doRequest()
+	follower := doRequest()
+
+	// The first client goes away before the end of the download
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(leader.Body, buf)
+	require.NoError(t, err)
+	require.NoError(t, leader.Body.Close())
+
+	close(release)
+
+	body, err := io.ReadAll(follower.Body)
+	require.NoError(t, err)
+	require.NoError(t, follower.Body.Close())
+	assert.Equal(t, "Hello world!", string(body))
+
+	// The full response was stored
+	cached := doRequest()
+	body, err = io.ReadAll(cached.Body)
+	require.NoError(t, err)
+	require.NoError(t, cached.Body.Close())
+	assert.Equal(t, "Hello world!", string(body))
+
+	assert.Equal(t, int32(1), requests.Load())
+	validateQueries([]string{"miss", "coalesced", "hit"})
+}
+
+func TestClientServesStaleResponsesWhileRevalidating(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description     string
+		cacheControl    string
+		defaultWindow   time.Duration
+		expectedBody    string
+		expectedQueries []string
+	}{
+		{
+			"upstream-window",
+			"public, max-age=1, stale-while-revalidate=60",
+			0,
+			"v1",
+			[]string{"miss", "stale", "hit"},
+		},
+		{"default-window", "public, max-age=1", time.Minute, "v1", []string{"miss", "stale", "hit"}},
+		{"no-window", "public, max-age=1", 0, "v2", []string{"miss", "miss", "hit"}},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, validateQueries := setup(t)
+			client = client.WithOptions(Options{StaleWhileRevalidate: tc.defaultWindow})
+
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+				w.Header().Add("Cache-Control", tc.cacheControl)
+				_, err := fmt.Fprintf(w, "v%d", requests.Add(1))
+				assert.NoError(t, err)
+			}))
+			t.Cleanup(srv.Close)
+
+			_, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+			assert.Equal(t, "v1", body)
+
+			clock.Advance()
+			clock.Advance()
+
+			_, body = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+			assert.Equal(t, tc.expectedBody, body)
+
+			client.Wait()
+
+			// The entry has been refreshed, and is now fresh
+			_, body = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+			assert.Equal(t, "v2", body)
+
+			assert.Equal(t, int32(2), requests.Load())
+			validateQueries(tc.expectedQueries)
+		})
+	}
+}
+
+func TestClientRespectsStaleIfErrorPolicy(t *testing.T) {
+	t.Parallel()
+
+	fiveSeconds := 5 * time.Second
+	oneMinute := time.Minute
+
+	for _, tc := range []struct {
+		description    string
+		cacheControl   string
+		errorStatus    int
+		policy         StaleIfErrorPolicy
+		expectedStatus int
+	}{
+		{"within-directive", "max-age=1, stale-if-error=60", 503, StaleIfErrorPolicy{}, 200},
+		{"exceeds-directive", "max-age=1, stale-if-error=5", 503, StaleIfErrorPolicy{}, 503},
+		{
+			"directive-takes-precedence",
+			"max-age=1, stale-if-error=60",
+			503,
+			StaleIfErrorPolicy{MaxStaleness: &fiveSeconds},
+			200,
+		},
+		{"within-max-staleness", "max-age=1", 503, StaleIfErrorPolicy{MaxStaleness: &oneMinute}, 200},
+		{"exceeds-max-staleness", "max-age=1", 503, StaleIfErrorPolicy{MaxStaleness: &fiveSeconds}, 503},
+		{"must-revalidate", "max-age=1, must-revalidate", 503, StaleIfErrorPolicy{}, 503},
+		{
+			"must-revalidate-allowed",
+			"max-age=1, must-revalidate",
+			503,
+			StaleIfErrorPolicy{AllowMustRevalidate: true},
+			200,
+		},
+		{"unlisted-status", "max-age=1", 503, StaleIfErrorPolicy{StatusCodes: []int{502}}, 503},
+		{"listed-status", "max-age=1", 404, StaleIfErrorPolicy{StatusCodes: []int{404}}, 200},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, _ := setup(t)
+			client = client.WithOptions(Options{StaleIfError: tc.policy})
+
+			wasCalled := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if wasCalled {
+					w.WriteHeader(tc.errorStatus)
+					return
+				}
+
+				w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+				w.Header().Add("Cache-Control", tc.cacheControl)
+				_, err := w.Write([]byte("Hello!"))
+				assert.NoError(t, err)
+				wasCalled = true
+			}))
+			t.Cleanup(srv.Close)
+
+			resp, _ := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			for range 10 {
+				clock.Advance()
+			}
+
+			resp, _ = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestClientRespectsRequestCacheControlDirectives(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description      string
+		headers          http.Header
+		opts             Options
+		elapsed          int
+		expectedQueries  []string
+		expectedRequests int32
+	}{
+		{
+			"no-cache",
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			Options{},
+			0,
+			[]string{"miss", "miss"},
+			2,
+		},
+		{
+			"pragma-no-cache",
+			http.Header{"Pragma": []string{"no-cache"}},
+			Options{},
+			0,
+			[]string{"miss", "miss"},
+			2,
+		},
+		{
+			"ignored-no-cache",
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			Options{IgnoreClientNoCache: true},
+			0,
+			[]string{"miss", "hit"},
+			1,
+		},
+		{
+			"max-age",
+			http.Header{"Cache-Control": []string{"max-age=0"}},
+			Options{},
+			1,
+			[]string{"miss", "miss"},
+			2,
+		},
+		{
+			"min-fresh",
+			http.Header{"Cache-Control": []string{"min-fresh=30"}},
+			Options{},
+			40,
+			[]string{"miss", "miss"},
+			2,
+		},
+		{
+			"max-stale",
+			http.Header{"Cache-Control": []string{"max-stale=30"}},
+			Options{},
+			70,
+			[]string{"miss", "hit"},
+			1,
+		},
+		{
+			"too-stale",
+			http.Header{"Cache-Control": []string{"max-stale=5"}},
+			Options{},
+			70,
+			[]string{"miss", "miss"},
+			2,
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, validateQueries := setup(t)
+			client = client.WithOptions(tc.opts)
+
+			var requests atomic.Int32
+			date := clock.Now().Format(http.TimeFormat)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Header().Add("Date", date)
+				w.Header().Add("Cache-Control", "public, max-age=60")
+				_, err := w.Write([]byte("Hello!"))
+				assert.NoError(t, err)
+			}))
+			t.Cleanup(srv.Close)
+
+			_, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+			assert.Equal(t, "Hello!", body)
+
+			for range tc.elapsed {
+				clock.Advance()
+			}
+
+			resp, body := makeRequest( //nolint:bodyclose
+				t,
+				client,
+				http.MethodGet,
+				srv.URL,
+				tc.headers,
+				nil,
+			)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "Hello!", body)
+
+			assert.Equal(t, tc.expectedRequests, requests.Load())
+			validateQueries(tc.expectedQueries)
+		})
+	}
+}
+
+func TestClientReturnsGatewayTimeoutForOnlyIfCachedOnMiss(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+		w.Header().Add("Cache-Control", "public, max-age=60")
+		_, err := w.Write([]byte("Hello!"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	onlyIfCached := http.Header{"Cache-Control": []string{"only-if-cached"}}
+
+	resp, _ := makeRequest(t, client, http.MethodGet, srv.URL, onlyIfCached, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, int32(0), requests.Load())
+
+	_, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, "Hello!", body)
+
+	resp, body = makeRequest(t, client, http.MethodGet, srv.URL, onlyIfCached, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+
+	assert.Equal(t, int32(1), requests.Load())
+	validateQueries([]string{"miss", "miss", "hit"})
+}
+
+func TestClientDoesNotStoreResponsesForNoStoreRequests(t *testing.T) {
+	t.Parallel()
+
+	client, clock, validateCache, validateQueries := setup(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+		w.Header().Add("Cache-Control", "public, max-age=60")
+		_, err := w.Write([]byte("Hello!"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, body := makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodGet,
+		srv.URL,
+		http.Header{"Cache-Control": []string{"no-store"}},
+		nil,
+	)
+	assert.Equal(t, "Hello!", body)
+
+	validateCache(map[string]CachedResponses{}, nil)
+	validateQueries([]string{"miss"})
+}
+
+func must[T any](val T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func TestClientServesPreferredVariantsForNegotiatedHeaders(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+		clock.Advance()
+		w.Header().Add("Cache-Control", "public, max-age=30")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := "identity"
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			encoding = "gzip"
+			w.Header().Add("Content-Encoding", "gzip")
+		}
+		_, err := w.Write([]byte(encoding))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"gzip", "gzip"},
+		{"identity", "identity"},
+		// Reordering and whitespace are normalized
+		{" GZIP ", "gzip"},
+		// Stored variants are reused if they are preferred
+		{"gzip, deflate, br", "gzip"},
+		{"deflate;q=0.5, identity", "identity"},
+	} {
+		_, body := makeRequest( //nolint:bodyclose
+			t,
+			client,
+			http.MethodGet,
+			srv.URL,
+			http.Header{"Accept-Encoding": []string{tc.acceptEncoding}},
+			nil,
+		)
+		assert.Equal(t, tc.expected, body, "Accept-Encoding: %s", tc.acceptEncoding)
+	}
+
+	validateQueries([]string{"miss", "miss", "hit", "hit", "hit"})
+}
+
+func TestClientAnswersHeadRequestsFromCachedGetResponses(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+
+	requests := map[string]int{}
+	requestsLock := sync.Mutex{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsLock.Lock()
+		requests[r.Method] += 1
+		requestsLock.Unlock()
+
+		w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+		w.Header().Add("Cache-Control", "public, max-age=30")
+		_, err := w.Write([]byte("Hello!"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	// Entries for HEAD requests stored by previous versions should be removed
+	headKey := []byte("HEAD+" + srv.URL)
+	require.NoError(t, client.cache.New(headKey, CachedResponses{{ContentHash: "outdated"}}))
+
+	resp, body := makeRequest(t, client, http.MethodHead, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+
+	_, body = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, "Hello!", body)
+
+	resp, body = makeRequest(t, client, http.MethodHead, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "6", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "public, max-age=30", resp.Header.Get("Cache-Control"))
+	assert.Empty(t, body)
+
+	validateQueries([]string{"miss", "miss", "hit"})
+	assert.Equal(t, map[string]int{http.MethodHead: 1, http.MethodGet: 1}, requests)
+
+	entry := new(database.Entry[CachedResponses])
+	require.ErrorIs(t, client.cache.Get(headKey, entry), database.ErrKeyNotFound)
+}
+
+func TestClientCachesNegativeResponsesWhenConfigured(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description     string
+		statusCode      int
+		headers         http.Header
+		negativeTTL     time.Duration
+		expectedQueries []string
+	}{
+		{"disabled", http.StatusNotFound, nil, 0, []string{"miss", "miss", "miss"}},
+		{"not-found", http.StatusNotFound, nil, 2 * time.Second, []string{"miss", "hit", "miss"}},
+		{"gone", http.StatusGone, nil, 2 * time.Second, []string{"miss", "hit", "miss"}},
+		{
+			"no-store",
+			http.StatusNotFound,
+			http.Header{"Cache-Control": {"no-store"}},
+			2 * time.Second,
+			[]string{"miss", "miss", "miss"},
+		},
+		{
+			"other-errors",
+			http.StatusForbidden,
+			nil,
+			2 * time.Second,
+			[]string{"miss", "miss", "miss"},
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, validateQueries := setup(t)
+			client = client.WithOptions(Options{NegativeTTL: tc.negativeTTL})
+
+			srv := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					maps.Copy(w.Header(), tc.headers)
+					w.WriteHeader(tc.statusCode)
+					_, err := w.Write([]byte("Missing"))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(srv.Close)
+
+			for range 3 {
+				resp, body := makeRequest( //nolint:bodyclose
+					t,
+					client,
+					http.MethodGet,
+					srv.URL,
+					nil,
+					nil,
+				)
+				assert.Equal(t, tc.statusCode, resp.StatusCode)
+				assert.Equal(t, "Missing", body)
+				clock.Advance()
+			}
+
+			validateQueries(tc.expectedQueries)
+		})
+	}
+}
+
+func TestClientAppliesFreshnessRules(t *testing.T) {
+	t.Parallel()
+
+	twoSeconds := 2 * time.Second
+
+	for _, tc := range []struct {
+		description     string
+		cacheControl    string
+		rule            FreshnessRule
+		expectedQueries []string
+	}{
+		{
+			"ttl",
+			"no-cache",
+			FreshnessRule{Path: regexp.MustCompile("^/blobs/"), TTL: &twoSeconds},
+			[]string{"miss", "hit", "revalidated"},
+		},
+		{
+			"immutable",
+			"max-age=0, must-revalidate",
+			FreshnessRule{Path: regexp.MustCompile("^/blobs/"), Immutable: true},
+			[]string{"miss", "hit", "hit"},
+		},
+		{
+			"no-store",
+			"public, max-age=3600",
+			FreshnessRule{Path: regexp.MustCompile("^/blobs/"), NoStore: true},
+			[]string{"N/A", "N/A", "N/A"},
+		},
+		{
+			"not-matching",
+			"no-cache",
+			FreshnessRule{Path: regexp.MustCompile("^/other/"), Immutable: true},
+			[]string{"miss", "revalidated", "revalidated"},
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, validateQueries := setup(t)
+			client = client.WithOptions(Options{FreshnessRules: []FreshnessRule{tc.rule}})
+
+			srv := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+					w.Header().Add("Cache-Control", tc.cacheControl)
+					w.Header().Add("Etag", "blob")
+					if r.Header.Get("If-None-Match") == "blob" {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					_, err := w.Write([]byte("Hello!"))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(srv.Close)
+
+			for range 3 {
+				_, body := makeRequest( //nolint:bodyclose
+					t,
+					client,
+					http.MethodGet,
+					srv.URL+"/blobs/1234",
+					http.Header{},
+					nil,
+				)
+				assert.Equal(t, "Hello!", body)
+				clock.Advance()
+			}
+
+			validateQueries(tc.expectedQueries)
+		})
+	}
+}
+
+func TestClientDoesNotStoreResponsesForbiddingItWhenMatchingFreshnessRules(t *testing.T) {
+	t.Parallel()
+
+	for _, cacheControl := range []string{"no-store", "private"} {
+		t.Run(cacheControl, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, validateCache, validateQueries := setup(t)
+			client = client.WithOptions(Options{FreshnessRules: []FreshnessRule{
+				{Path: regexp.MustCompile("^/blobs/"), Immutable: true},
+			}})
+
+			srv := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+					w.Header().Add("Cache-Control", cacheControl)
+					_, err := w.Write([]byte("Hello!"))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(srv.Close)
+
+			for range 2 {
+				_, body := makeRequest( //nolint:bodyclose
+					t,
+					client,
+					http.MethodGet,
+					srv.URL+"/blobs/1234",
+					http.Header{},
+					nil,
+				)
+				assert.Equal(t, "Hello!", body)
+			}
+
+			validateCache(map[string]CachedResponses{}, nil)
+			validateQueries([]string{"miss", "miss"})
+		})
+	}
+}
+
+func TestClientInvalidatesEntriesOnUnsafeMethods(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description     string
+		method          string
+		statusCode      int
+		headers         http.Header
+		expectedQueries []string
+	}{
+		{
+			"post",
+			http.MethodPost,
+			http.StatusCreated,
+			nil,
+			[]string{"miss", "miss", "miss", "miss", "hit"},
+		},
+		{
+			"put-location",
+			http.MethodPut,
+			http.StatusOK,
+			http.Header{"Location": {"/other"}},
+			[]string{"miss", "miss", "miss", "miss", "miss"},
+		},
+		{
+			"delete-content-location",
+			http.MethodDelete,
+			http.StatusNoContent,
+			http.Header{"Content-Location": {"other"}},
+			[]string{"miss", "miss", "miss", "miss", "miss"},
+		},
+		{
+			"other-origin",
+			http.MethodPost,
+			http.StatusOK,
+			http.Header{"Location": {"http://other.test/other"}},
+			[]string{"miss", "miss", "miss", "miss", "hit"},
+		},
+		{
+			"error",
+			http.MethodPost,
+			http.StatusBadRequest,
+			nil,
+			[]string{"miss", "miss", "miss", "hit", "hit"},
+		},
+		{
+			"safe-method",
+			http.MethodOptions,
+			http.StatusOK,
+			nil,
+			[]string{"miss", "miss", "miss", "hit", "hit"},
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, validateQueries := setup(t)
+
+			srv := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method != http.MethodGet {
+						maps.Copy(w.Header(), tc.headers)
+						w.WriteHeader(tc.statusCode)
+						return
+					}
+
+					w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+					w.Header().Add("Cache-Control", "public, max-age=60")
+					_, err := w.Write([]byte("Hello!"))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(srv.Close)
+
+			// Relative references are resolved against the target URI
+			target := srv.URL + "/target/"
+			other := srv.URL + "/other"
+			if tc.headers.Get("Content-Location") != "" {
+				other = srv.URL + "/target/other"
+			}
+
+			makeRequest(t, client, http.MethodGet, target, nil, nil) //nolint:bodyclose
+			makeRequest(t, client, http.MethodGet, other, nil, nil)  //nolint:bodyclose
+
+			resp, _ := makeRequest(t, client, tc.method, target, nil, nil) //nolint:bodyclose
+			assert.Equal(t, tc.statusCode, resp.StatusCode)
+
+			makeRequest(t, client, http.MethodGet, target, nil, nil) //nolint:bodyclose
+			makeRequest(t, client, http.MethodGet, other, nil, nil)  //nolint:bodyclose
+
+			validateQueries(tc.expectedQueries)
+		})
+	}
+}
+
+func TestClientKeepsTheAgeOfInvalidatedEntries(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	maxStaleness := 10 * time.Second
+	client = client.WithOptions(
+		Options{StaleIfError: StaleIfErrorPolicy{MaxStaleness: &maxStaleness}},
+	)
+
+	var failing atomic.Bool
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	makeRequest(t, client, http.MethodGet, srv.URL, nil, nil)  //nolint:bodyclose
+	makeRequest(t, client, http.MethodPost, srv.URL, nil, nil) //nolint:bodyclose
+
+	// The invalidated response is just past its lifetime, not infinitely old
+	failing.Store(true)
+	resp, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+	assert.Equal(t, "61", resp.Header.Get("Age"))
+
+	validateQueries([]string{"miss", "miss", "stale"})
+}
+
+func TestClientFallsThroughUpstreamCachesReturningErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, statusCode := range []int{
+		http.StatusInternalServerError,
+		http.StatusServiceUnavailable,
+		http.StatusTooManyRequests,
+	} {
+		t.Run(strconv.Itoa(statusCode), func(t *testing.T) {
+			t.Parallel()
+
+			client, clock, _, validateQueries := setup(t)
+
+			upstreamCache := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(statusCode)
+					_, err := w.Write([]byte("Unavailable"))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(upstreamCache.Close)
+
+			srv := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+					w.Header().Add("Cache-Control", "public")
+					_, err := w.Write([]byte("Hello!"))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(srv.Close)
+
+			upstreamCacheURL, err := url.Parse(upstreamCache.URL)
+			require.NoError(t, err)
+
+			resp, body := makeRequest( //nolint:bodyclose
+				t,
+				client,
+				http.MethodGet,
+				srv.URL,
+				nil,
+				[]*url.URL{upstreamCacheURL},
+			)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "Hello!", body)
+			validateQueries([]string{"miss"})
+
+			health := client.UpstreamHealth()
+			require.Len(t, health, 1)
+			assert.Equal(t, upstreamCache.URL, health[0].Upstream)
+			assert.Equal(t, CircuitClosed, health[0].State)
+			assert.Equal(t, uint64(1), health[0].Requests)
+			assert.Equal(t, uint64(1), health[0].Failures)
+			assert.Equal(t, uint64(1), health[0].ConsecutiveFailures)
+		})
+	}
+}
+
+func TestClientSkipsUnhealthyUpstreamCaches(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, _ := setup(t)
+
+	healthy := atomic.Bool{}
+	upstreamCalls := atomic.Int32{}
+	upstreamCache := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamCalls.Add(1)
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Header().Add("Cache-Control", "no-store")
+			_, err := w.Write([]byte("From upstream cache"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(upstreamCache.Close)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-store")
+		_, err := w.Write([]byte("From origin"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	upstreamCacheURL, err := url.Parse(upstreamCache.URL)
+	require.NoError(t, err)
+
+	request := func() string {
+		t.Helper()
+		_, body := makeRequest( //nolint:bodyclose
+			t,
+			client,
+			http.MethodGet,
+			srv.URL,
+			nil,
+			[]*url.URL{upstreamCacheURL},
+		)
+		return body
+	}
+
+	for range failureThreshold {
+		assert.Equal(t, "From origin", request())
+	}
+	assert.Equal(t, int32(failureThreshold), upstreamCalls.Load())
+	assert.Equal(t, CircuitOpen, client.UpstreamHealth()[0].State)
+
+	// The circuit is open, the upstream cache is not contacted anymore
+	assert.Equal(t, "From origin", request())
+	assert.Equal(t, int32(failureThreshold), upstreamCalls.Load())
+
+	// Once the cooldown is over, a request probes the upstream cache again
+	clock.current = clock.current.Add(circuitCooldown)
+	healthy.Store(true)
+
+	assert.Equal(t, "From upstream cache", request())
+	assert.Equal(t, int32(failureThreshold+1), upstreamCalls.Load())
+
+	health := client.UpstreamHealth()[0]
+	assert.Equal(t, CircuitClosed, health.State)
+	assert.Equal(t, uint64(0), health.ConsecutiveFailures)
+}
+
+func TestHealthTrackerReopensCircuitWhenProbeFails(t *testing.T) {
+	t.Parallel()
+
+	clock := &Clock{time.Now()}
+	tracker := newHealthTracker(clock.Now)
+
+	for range failureThreshold {
+		require.True(t, tracker.allow("upstream"))
+		tracker.record("upstream", false, time.Second)
+	}
+	assert.False(t, tracker.allow("upstream"))
+
+	clock.current = clock.current.Add(circuitCooldown)
+
+	// Only a single probe is allowed at a time
+	require.True(t, tracker.allow("upstream"))
+	assert.False(t, tracker.allow("upstream"))
+	tracker.record("upstream", false, time.Second)
+
+	assert.Equal(t, CircuitOpen, tracker.snapshot()[0].State)
+	assert.False(t, tracker.allow("upstream"))
+}
+
+func TestClientHedgesRequestsToSlowUpstreamCaches(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{HedgingDelay: 50 * time.Millisecond})
+
+	cancelled := make(chan struct{})
+	upstreamCache := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+			case <-time.After(5 * time.Second):
+				assert.Fail(t, "The request to the slow upstream cache was not cancelled")
+			}
+		}),
+	)
+	t.Cleanup(upstreamCache.Close)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-store")
+		_, err := w.Write([]byte("From origin"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	upstreamCacheURL, err := url.Parse(upstreamCache.URL)
+	require.NoError(t, err)
+
+	resp, body := makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodGet,
+		srv.URL,
+		nil,
+		[]*url.URL{upstreamCacheURL},
+	)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "From origin", body)
+	validateQueries([]string{"miss"})
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "The request to the slow upstream cache was not cancelled")
+	}
+}
+
+func TestClientHedgingTriesNextUpstreamImmediatelyOnErrors(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, _ := setup(t)
+	// The test would time out if we waited for the delay
+	client = client.WithOptions(Options{HedgingDelay: time.Hour})
+
+	upstreamCache := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	t.Cleanup(upstreamCache.Close)
+
+	secondUpstreamCache := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Cache-Control", "no-store")
+			_, err := w.Write([]byte("From upstream cache"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(secondUpstreamCache.Close)
+
+	upstreamCacheURL, err := url.Parse(upstreamCache.URL)
+	require.NoError(t, err)
+	secondUpstreamCacheURL, err := url.Parse(secondUpstreamCache.URL)
+	require.NoError(t, err)
+
+	_, body := makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodGet,
+		"https://invalid.test",
+		nil,
+		[]*url.URL{upstreamCacheURL, secondUpstreamCacheURL},
+	)
+	assert.Equal(t, "From upstream cache", body)
+}
+
+func TestClientHedgingWaitsForUpstreamCachesWhenUpstreamFails(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, _ := setup(t)
+	client = client.WithOptions(Options{HedgingDelay: 10 * time.Millisecond})
+
+	upstreamCache := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.Header().Add("Cache-Control", "no-store")
+			_, err := w.Write([]byte("From upstream cache"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(upstreamCache.Close)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	upstreamCacheURL, err := url.Parse(upstreamCache.URL)
+	require.NoError(t, err)
+
+	resp, body := makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodGet,
+		srv.URL,
+		nil,
+		[]*url.URL{upstreamCacheURL},
+	)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "From upstream cache", body)
+
+	// The failure from upstream is returned if no upstream cache answers
+	upstreamCache.Close()
+
+	resp, _ = makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodGet,
+		srv.URL,
+		nil,
+		[]*url.URL{upstreamCacheURL},
+	)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestHealthTrackerOrdersUpstreamsByLatency(t *testing.T) {
+	t.Parallel()
+
+	tracker := newHealthTracker(time.Now)
+
+	upstreams := []*url.URL{}
+	for _, host := range []string{"slow", "unknown", "fast", "failing"} {
+		upstreams = append(upstreams, &url.URL{Scheme: "http", Host: host})
+	}
+
+	tracker.record("http://slow", true, 2*time.Second)
+	tracker.record("http://fast", true, time.Second)
+	tracker.record("http://failing", false, time.Millisecond)
+	tracker.record("http://failing", true, 3*time.Second)
+
+	ordered := []string{}
+	for _, upstream := range tracker.orderByLatency(upstreams) {
+		ordered = append(ordered, upstream.Host)
+	}
+	assert.Equal(t, []string{"unknown", "fast", "slow", "failing"}, ordered)
+}
+
+func TestClientShardsRequestsAcrossPeers(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, _ := setup(t)
+
+	peerUp := atomic.Bool{}
+	peerUp.Store(true)
+	peerCalls := atomic.Int32{}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCalls.Add(1)
+		if !peerUp.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Add("Cache-Control", "no-store")
+		_, err := w.Write([]byte("From peer"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(peer.Close)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-store")
+		_, err := w.Write([]byte("From origin"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	peerURL, err := url.Parse(peer.URL)
+	require.NoError(t, err)
+	self := &url.URL{Scheme: "http", Host: "self.test:1234"}
+	client = client.WithOptions(Options{PeerGroup: PeerGroup{[]*url.URL{peerURL, self}, self}})
+
+	ownedByPeer := []string{}
+	ownedBySelf := []string{}
+	for i := range 20 {
+		uri := srv.URL + "/" + strconv.Itoa(i)
+		parsed, err := url.Parse(uri)
+		require.NoError(t, err)
+
+		owner := client.opts.PeerGroup.rankPeers(buildKeyForMethod(http.MethodGet, parsed))[0]
+		if owner == self {
+			ownedBySelf = append(ownedBySelf, uri)
+		} else {
+			ownedByPeer = append(ownedByPeer, uri)
+		}
+	}
+	require.NotEmpty(t, ownedByPeer)
+	require.NotEmpty(t, ownedBySelf)
+
+	for _, uri := range ownedByPeer {
+		_, body := makeRequest(t, client, http.MethodGet, uri, nil, nil) //nolint:bodyclose
+		assert.Equal(t, "From peer", body)
+	}
+	for _, uri := range ownedBySelf {
+		_, body := makeRequest(t, client, http.MethodGet, uri, nil, nil) //nolint:bodyclose
+		assert.Equal(t, "From origin", body)
+	}
+	assert.Equal(t, int32(len(ownedByPeer)), peerCalls.Load())
+
+	// When the peer goes down, this instance takes over its requests
+	peerUp.Store(false)
+	uri := ownedByPeer[0]
+	for range failureThreshold + 1 {
+		_, body := makeRequest(t, client, http.MethodGet, uri, nil, nil) //nolint:bodyclose
+		assert.Equal(t, "From origin", body)
+	}
+	assert.Equal(t, int32(len(ownedByPeer)+failureThreshold), peerCalls.Load())
+}
+
+func TestPeerOwnershipIsStableWhenPeersLeave(t *testing.T) {
+	t.Parallel()
+
+	peers := []*url.URL{}
+	for _, host := range []string{"cache-1", "cache-2", "cache-3", "cache-4"} {
+		peers = append(peers, &url.URL{Scheme: "http", Host: host + ":3131"})
+	}
+	group := PeerGroup{Peers: peers}
+	reducedGroup := PeerGroup{Peers: slices.Delete(slices.Clone(peers), 1, 2)}
+
+	owners := map[*url.URL]int{}
+	for i := range 1000 {
+		key := []byte("GET+https://example.test/" + strconv.Itoa(i))
+		owner := group.rankPeers(key)[0]
+		owners[owner]++
+
+		// Only the keys of the peer leaving move
+		if owner != peers[1] {
+			assert.Equal(t, owner, reducedGroup.rankPeers(key)[0])
+		}
+	}
+
+	for _, peer := range peers {
+		assert.InDelta(t, 250, owners[peer], 50, "keys are not spread evenly")
+	}
+}
+
+func TestClientReportsCacheStatus(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, _ := setup(t)
+	client = client.WithOptions(Options{Name: "cache-1:3131"})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"1.1 cache-1:3131"}, r.Header.Values("Via"))
+
+		w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+		w.Header().Add("Cache-Control", "public, max-age=60")
+		w.Header().Add("Via", "1.1 origin")
+		_, err := w.Write([]byte("Hello!"))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	testCases := []struct {
+		headers             http.Header
+		expectedCacheStatus string
+	}{
+		{http.Header{}, "cache-1:3131; fwd=uri-miss; ttl=60; stored"},
+		{http.Header{}, "cache-1:3131; hit; ttl=59"},
+		{
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			"cache-1:3131; fwd=request; ttl=60; stored",
+		},
+	}
+
+	for _, tc := range testCases {
+		resp, body := makeRequest( //nolint:bodyclose
+			t,
+			client,
+			http.MethodGet,
+			srv.URL,
+			tc.headers,
+			nil,
+		)
+		assert.Equal(t, "Hello!", body)
+		assert.Equal(t, []string{tc.expectedCacheStatus}, resp.Header.Values("Cache-Status"))
+		assert.Equal(t, []string{"1.1 origin", "1.1 cache-1:3131"}, resp.Header.Values("Via"))
+		clock.Advance()
+	}
+
+	// The headers of the response are not stored
+	entry := new(database.Entry[CachedResponses])
+	require.NoError(t, client.cache.Get([]byte("GET+"+srv.URL), entry))
+	require.Len(t, entry.Value, 1)
+	assert.Equal(t, []string{"1.1 origin"}, entry.Value[0].Headers.Values("Via"))
+	assert.Empty(t, entry.Value[0].Headers.Values("Cache-Status"))
+}
+
+func TestClientRefusesLoopingRequests(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{Name: "cache-1:3131"})
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "http://invalid.test", nil)
+	require.NoError(t, err)
+	req.Header.Add("Via", "1.1 cache-2:3131, 1.1 CACHE-1:3131 (locaccel)")
+
+	_, err = client.Do(req, UpstreamCache{}) //nolint:bodyclose
+	require.ErrorIs(t, err, ErrLoopDetected)
+	validateQueries([]string{})
+}
+
+func TestClientRetriesTransientErrors(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{
+		Retry: RetryPolicy{
+			Attempts:       3,
+			StatusCodes:    []int{http.StatusBadGateway},
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Budget:         0.1,
+		},
+	})
+
+	requests := atomic.Int32{}
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	resp, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+	assert.Equal(t, int32(3), requests.Load())
+	validateQueries([]string{"miss"})
+}
+
+func TestClientDoesNotRetryWhenAskedToWaitTooLong(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, _ := setup(t)
+	client = client.WithOptions(Options{
+		Retry: RetryPolicy{
+			Attempts:       3,
+			StatusCodes:    []int{http.StatusServiceUnavailable},
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Second,
+			Budget:         0.1,
+		},
+	})
+
+	requests := atomic.Int32{}
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Add("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	resp, _ := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestClientStopsRetryingWhenBudgetIsExhausted(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, _ := setup(t)
+	client = client.WithOptions(Options{
+		Retry: RetryPolicy{
+			Attempts:       100,
+			StatusCodes:    []int{http.StatusBadGateway},
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Budget:         0,
+		},
+	})
+
+	requests := atomic.Int32{}
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	resp, _ := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, int32(1+maxRetryTokens), requests.Load())
+
+	// No budget is left, requests are not retried anymore
+	resp, _ = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, int32(2+maxRetryTokens), requests.Load())
+}
+
+func TestClientResumesInterruptedDownloads(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, _ := setup(t)
+	client = client.WithOptions(Options{
+		Retry: RetryPolicy{
+			Attempts:       1,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Budget:         0.1,
+		},
+	})
+
+	ranges := []string{}
+	rangesLock := sync.Mutex{}
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rangesLock.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			rangesLock.Unlock()
+
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public")
+			w.Header().Add("ETag", `"hello"`)
+
+			if r.Header.Get("Range") == "" {
+				w.Header().Add("Content-Length", "12")
+				_, err := w.Write([]byte("Hello"))
+				assert.NoError(t, err)
+				w.(http.Flusher).Flush()
+				// Break the connection in the middle of the body
+				panic(http.ErrAbortHandler)
+			}
+
+			assert.Equal(t, `"hello"`, r.Header.Get("If-Range"))
+			w.Header().Add("Content-Range", "bytes 5-11/12")
+			w.WriteHeader(http.StatusPartialContent)
+			_, err := w.Write([]byte(" World!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	resp, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello World!", body)
+	assert.Equal(t, []string{"", "bytes=5-"}, ranges)
+}
+
+func TestClientResumesInterruptedDownloadsAtTheConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, _ := setup(t)
+	client = client.WithOptions(Options{
+		MaxConcurrentRequests: 1,
+		Retry: RetryPolicy{
+			Attempts:       1,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Budget:         0.1,
+		},
+	})
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public")
+			w.Header().Add("ETag", `"hello"`)
+
+			if r.Header.Get("Range") == "" {
+				w.Header().Add("Content-Length", "12")
+				_, err := w.Write([]byte("Hello"))
+				assert.NoError(t, err)
+				w.(http.Flusher).Flush()
+				// Break the connection in the middle of the body
+				panic(http.ErrAbortHandler)
+			}
+
+			w.Header().Add("Content-Range", "bytes 5-11/12")
+			w.WriteHeader(http.StatusPartialContent)
+			_, err := w.Write([]byte(" World!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req = req.WithContext(testutils.TestLogger(t, nil).WithContext(req.Context()))
+
+	done := make(chan string)
+	go func() {
+		defer close(done)
+
+		resp, err := client.Do(req, UpstreamCache{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		done <- string(body)
+	}()
+
+	select {
+	case body := <-done:
+		assert.Equal(t, "Hello World!", body)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "resuming the download waited for its own slot")
+	}
+}
+
+func TestClientServesFromCacheOnlyWhenOffline(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	global := NewOfflineMode(false, nil)
+	offline := NewOfflineMode(false, global)
+	client = client.WithOptions(Options{Name: "locaccel", Offline: offline})
+
+	requests := atomic.Int32{}
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "max-age=1, must-revalidate")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	resp, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+
+	global.Set(true)
+	assert.True(t, offline.Enabled())
+	assert.False(t, offline.IsSet())
+
+	resp, body = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+	assert.Empty(t, resp.Header.Values("Warning"))
+	assert.Equal(t, []string{"locaccel; hit; ttl=1"}, resp.Header.Values("Cache-Status"))
+
+	// Stale responses are served when offline, even if they need revalidation
+	clock.current = clock.current.Add(time.Hour)
+
+	resp, body = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+	assert.Equal(t, []string{`112 - "Disconnected Operation"`}, resp.Header.Values("Warning"))
+	assert.Equal(t, []string{"locaccel; fwd=stale; ttl=-3599"}, resp.Header.Values("Cache-Status"))
+
+	resp, body = makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodHead,
+		srv.URL,
+		http.Header{"Cache-Control": []string{"no-cache"}},
+		nil,
+	)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, []string{`112 - "Disconnected Operation"`}, resp.Header.Values("Warning"))
+
+	resp, body = makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodGet,
+		srv.URL+"/missing",
+		nil,
+		nil,
+	)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, "The cache is offline, and has no stored response for this request", body)
+
+	resp, _ = makeRequest(t, client, http.MethodPost, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	assert.Equal(t, int32(1), requests.Load())
+	validateQueries([]string{"miss", "hit", "stale", "stale", "miss", "miss"})
+
+	global.Set(false)
+	resp, _ = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestClientAuthenticatesOnlyToUpstream(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, _ := setup(t)
+
+	upstreamCache := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusBadGateway)
+		}),
+	)
+	t.Cleanup(upstreamCache.Close)
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "user" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	upstreamCacheURL, err := url.Parse(upstreamCache.URL)
+	require.NoError(t, err)
+
+	client = client.WithOptions(Options{
+		Credentials: NewCredentials(BasicCredentials, srvURL.Host, "user", "secret", nil),
+	})
+
+	resp, body := makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodGet,
+		srv.URL,
+		nil,
+		[]*url.URL{upstreamCacheURL},
+	)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+}
+
+func TestClientFollowsOCITokenFlow(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, _ := setup(t)
+
+	tokenRequests := atomic.Int32{}
+	tokenServer := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests.Add(1)
+
+			username, password, ok := r.BasicAuth()
+			assert.True(t, ok)
+			assert.Equal(t, "user", username)
+			assert.Equal(t, "secret", password)
+			assert.Equal(t, "registry.test", r.URL.Query().Get("service"))
+			assert.Equal(t, "repository:library/hello:pull,push", r.URL.Query().Get("scope"))
+
+			_, err := w.Write([]byte(`{"token": "abc", "expires_in": 300}`))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(tokenServer.Close)
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer abc" {
+				w.Header().Add(
+					"Www-Authenticate",
+					fmt.Sprintf(
+						`Bearer realm="%s/token",service="registry.test",scope="%s"`,
+						tokenServer.URL,
+						"repository:library/hello:pull,push",
+					),
+				)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	client = client.WithOptions(Options{
+		Credentials: NewCredentials(OCITokenCredentials, srvURL.Host, "user", "secret", nil),
+	})
+
+	for _, tag := range []string{"latest", "v1"} {
+		resp, body := makeRequest( //nolint:bodyclose
+			t,
+			client,
+			http.MethodGet,
+			srv.URL+"/v2/library/hello/manifests/"+tag,
+			nil,
+			nil,
+		)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "Hello!", body)
+	}
+
+	// The token is reused for the same repository
+	assert.Equal(t, int32(1), tokenRequests.Load())
+}
+
+func TestClientOnlyRequestsTokensFromTrustedRealms(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name           string
+		tls            bool
+		realmHost      string
+		realmHosts     []string
+		expectedStatus int
+	}{
+		{"same-host", false, "127.0.0.1", nil, http.StatusOK},
+		{"foreign-host", false, "localhost", nil, http.StatusUnauthorized},
+		{"allowed-foreign-host", false, "localhost", []string{"localhost"}, http.StatusOK},
+		{"http-realm-for-https-upstream", true, "127.0.0.1", nil, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, _, _, _ := setup(t)
+
+			tokenRequests := atomic.Int32{}
+			tokenServer := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					tokenRequests.Add(1)
+					_, err := w.Write([]byte(`{"token": "abc"}`))
+					assert.NoError(t, err)
+				}),
+			)
+			t.Cleanup(tokenServer.Close)
+
+			tokenURL, err := url.Parse(tokenServer.URL)
+			require.NoError(t, err)
+			realm := "http://" + net.JoinHostPort(tc.realmHost, tokenURL.Port()) + "/token"
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer abc" {
+					w.Header().Add("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, realm))
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				_, err := w.Write([]byte("Hello!"))
+				assert.NoError(t, err)
+			})
+
+			var srv *httptest.Server
+			if tc.tls {
+				srv = httptest.NewTLSServer(handler)
+				client.client = srv.Client()
+			} else {
+				srv = httptest.NewServer(handler)
+			}
+			t.Cleanup(srv.Close)
+
+			srvURL, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+
+			client = client.WithOptions(Options{
+				Credentials: NewCredentials(
+					OCITokenCredentials,
+					srvURL.Host,
+					"user",
+					"secret",
+					tc.realmHosts,
+				),
+			})
+
+			resp, _ := makeRequest( //nolint:bodyclose
+				t,
+				client,
+				http.MethodGet,
+				srv.URL+"/v2/library/hello/manifests/latest",
+				nil,
+				nil,
+			)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+
+			expectedTokenRequests := int32(0)
+			if tc.expectedStatus == http.StatusOK {
+				expectedTokenRequests = 1
+			}
+			assert.Equal(t, expectedTokenRequests, tokenRequests.Load())
+		})
+	}
+}
+
+func TestClientPartitionsCacheByAuthorization(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{PartitionByAuthorization: true})
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			if r.URL.Path == "/public" {
+				w.Header().Add("Cache-Control", "public, max-age=60")
+			} else {
+				w.Header().Add("Cache-Control", "private, max-age=60")
+			}
+			_, err := w.Write([]byte("Hello " + cmp.Or(r.Header.Get("Authorization"), "anonymous")))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	alice := http.Header{"Authorization": {"alice"}}
+	bob := http.Header{"Authorization": {"bob"}}
+
+	for _, tc := range []struct {
+		method       string
+		path         string
+		headers      http.Header
+		expectedBody string
+	}{
+		{http.MethodGet, "/private", alice, "Hello alice"},
+		{http.MethodGet, "/private", alice, "Hello alice"},
+		{http.MethodGet, "/private", bob, "Hello bob"},
+		{http.MethodGet, "/private", nil, "Hello anonymous"},
+		// Public responses are shared with everyone
+		{http.MethodGet, "/public", alice, "Hello alice"},
+		{http.MethodGet, "/public", bob, "Hello alice"},
+		{http.MethodGet, "/public", nil, "Hello alice"},
+		// Invalidations apply to all partitions
+		{http.MethodPost, "/private", alice, ""},
+		{http.MethodGet, "/private", bob, "Hello bob"},
+	} {
+		_, body := makeRequest( //nolint:bodyclose
+			t,
+			client,
+			tc.method,
+			srv.URL+tc.path,
+			tc.headers.Clone(),
+			nil,
+		)
+		assert.Equal(t, tc.expectedBody, body)
+	}
+
+	validateQueries([]string{"miss", "hit", "miss", "miss", "miss", "hit", "hit", "miss", "miss"})
+}
+
+func TestClientThrottlesDownloadsFromUpstreamOnly(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{Bandwidth: NewThrottle(200, nil)})
+
+	content := strings.Repeat("a", 400)
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			_, err := w.Write([]byte(content))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	// The first half is allowed as a burst, the second one needs to wait
+	start := time.Now()
+	_, body := makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, content, body)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+
+	start = time.Now()
+	_, body = makeRequest(t, client, http.MethodGet, srv.URL, nil, nil) //nolint:bodyclose
+	assert.Equal(t, content, body)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	validateQueries([]string{"miss", "hit"})
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	assert.Positive(t, client.shaping.upstreams[srvURL.Host].throttled)
+}
+
+func TestClientQueuesRequestsAboveConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	client, _, _, _ := setup(t)
+	client = client.WithOptions(Options{MaxConcurrentRequests: 1})
+
+	inFlight := atomic.Int32{}
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, int32(1), inFlight.Add(1))
+			defer inFlight.Add(-1)
+
+			<-unblock
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	for _, path := range []string{"/first", "/second"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+path, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			req = req.WithContext(testutils.TestLogger(t, nil).WithContext(req.Context()))
+
+			resp, err := client.Do(req, UpstreamCache{})
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.NoError(t, resp.Body.Close())
+			assert.Equal(t, "Hello!", string(body))
+		}()
+	}
+
+	assert.Eventually(t, func() bool {
+		client.shaping.mutex.Lock()
+		defer client.shaping.mutex.Unlock()
+		stats, ok := client.shaping.upstreams[srvURL.Host]
+		return ok && stats.waiting == 1
+	}, time.Second, time.Millisecond)
+
+	close(unblock)
+	wg.Wait()
+
+	assert.Positive(t, client.shaping.upstreams[srvURL.Host].queued)
+	assert.Zero(t, client.shaping.upstreams[srvURL.Host].waiting)
+}
+
+func TestClientVerifiesExpectedDigests(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{VerifyDigests: true})
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	request := func(uri, digest string, expectedErrors []string) error {
+		t.Helper()
+
+		expected, err := ParseOCIDigest(digest)
+		require.NoError(t, err)
+
+		ctx := WithExpectedDigests(t.Context(), expected)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		require.NoError(t, err)
+		logger := testutils.TestLogger(t, expectedErrors)
+		req = req.WithContext(logger.WithContext(req.Context()))
+
+		resp, err := client.Do(req, UpstreamCache{})
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, resp.Body.Close())
+		return err
+	}
+
+	valid := "sha256:334d016f755cd6dc58c53a86e183882f8ec14f52fb05345887c8a5edd42c87b7"
+	invalid := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	require.NoError(t, request(srv.URL+"/valid", valid, nil))
+	require.NoError(t, request(srv.URL+"/valid", valid, nil))
+	require.ErrorIs(
+		t,
+		request(
+			srv.URL+"/invalid",
+			invalid,
+			[]string{
+				"Response from upstream failed verification",
+				"an error happened ingesting the file",
+			},
+		),
+		ErrDigestMismatch,
+	)
+	// The response failing verification was not stored
+	makeRequest(t, client, http.MethodGet, srv.URL+"/invalid", nil, nil) //nolint:bodyclose
+
+	validateQueries([]string{"miss", "hit", "miss", "miss"})
+}
+
+func TestClientServesContentWithTheSameDigestFromOtherURLs(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{VerifyDigests: true})
+
+	registry := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(registry.Close)
+
+	mirror := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Fail(t, "the mirror should not be contacted", r.URL.Path)
+		}),
+	)
+	t.Cleanup(mirror.Close)
+
+	digest, err := ParseOCIDigest(
+		"sha256:334d016f755cd6dc58c53a86e183882f8ec14f52fb05345887c8a5edd42c87b7",
+	)
+	require.NoError(t, err)
+
+	request := func(method, uri string) (*http.Response, string) {
+		t.Helper()
+
+		ctx := WithExpectedDigests(t.Context(), digest)
+		req, err := http.NewRequestWithContext(ctx, method, uri, nil)
+		require.NoError(t, err)
+		logger := testutils.TestLogger(t, nil)
+		req = req.WithContext(logger.WithContext(req.Context()))
+
+		resp, err := client.Do(req, UpstreamCache{})
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp, string(body)
+	}
+
+	_, body := request(http.MethodGet, registry.URL+"/blobs/"+digest.String()) //nolint:bodyclose
+	assert.Equal(t, "Hello!", body)
+
+	resp, body := request(http.MethodGet, mirror.URL+"/other/blob") //nolint:bodyclose
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello!", body)
+
+	resp, _ = request(http.MethodHead, mirror.URL+"/other/blob") //nolint:bodyclose
+	assert.Equal(t, "6", resp.Header.Get("Content-Length"))
+
+	validateQueries([]string{"miss", "hit", "hit"})
+}
+
+func TestClientOnlyAliasesContentMatchingAllTheStrongDigests(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{VerifyDigests: true})
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	sha1 := must(ParseHexDigest("sha1", "69342c5c39e5ae5f0077aecc32c0f81811fb8193"))
+	sha256 := must(ParseOCIDigest(
+		"sha256:334d016f755cd6dc58c53a86e183882f8ec14f52fb05345887c8a5edd42c87b7",
+	))
+	sha512 := must(ParseHexDigest(
+		"sha512",
+		"3a928aa2cc3bf291a4657d1b51e0e087dfb1dea060c89d20776b8943d24e712e"+
+			"a65778fe608ddaee0a191bc6680483ad12be1f357389a2380f660db246be5844",
+	))
+
+	for _, tc := range []struct {
+		path    string
+		digests []Digest
+	}{
+		{"/first", []Digest{sha256, sha1}},
+		// SHA-1 digests are never enough to find the content
+		{"/sha1", []Digest{sha1}},
+		// All the digests must have been verified for the content
+		{"/sha512", []Digest{sha256, sha512}},
+		{"/both", []Digest{sha512, sha256}},
+	} {
+		ctx := WithExpectedDigests(t.Context(), tc.digests...)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+tc.path, nil)
+		require.NoError(t, err)
+		req = req.WithContext(testutils.TestLogger(t, nil).WithContext(req.Context()))
+
+		resp, err := client.Do(req, UpstreamCache{})
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, "Hello!", string(body))
+	}
+
+	validateQueries([]string{"miss", "miss", "miss", "hit"})
+}
+
+func TestClientScopesDigestAliasesToPartitions(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client = client.WithOptions(Options{VerifyDigests: true, PartitionByAuthorization: true})
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "private, max-age=60")
+			_, err := w.Write([]byte("Hello!"))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	digest := must(ParseOCIDigest(
+		"sha256:334d016f755cd6dc58c53a86e183882f8ec14f52fb05345887c8a5edd42c87b7",
+	))
+
+	for _, tc := range []struct {
+		path          string
+		authorization string
+	}{
+		{"/alice", "alice"},
+		// Content stored with someone's credentials is not shared with others
+		{"/bob", "bob"},
+		{"/anonymous", ""},
+		{"/other", "alice"},
+	} {
+		ctx := WithExpectedDigests(t.Context(), digest)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+tc.path, nil)
+		require.NoError(t, err)
+		req = req.WithContext(testutils.TestLogger(t, nil).WithContext(req.Context()))
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+
+		resp, err := client.Do(req, UpstreamCache{})
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, "Hello!", string(body))
+	}
+
+	validateQueries([]string{"miss", "miss", "miss", "hit"})
+}
+
+func TestDigestsMatchTheirEcosystemFormats(t *testing.T) {
+	t.Parallel()
+
+	goMod := "module golang.org/x/mod\n\ngo 1.18\n\n" +
+		"require golang.org/x/tools v0.13.0 // tagx:ignore\n"
+
+	for _, tc := range []struct {
+		description string
+		parse       func() (Digest, error)
+	}{
+		{
+			"sri",
+			func() (Digest, error) {
+				return ParseSRI(
+					"sha512-OpKKosw78pGkZX0bUeDgh9+x3qBgyJ0gd2uJQ9JOcS6mV3j+" +
+						"YI3a7goZG8ZoBIOtEr4fNXOJojgPZg2yRr5YRA==",
+				)
+			},
+		},
+		{
+			"hex",
+			func() (Digest, error) {
+				return ParseHexDigest("sha1", "69342c5c39e5ae5f0077aecc32c0f81811fb8193")
+			},
+		},
+		{
+			"go.mod",
+			func() (Digest, error) {
+				return ParseGoSumHash("h1:hTbmBsO62+eylJbnUtE2MGJUyE7QWk4xUqPFrRgJ+7c=", true)
+			},
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			digest, err := tc.parse()
+			require.NoError(t, err)
+
+			content := "Hello!"
+			if digest.Algorithm == GoModHash {
+				content = goMod
+			}
+
+			verifier := newVerifier(digest, t.TempDir())
+			t.Cleanup(verifier.close)
+			_, err = verifier.Write([]byte(content))
+			require.NoError(t, err)
+			require.NoError(t, verifier.verify())
+
+			verifier = newVerifier(digest, t.TempDir())
+			t.Cleanup(verifier.close)
+			_, err = verifier.Write([]byte("Tampered"))
+			require.NoError(t, err)
+			require.ErrorIs(t, verifier.verify(), ErrDigestMismatch)
+		})
+	}
+}
+
+func TestClientServesFilesStoredCompressed(t *testing.T) {
+	t.Parallel()
+
+	client, clock, _, validateQueries := setup(t)
+	client.cache.compression = Compression{Enabled: true, MinSize: 100}
+
+	content := strings.Repeat("Hello, compressed world! ", 20)
+
+	srv := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Date", clock.Now().Format(http.TimeFormat))
+			w.Header().Add("Cache-Control", "public, max-age=60")
+			w.Header().Add("Content-Type", "text/plain")
+			w.Header().Add("Etag", `"hello"`)
+
+			if match := r.Header.Get("If-None-Match"); match != "" {
+				assert.NotContains(t, match, "-zstd")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			_, err := w.Write([]byte(content))
+			assert.NoError(t, err)
+		}),
+	)
+	t.Cleanup(srv.Close)
+
+	request := func(headers http.Header) (*http.Response, string) {
+		t.Helper()
+		return makeRequest(t, client, http.MethodGet, srv.URL, headers, nil)
+	}
+
+	_, body := request(http.Header{}) //nolint:bodyclose
+	assert.Equal(t, content, body)
+	// Files are compressed in the background
+	client.cache.cache.Wait()
+
+	resp, body := request(http.Header{}) //nolint:bodyclose
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"hello"`, resp.Header.Get("Etag"))
+	assert.Equal(t, content, body)
+
+	resp, body = request(http.Header{"Accept-Encoding": {"gzip, zstd"}}) //nolint:bodyclose
+	assert.Equal(t, "zstd", resp.Header.Get("Content-Encoding"))
+	assert.Contains(t, resp.Header.Values("Vary"), "Accept-Encoding")
+	// The stored bytes are a different representation than the content
+	assert.Equal(t, `"hello-zstd"`, resp.Header.Get("Etag"))
+	assert.Less(t, len(body), len(content))
+
+	decoder, err := zstd.NewReader(nil)
+	require.NoError(t, err)
+	defer decoder.Close()
+	decoded, err := decoder.DecodeAll([]byte(body), nil)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(decoded))
+
+	// HEAD requests describe what the GET request would get
+	head, body := makeRequest( //nolint:bodyclose
+		t,
+		client,
+		http.MethodHead,
+		srv.URL,
+		http.Header{"Accept-Encoding": {"gzip, zstd"}},
+		nil,
+	)
+	assert.Empty(t, body)
+	for _, header := range []string{"Content-Encoding", "Content-Length", "Etag", "Vary"} {
+		assert.Equal(t, resp.Header.Values(header), head.Header.Values(header), header)
+	}
+	assert.Equal(t, "zstd", head.Header.Get("Content-Encoding"))
+	assert.NotEmpty(t, head.Header.Get("Content-Length"))
+
+	resp, body = request( //nolint:bodyclose
+		http.Header{"Accept-Encoding": {"zstd"}, "Range": {"bytes=0-4"}},
+	)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, content, body)
+
+	// Revalidating uses the entity tag upstream knows of
+	resp, _ = request(http.Header{ //nolint:bodyclose
+		"Accept-Encoding": {"zstd"},
+		"Cache-Control":   {"no-cache"},
+		"If-None-Match":   {`"hello-zstd"`},
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"hello-zstd"`, resp.Header.Get("Etag"))
+
+	validateQueries([]string{"miss", "hit", "hit", "hit", "hit", "revalidated"})
 }
@@ -0,0 +1,151 @@
+package httpclient
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/benjaminschubert/locaccel/internal/filecache"
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// Compression selects the files stored compressed in the cache, to save space.
+// Files are only stored compressed if it makes them smaller.
+type Compression struct {
+	Enabled bool
+	// MinSize is the size from which files are compressed
+	MinSize int64
+	// ContentTypes are patterns matching the media types of the responses to
+	// compress, like `text/*` or `application/*+json`. All are if empty.
+	ContentTypes []string
+}
+
+// applies returns whether the content of the response should be stored
+// compressed, if it is large enough
+func (c Compression) applies(header http.Header) bool {
+	if !c.Enabled {
+		return false
+	}
+
+	// Encoded responses are already compressed
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.ContentTypes {
+		if matched, _ := path.Match(pattern, mediaType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// compressAtRest makes the ingestion store the response compressed, if the
+// compression applies to it
+func (c *Cache) compressAtRest(ingestion *filecache.Ingestion, header http.Header) {
+	if ingestion != nil && c.compression.applies(header) {
+		ingestion.CompressAbove(c.compression.MinSize)
+	}
+}
+
+// storedEncodingEtagSuffix distinguishes the entity tags of the files sent as
+// they are stored from the ones of their content, as they are different bytes
+const storedEncodingEtagSuffix = "-" + filecache.CompressedEncoding
+
+// storedEncodingEtag returns the entity tag of the file sent as it is stored
+func storedEncodingEtag(etag string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + storedEncodingEtagSuffix + `"`
+}
+
+// stripStoredEncodingEtags replaces the entity tags of files sent as they are
+// stored by the ones of their content in the conditional headers, so that they
+// match what upstream and the cache know of.
+func stripStoredEncodingEtags(header http.Header) {
+	values := header.Values("If-None-Match")
+	if len(values) == 0 {
+		return
+	}
+
+	stripped := make([]string, 0, len(values))
+	for _, value := range values {
+		stripped = append(stripped, strings.ReplaceAll(value, storedEncodingEtagSuffix+`"`, `"`))
+	}
+	// The values are shared with the original request, they can't be modified
+	header["If-None-Match"] = stripped
+}
+
+// acceptsStoredEncoding returns whether the files stored compressed can be
+// sent as they are to the client. Ranges are of the content itself, and can't
+// be served from them.
+func acceptsStoredEncoding(req *http.Request) bool {
+	return req.Header.Get("Range") == "" &&
+		httpcaching.AcceptsContentCoding(req.Header, filecache.CompressedEncoding)
+}
+
+// sendStoredEncoding replaces the body of a response served from a file stored
+// compressed by the file itself, encoded as it is stored, instead of
+// decompressing it.
+func sendStoredEncoding(resp *http.Response) *http.Response {
+	file, ok := resp.Body.(*filecache.CompressedFile)
+	if !ok || resp.Header.Get("Content-Encoding") != "" {
+		return resp
+	}
+
+	body, encoding := file.Encoded()
+	resp.Body = body
+	resp.Header.Set("Content-Encoding", encoding)
+	// The stored length is the one of the content
+	if stat, err := body.Stat(); err == nil {
+		resp.Header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	} else {
+		resp.Header.Del("Content-Length")
+	}
+	if etag := resp.Header.Get("Etag"); etag != "" {
+		resp.Header.Set("Etag", storedEncodingEtag(etag))
+	}
+
+	for _, value := range resp.Header.Values("Vary") {
+		for field := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return resp
+			}
+		}
+	}
+	resp.Header.Add("Vary", "Accept-Encoding")
+	return resp
+}
+
+// cachedContentLength returns the size of the content of a file served from the
+// cache, whether it is stored compressed or not
+func cachedContentLength(body io.ReadCloser, logger *zerolog.Logger) (int64, bool) {
+	switch file := body.(type) {
+	case *os.File:
+		if stat, err := file.Stat(); err == nil {
+			return stat.Size(), true
+		}
+	case *filecache.CompressedFile:
+		size, err := file.Size()
+		if err == nil {
+			return size, true
+		}
+		logger.Warn().Err(err).Msg("unable to read the size of the compressed file")
+	}
+	return 0, false
+}
@@ -0,0 +1,318 @@
+package httpclient
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultTokenLifetime is how long tokens not specifying it are valid
+	defaultTokenLifetime = 60 * time.Second
+	// tokenExpiryMargin avoids using tokens that would expire before upstream
+	// gets to check them
+	tokenExpiryMargin = 5 * time.Second
+)
+
+var (
+	errNoTokenReturned   = errors.New("no token returned")
+	errTokenNotGenerated = errors.New("unable to get a token")
+	errUntrustedRealm    = errors.New("untrusted token realm")
+)
+
+// CredentialsType is how credentials are presented to upstream
+type CredentialsType int
+
+const (
+	// BasicCredentials are sent as a username and password
+	BasicCredentials CredentialsType = iota
+	// BearerCredentials are sent as a static token
+	BearerCredentials
+	// OCITokenCredentials are exchanged for short-lived tokens, following the
+	// token authentication flow of OCI registries
+	OCITokenCredentials
+)
+
+// Credentials authenticate the requests sent to an upstream on behalf of the
+// clients, which don't need to know them.
+type Credentials struct {
+	kind CredentialsType
+	// host is the upstream the credentials are for. They are never sent anywhere else.
+	host     string
+	username string
+	// password is the token for bearer credentials
+	password string
+	// realmHosts are the hosts, other than the upstream's, from which tokens
+	// can be requested with the credentials
+	realmHosts []string
+	tokens     *tokenCache
+}
+
+func NewCredentials(
+	kind CredentialsType,
+	host, username, password string,
+	realmHosts []string,
+) *Credentials {
+	return &Credentials{
+		kind,
+		host,
+		username,
+		password,
+		realmHosts,
+		&tokenCache{tokens: map[string]token{}},
+	}
+}
+
+// String avoids leaking the credentials if they get printed
+func (c *Credentials) String() string {
+	return "credentials for " + c.host
+}
+
+// appliesTo returns whether the credentials need to be added to the request
+func (c *Credentials) appliesTo(req *http.Request) bool {
+	return c != nil &&
+		strings.EqualFold(req.URL.Host, c.host) &&
+		req.Header.Get("Authorization") == "" &&
+		// Requests through upstream caches acting as proxies would leak them
+		req.Context().Value(proxyCtx{}) == nil
+}
+
+// authorize adds the credentials to the request, when they are known
+func (c *Credentials) authorize(req *http.Request, now time.Time) {
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	switch c.kind {
+	case BasicCredentials:
+		req.SetBasicAuth(c.username, c.password)
+	case BearerCredentials:
+		req.Header.Set("Authorization", "Bearer "+c.password)
+	case OCITokenCredentials:
+		if token, ok := c.tokens.get(ociRepository(req.URL.Path), now); ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+}
+
+type token struct {
+	value     string
+	expiresAt time.Time
+}
+
+// tokenCache keeps the tokens obtained from the OCI token flow, per repository
+type tokenCache struct {
+	mutex  sync.Mutex
+	tokens map[string]token
+}
+
+func (t *tokenCache) get(repository string, now time.Time) (string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	token, ok := t.tokens[repository]
+	if !ok || !now.Before(token.expiresAt) {
+		delete(t.tokens, repository)
+		return "", false
+	}
+	return token.value, true
+}
+
+func (t *tokenCache) set(repository string, value token) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.tokens[repository] = value
+}
+
+// ociRepository returns the repository the path of the OCI API refers to, or an
+// empty string if it doesn't refer to any
+func ociRepository(path string) string {
+	_, name, ok := strings.Cut(path, "/v2/")
+	if !ok {
+		return ""
+	}
+
+	end := -1
+	for _, marker := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		end = max(end, strings.LastIndex(name, marker))
+	}
+	if end == -1 {
+		return ""
+	}
+	return name[:end]
+}
+
+// parseBearerChallenge returns the parameters of a Bearer challenge from a
+// WWW-Authenticate header, like `Bearer realm="...",service="...",scope="..."`
+//
+// See https://datatracker.ietf.org/doc/html/rfc6750#section-3
+func parseBearerChallenge(header string) (map[string]string, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, false
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end == -1 {
+				return nil, false
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+
+	return params, params["realm"] != ""
+}
+
+// trustsRealm returns an error if the credentials can't be sent to the realm
+// that the upstream at the given URL named. Anyone able to answer for upstream
+// could otherwise obtain them.
+func (c *Credentials) trustsRealm(upstream, realm *url.URL) error {
+	// Credentials sent in clear to upstream can be sent in clear to its realm
+	if realm.Scheme != "https" && (realm.Scheme != "http" || upstream.Scheme != "http") {
+		return fmt.Errorf("%w: %s is not using https", errUntrustedRealm, realm.Redacted())
+	}
+
+	if strings.EqualFold(realm.Hostname(), upstream.Hostname()) ||
+		slices.ContainsFunc(c.realmHosts, func(host string) bool {
+			return strings.EqualFold(realm.Hostname(), host)
+		}) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not an allowed host", errUntrustedRealm, realm.Hostname())
+}
+
+// fetchToken obtains a token from the realm of the challenge that the upstream
+// at the given URL sent, authenticating with the credentials
+func (c *Client) fetchToken(
+	ctx context.Context,
+	upstream *url.URL,
+	challenge map[string]string,
+	logger *zerolog.Logger,
+) (token, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil {
+		return token{}, err
+	}
+	if err := c.opts.Credentials.trustsRealm(upstream, realm); err != nil {
+		return token{}, err
+	}
+
+	query := realm.Query()
+	for _, param := range []string{"service", "scope"} {
+		if value := challenge[param]; value != "" {
+			query.Set(param, value)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return token{}, err
+	}
+	if c.opts.Credentials.username != "" {
+		req.SetBasicAuth(c.opts.Credentials.username, c.opts.Credentials.password)
+	}
+
+	logger.Debug().Str("realm", realm.Host).Msg("Requesting a token for upstream")
+
+	timeAtRequestCreated := c.now()
+	resp, err := c.client.Do(req) //nolint:gosec
+	if err != nil {
+		return token{}, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Debug().Err(err).Msg("Error closing the token response")
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return token{}, fmt.Errorf("%w: status %d", errTokenNotGenerated, resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return token{}, err
+	}
+
+	value := cmp.Or(body.Token, body.AccessToken)
+	if value == "" {
+		return token{}, errNoTokenReturned
+	}
+
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+
+	return token{value, timeAtRequestCreated.Add(lifetime - tokenExpiryMargin)}, nil
+}
+
+// send sends the request to upstream, adding the credentials if it is the
+// upstream they are for. Tokens are obtained when upstream asks for them.
+func (c *Client) send(req *http.Request, logger *zerolog.Logger) (*http.Response, error) {
+	credentials := c.opts.Credentials
+	if !credentials.appliesTo(req) {
+		return c.client.Do(req) //nolint:gosec
+	}
+
+	// The original request can be stored, with its headers, it must not be modified
+	authenticated := req.Clone(req.Context())
+	credentials.authorize(authenticated, c.now())
+
+	resp, err := c.client.Do(authenticated) //nolint:gosec
+	if err != nil ||
+		resp.StatusCode != http.StatusUnauthorized ||
+		credentials.kind != OCITokenCredentials ||
+		!isSafeMethod(req.Method) {
+		return resp, err
+	}
+
+	challenge, ok := parseBearerChallenge(resp.Header.Get("Www-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+
+	token, err := c.fetchToken(req.Context(), req.URL, challenge, logger)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Unable to get a token for upstream")
+		return resp, nil
+	}
+	credentials.tokens.set(ociRepository(req.URL.Path), token)
+	readAndCloseUpstreamBody(resp.Body, logger)
+
+	authenticated = req.Clone(req.Context())
+	credentials.authorize(authenticated, c.now())
+	return c.client.Do(authenticated) //nolint:gosec
+}
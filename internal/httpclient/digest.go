@@ -0,0 +1,472 @@
+package httpclient
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrDigestMismatch = errors.New("the content does not match the expected digest")
+	ErrInvalidDigest  = errors.New("invalid digest")
+)
+
+// DigestAlgorithm is how a digest is computed from the content
+type DigestAlgorithm int
+
+const (
+	SHA1 DigestAlgorithm = iota
+	SHA256
+	SHA512
+	// GoModuleHash is the h1 hash of the files of a Go module zip, as found in
+	// go.sum files
+	GoModuleHash
+	// GoModHash is the h1 hash of a go.mod file, as found in go.sum files
+	GoModHash
+)
+
+func (a DigestAlgorithm) String() string {
+	switch a {
+	case SHA1:
+		return "sha1"
+	case SHA256:
+		return "sha256"
+	case SHA512:
+		return "sha512"
+	case GoModuleHash, GoModHash:
+		return "h1"
+	default:
+		return "unknown"
+	}
+}
+
+// Digest is what an ecosystem promises the content of a file hashes to
+type Digest struct {
+	Algorithm DigestAlgorithm
+	Sum       []byte
+}
+
+func (d Digest) String() string {
+	switch d.Algorithm {
+	case SHA1, SHA256, SHA512:
+		return d.Algorithm.String() + ":" + hex.EncodeToString(d.Sum)
+	case GoModuleHash, GoModHash:
+		return "h1:" + base64.StdEncoding.EncodeToString(d.Sum)
+	default:
+		return "unknown"
+	}
+}
+
+func parseAlgorithm(name string) (DigestAlgorithm, bool) {
+	switch name {
+	case "sha1":
+		return SHA1, true
+	case "sha256":
+		return SHA256, true
+	case "sha512":
+		return SHA512, true
+	default:
+		return 0, false
+	}
+}
+
+func newDigest(algorithm DigestAlgorithm, sum []byte) (Digest, error) {
+	var size int
+	switch algorithm {
+	case SHA1:
+		size = sha1.Size
+	case SHA256, GoModuleHash, GoModHash:
+		size = sha256.Size
+	case SHA512:
+		size = sha512.Size
+	}
+
+	if len(sum) != size {
+		return Digest{}, fmt.Errorf("%w: %s sum of %d bytes", ErrInvalidDigest, algorithm, len(sum))
+	}
+	return Digest{algorithm, sum}, nil
+}
+
+// ParseHexDigest parses a digest given as the name of its algorithm and its hex
+// encoded sum, like PyPI and npm shasums provide them
+func ParseHexDigest(algorithm, value string) (Digest, error) {
+	alg, ok := parseAlgorithm(algorithm)
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidDigest, algorithm)
+	}
+
+	sum, err := hex.DecodeString(value)
+	if err != nil {
+		return Digest{}, fmt.Errorf("%w: %w", ErrInvalidDigest, err)
+	}
+	return newDigest(alg, sum)
+}
+
+// ParseOCIDigest parses a digest like OCI registries use, like `sha256:<hex>`
+func ParseOCIDigest(value string) (Digest, error) {
+	algorithm, sum, ok := strings.Cut(value, ":")
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: %s", ErrInvalidDigest, value)
+	}
+	return ParseHexDigest(algorithm, sum)
+}
+
+// ParseSRI parses a subresource integrity digest, like `sha512-<base64>`, as
+// found in npm packuments
+//
+// See https://www.w3.org/TR/SRI/#the-integrity-attribute
+func ParseSRI(value string) (Digest, error) {
+	algorithm, encoded, ok := strings.Cut(value, "-")
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: %s", ErrInvalidDigest, value)
+	}
+
+	alg, ok := parseAlgorithm(algorithm)
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidDigest, algorithm)
+	}
+
+	// Options can follow the hash, separated by `?`
+	encoded, _, _ = strings.Cut(encoded, "?")
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Digest{}, fmt.Errorf("%w: %w", ErrInvalidDigest, err)
+	}
+	return newDigest(alg, sum)
+}
+
+// ParseGoSumHash parses a hash from a go.sum file, like `h1:<base64>`, for
+// either a go.mod file or a module zip
+func ParseGoSumHash(value string, isGoMod bool) (Digest, error) {
+	encoded, ok := strings.CutPrefix(value, "h1:")
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: unsupported hash %s", ErrInvalidDigest, value)
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Digest{}, fmt.Errorf("%w: %w", ErrInvalidDigest, err)
+	}
+
+	if isGoMod {
+		return newDigest(GoModHash, sum)
+	}
+	return newDigest(GoModuleHash, sum)
+}
+
+type expectedDigestsCtx struct{}
+
+// WithExpectedDigests returns a context for requests whose response must match
+// the digests. When verifying digests, responses not matching them are never
+// stored, and fail instead of completing.
+func WithExpectedDigests(ctx context.Context, digests ...Digest) context.Context {
+	if len(digests) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, expectedDigestsCtx{}, digests)
+}
+
+// digestsLookup finds the digests a response must match only once they are
+// needed, which is when the response is not in the cache
+type digestsLookup struct {
+	once    sync.Once
+	lookup  func() []Digest
+	digests []Digest
+}
+
+func (l *digestsLookup) get() []Digest {
+	l.once.Do(func() { l.digests = l.lookup() })
+	return l.digests
+}
+
+// WithExpectedDigestsLookup works like WithExpectedDigests, but only looks the
+// digests up when the response is not served from the cache, as finding them
+// can be expensive. The lookup runs at most once.
+func WithExpectedDigestsLookup(ctx context.Context, lookup func() []Digest) context.Context {
+	return context.WithValue(ctx, expectedDigestsCtx{}, &digestsLookup{lookup: lookup})
+}
+
+// VerifiesDigests returns whether the responses are checked against the digests
+// they are expected to match. Finding them can thus be skipped if they are not.
+func (c *Client) VerifiesDigests() bool {
+	return c.opts.VerifyDigests
+}
+
+// verifier checks that the content written to it matches a digest
+type verifier interface {
+	io.Writer
+	verify() error
+	close()
+}
+
+// newVerifier returns a verifier for the digest, spooling what it needs to in
+// the given directory
+func newVerifier(digest Digest, tmpdir string) verifier {
+	switch digest.Algorithm {
+	case SHA1:
+		return &hashVerifier{sha1.New(), digest} //nolint:gosec
+	case SHA256:
+		return &hashVerifier{sha256.New(), digest}
+	case SHA512:
+		return &hashVerifier{sha512.New(), digest}
+	case GoModHash:
+		return &goModVerifier{hashVerifier{sha256.New(), digest}}
+	case GoModuleHash:
+		return &goModuleVerifier{digest: digest, tmpdir: tmpdir}
+	default:
+		return nil
+	}
+}
+
+func mismatch(expected Digest, actual []byte) error {
+	return fmt.Errorf(
+		"%w: expected %s, got %s",
+		ErrDigestMismatch,
+		expected,
+		Digest{expected.Algorithm, actual},
+	)
+}
+
+type hashVerifier struct {
+	hash.Hash
+
+	digest Digest
+}
+
+func (v *hashVerifier) verify() error {
+	if sum := v.Sum(nil); !bytes.Equal(sum, v.digest.Sum) {
+		return mismatch(v.digest, sum)
+	}
+	return nil
+}
+
+func (v *hashVerifier) close() {}
+
+// goHash1 computes the h1 hash of files from their sha256 sums, like the go
+// command does for go.sum
+//
+// See https://pkg.go.dev/golang.org/x/mod/sumdb/dirhash#Hash1
+func goHash1(sums map[string][]byte) ([]byte, error) {
+	summary := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(sums)) {
+		if strings.Contains(name, "\n") {
+			return nil, fmt.Errorf("%w: file name contains a newline", ErrInvalidDigest)
+		}
+		fmt.Fprintf(summary, "%x  %s\n", sums[name], name)
+	}
+	return summary.Sum(nil), nil
+}
+
+type goModVerifier struct {
+	hashVerifier
+}
+
+func (v *goModVerifier) verify() error {
+	sum, err := goHash1(map[string][]byte{"go.mod": v.Sum(nil)})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, v.digest.Sum) {
+		return mismatch(v.digest, sum)
+	}
+	return nil
+}
+
+// goModuleVerifier spools the module zip to a temporary file, as its files can
+// only be read once it is complete
+type goModuleVerifier struct {
+	digest Digest
+	tmpdir string
+	file   *os.File
+	err    error
+}
+
+func (v *goModuleVerifier) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return len(p), nil
+	}
+
+	if v.file == nil {
+		v.file, v.err = os.CreateTemp(v.tmpdir, "verify-*.zip")
+		if v.err != nil {
+			return len(p), nil
+		}
+	}
+
+	if _, err := v.file.Write(p); err != nil {
+		v.err = err
+	}
+	return len(p), nil
+}
+
+func (v *goModuleVerifier) verify() error {
+	if v.err != nil {
+		return fmt.Errorf("unable to verify the module: %w", v.err)
+	}
+	if v.file == nil {
+		return mismatch(v.digest, nil)
+	}
+
+	info, err := v.file.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to verify the module: %w", err)
+	}
+	archive, err := zip.NewReader(v.file, info.Size())
+	if err != nil {
+		return fmt.Errorf("%w: invalid module zip: %w", ErrDigestMismatch, err)
+	}
+
+	sums := make(map[string][]byte, len(archive.File))
+	for _, file := range archive.File {
+		if err := func() error {
+			content, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer content.Close() //nolint:errcheck
+
+			h := sha256.New()
+			if _, err := io.Copy(h, content); err != nil {
+				return err
+			}
+			sums[file.Name] = h.Sum(nil)
+			return nil
+		}(); err != nil {
+			return fmt.Errorf("%w: invalid module zip: %w", ErrDigestMismatch, err)
+		}
+	}
+
+	sum, err := goHash1(sums)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, v.digest.Sum) {
+		return mismatch(v.digest, sum)
+	}
+	return nil
+}
+
+func (v *goModuleVerifier) close() {
+	if v.file == nil {
+		return
+	}
+	_ = v.file.Close()
+	_ = os.Remove(v.file.Name())
+	v.file = nil
+}
+
+// verifyingBody checks that the body matches the digests once fully read, and
+// fails instead of completing if it doesn't. It is read before being ingested,
+// which thus gets aborted. The last byte read is held back until the body is
+// verified, so that a response failing verification is never complete.
+type verifyingBody struct {
+	io.ReadCloser
+
+	verifiers []verifier
+	logger    *zerolog.Logger
+	// err is returned once upstream is fully read, nil or io.EOF if verified
+	err     error
+	held    byte
+	hasHeld bool
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		if b.hasHeld && len(p) > 0 && errors.Is(b.err, io.EOF) {
+			p[0] = b.held
+			b.hasHeld = false
+			return 1, b.err
+		}
+		return 0, b.err
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	for _, v := range b.verifiers {
+		// Verifiers record their own errors, and report them when verifying
+		_, _ = v.Write(p[:n])
+	}
+
+	if n > 0 {
+		last := p[n-1]
+		if b.hasHeld {
+			copy(p[1:n], p[:n-1])
+			p[0] = b.held
+		} else {
+			n--
+		}
+		b.held, b.hasHeld = last, true
+	}
+
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+
+	b.err = err
+	for _, v := range b.verifiers {
+		if vErr := v.verify(); vErr != nil {
+			b.logger.Error().Err(vErr).Msg("Response from upstream failed verification")
+			b.err = vErr
+			return n, vErr
+		}
+	}
+	b.logger.Debug().Msg("response from upstream matches the expected digests")
+	// The byte held back is returned by the next read
+	return n, nil
+}
+
+func (b *verifyingBody) Close() error {
+	for _, v := range b.verifiers {
+		v.close()
+	}
+	return b.ReadCloser.Close()
+}
+
+// verifyDigests makes the body of the response fail if it doesn't match the
+// digests expected for the request, and returns the digests it is verified
+// against, if any
+func (c *Client) verifyDigests(
+	req *http.Request,
+	resp *http.Response,
+	logger *zerolog.Logger,
+) []Digest {
+	if !c.opts.VerifyDigests || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	digests := expectedDigests(req)
+	if len(digests) == 0 {
+		return nil
+	}
+
+	// Digests are computed on the content itself
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		logger.Debug().Str("encoding", encoding).Msg("not verifying encoded response")
+		return nil
+	}
+
+	verifiers := make([]verifier, 0, len(digests))
+	for _, digest := range digests {
+		if v := newVerifier(digest, c.cache.cache.TempDir()); v != nil {
+			verifiers = append(verifiers, v)
+		}
+	}
+	resp.Body = &verifyingBody{ReadCloser: resp.Body, verifiers: verifiers, logger: logger}
+	return digests
+}
@@ -0,0 +1,335 @@
+package httpclient
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// failureThreshold is the number of consecutive failures after which an
+	// upstream cache is not tried anymore
+	failureThreshold = 5
+	// errorRateThreshold is the error rate after which an upstream cache is not
+	// tried anymore, once it has seen enough requests for the rate to be relevant
+	errorRateThreshold = 0.5
+	// errorRateMinRequests is the number of requests needed before taking the
+	// error rate into account
+	errorRateMinRequests = 20
+	// healthSmoothing is the weight given to the latest request when computing
+	// the error rate and latency, as exponentially weighted moving averages
+	healthSmoothing = 0.1
+	// circuitCooldown is how long an upstream cache is skipped before probing
+	// it again
+	circuitCooldown = 30 * time.Second
+)
+
+// CircuitState represents whether requests are sent to an upstream cache
+type CircuitState int
+
+const (
+	// CircuitClosed upstreams are healthy and receive all requests
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen upstreams receive a single request, probing whether they
+	// are healthy again
+	CircuitHalfOpen
+	// CircuitOpen upstreams are unhealthy and are skipped
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// UpstreamHealth is a snapshot of the health of an upstream cache
+type UpstreamHealth struct {
+	Upstream            string
+	State               CircuitState
+	Requests            uint64
+	Failures            uint64
+	ConsecutiveFailures uint64
+	ErrorRate           float64
+	Latency             time.Duration
+}
+
+type upstreamHealth struct {
+	UpstreamHealth
+
+	openedAt      time.Time
+	probeInFlight bool
+}
+
+// healthTracker keeps track of the health of the upstream caches, to avoid
+// waiting on the ones that are known to be unhealthy.
+//
+// It implements a circuit breaker: after too many failures, an upstream is
+// skipped for a while, after which a single request probes whether it is
+// healthy again.
+type healthTracker struct {
+	mutex     sync.Mutex
+	upstreams map[string]*upstreamHealth
+	now       func() time.Time
+}
+
+func newHealthTracker(now func() time.Time) *healthTracker {
+	return &healthTracker{upstreams: map[string]*upstreamHealth{}, now: now}
+}
+
+func (h *healthTracker) get(upstream string) *upstreamHealth {
+	health, ok := h.upstreams[upstream]
+	if !ok {
+		health = &upstreamHealth{UpstreamHealth: UpstreamHealth{Upstream: upstream}}
+		h.upstreams[upstream] = health
+	}
+	return health
+}
+
+// allow returns whether a request can be sent to the upstream
+func (h *healthTracker) allow(upstream string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	health := h.get(upstream)
+
+	switch health.State {
+	case CircuitOpen:
+		if h.now().Sub(health.openedAt) < circuitCooldown {
+			return false
+		}
+		health.State = CircuitHalfOpen
+		health.probeInFlight = true
+		return true
+	case CircuitHalfOpen:
+		if health.probeInFlight {
+			return false
+		}
+		health.probeInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// available returns whether requests could be sent to the upstream, without
+// counting as a probe
+func (h *healthTracker) available(upstream string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	health, ok := h.upstreams[upstream]
+	if !ok {
+		return true
+	}
+
+	switch health.State {
+	case CircuitOpen:
+		return h.now().Sub(health.openedAt) >= circuitCooldown
+	case CircuitHalfOpen:
+		return !health.probeInFlight
+	default:
+		return true
+	}
+}
+
+// release gives up on a request for which the health of the upstream is unknown,
+// for example because the client went away
+func (h *healthTracker) release(upstream string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.get(upstream).probeInFlight = false
+}
+
+// record updates the health of the upstream with the outcome of a request
+func (h *healthTracker) record(upstream string, success bool, latency time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	health := h.get(upstream)
+	health.probeInFlight = false
+	health.Requests++
+
+	failure := 0.0
+	if success {
+		health.ConsecutiveFailures = 0
+	} else {
+		failure = 1
+		health.Failures++
+		health.ConsecutiveFailures++
+	}
+
+	if health.Requests == 1 {
+		health.ErrorRate = failure
+	} else {
+		health.ErrorRate += healthSmoothing * (failure - health.ErrorRate)
+	}
+
+	// Failures can be fast, but don't tell how fast the upstream is
+	if success && health.Requests-health.Failures == 1 {
+		health.Latency = latency
+	} else if success {
+		health.Latency += time.Duration(healthSmoothing * float64(latency-health.Latency))
+	}
+
+	switch {
+	case health.State == CircuitHalfOpen && success:
+		health.State = CircuitClosed
+		// Start afresh, the previous errors are not relevant anymore
+		health.ErrorRate = 0
+	case health.State == CircuitHalfOpen,
+		health.ConsecutiveFailures >= failureThreshold,
+		health.Requests >= errorRateMinRequests && health.ErrorRate >= errorRateThreshold:
+		health.State = CircuitOpen
+		health.openedAt = h.now()
+	}
+}
+
+// orderByLatency returns the upstreams sorted from the fastest to the slowest.
+// Upstreams never contacted come first, in order to learn their latency.
+func (h *healthTracker) orderByLatency(upstreams []*url.URL) []*url.URL {
+	h.mutex.Lock()
+	latencies := make(map[*url.URL]time.Duration, len(upstreams))
+	for _, upstream := range upstreams {
+		if health, ok := h.upstreams[upstream.String()]; ok {
+			latencies[upstream] = health.Latency
+		}
+	}
+	h.mutex.Unlock()
+
+	ordered := slices.Clone(upstreams)
+	slices.SortStableFunc(ordered, func(a, b *url.URL) int {
+		return cmp.Compare(latencies[a], latencies[b])
+	})
+	return ordered
+}
+
+func (h *healthTracker) snapshot() []UpstreamHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	result := make([]UpstreamHealth, 0, len(h.upstreams))
+	for _, health := range h.upstreams {
+		result = append(result, health.UpstreamHealth)
+	}
+	slices.SortFunc(result, func(a, b UpstreamHealth) int {
+		return strings.Compare(a.Upstream, b.Upstream)
+	})
+
+	return result
+}
+
+// isUpstreamFailure returns whether the response from an upstream cache shows
+// it is unable to serve requests, and the next one should be tried instead
+func isUpstreamFailure(resp *http.Response) bool {
+	return resp.StatusCode >= http.StatusInternalServerError ||
+		resp.StatusCode == http.StatusTooManyRequests
+}
+
+var (
+	upstreamStateDesc = prometheus.NewDesc(
+		"upstream_cache_circuit_state",
+		"State of the circuit breaker for the upstream cache (0: closed, 1: half-open, 2: open).",
+		[]string{"upstream"},
+		nil,
+	)
+	upstreamRequestsDesc = prometheus.NewDesc(
+		"upstream_cache_requests_total",
+		"Tracks the number of requests sent to the upstream cache.",
+		[]string{"upstream"},
+		nil,
+	)
+	upstreamFailuresDesc = prometheus.NewDesc(
+		"upstream_cache_failures_total",
+		"Tracks the number of requests to the upstream cache that failed.",
+		[]string{"upstream"},
+		nil,
+	)
+	upstreamConsecutiveFailuresDesc = prometheus.NewDesc(
+		"upstream_cache_consecutive_failures",
+		"Number of requests to the upstream cache that failed since the last success.",
+		[]string{"upstream"},
+		nil,
+	)
+	upstreamErrorRateDesc = prometheus.NewDesc(
+		"upstream_cache_error_rate",
+		"Moving average of the rate of failed requests to the upstream cache.",
+		[]string{"upstream"},
+		nil,
+	)
+	upstreamLatencyDesc = prometheus.NewDesc(
+		"upstream_cache_latency_seconds",
+		"Moving average of the time the upstream cache takes to return headers.",
+		[]string{"upstream"},
+		nil,
+	)
+)
+
+func (h *healthTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamStateDesc
+	ch <- upstreamRequestsDesc
+	ch <- upstreamFailuresDesc
+	ch <- upstreamConsecutiveFailuresDesc
+	ch <- upstreamErrorRateDesc
+	ch <- upstreamLatencyDesc
+}
+
+func (h *healthTracker) Collect(ch chan<- prometheus.Metric) {
+	for _, health := range h.snapshot() {
+		ch <- prometheus.MustNewConstMetric(
+			upstreamStateDesc, prometheus.GaugeValue, float64(health.State), health.Upstream,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			upstreamRequestsDesc,
+			prometheus.CounterValue,
+			float64(health.Requests),
+			health.Upstream,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			upstreamFailuresDesc,
+			prometheus.CounterValue,
+			float64(health.Failures),
+			health.Upstream,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			upstreamConsecutiveFailuresDesc,
+			prometheus.GaugeValue,
+			float64(health.ConsecutiveFailures),
+			health.Upstream,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			upstreamErrorRateDesc, prometheus.GaugeValue, health.ErrorRate, health.Upstream,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			upstreamLatencyDesc,
+			prometheus.GaugeValue,
+			health.Latency.Seconds(),
+			health.Upstream,
+		)
+	}
+}
+
+// UpstreamHealth returns the health of all the upstream caches contacted so far
+func (c *Client) UpstreamHealth() []UpstreamHealth {
+	return c.health.snapshot()
+}
+
+// UpstreamHealthCollector returns a collector exposing the health of the
+// upstream caches as prometheus metrics
+func (c *Client) UpstreamHealthCollector() prometheus.Collector {
+	return c.health
+}
@@ -0,0 +1,200 @@
+package httpclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// cancelOnCloseBody releases the context of a request once its response has
+// been consumed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// forwardRequestHedged sends the request to the upstream caches, one after the
+// other, without waiting for more than the hedging delay for each of them to
+// return headers. The upstream itself is contacted last.
+//
+// The first usable response is returned, and all the other requests are cancelled.
+// Failures from the upstream itself, like 5xx, are only returned if no upstream
+// cache answers either.
+func (c *Client) forwardRequestHedged(
+	req *http.Request,
+	upstreams []*url.URL,
+	buildUpstreamRequest func(r *http.Request, upstream *url.URL) *http.Request,
+	logger *zerolog.Logger,
+) upstreamAttempt {
+	type result struct {
+		upstreamAttempt
+
+		index    int
+		isOrigin bool
+	}
+
+	results := make(chan result, len(upstreams)+1)
+	cancels := make([]context.CancelFunc, 0, len(upstreams)+1)
+	next := 0
+	pending := 0
+
+	// startNext sends the request to the next healthy upstream cache, or
+	// upstream, returning false once they have all been contacted
+	startNext := func() bool {
+		for ; next < len(upstreams); next++ {
+			upstream := upstreams[next]
+			if !c.health.allow(upstream.String()) {
+				logger.Debug().Stringer("upstream", upstream).Msg("Skipping unhealthy upstream")
+				continue
+			}
+			next++
+
+			ctx, cancel := context.WithCancel(req.Context())
+			upstreamReq := buildUpstreamRequest(req.WithContext(ctx), upstream)
+			index := len(cancels)
+			cancels = append(cancels, cancel)
+			pending++
+
+			go func() {
+				attempt := c.forwardRequestToUpstreamCache(upstreamReq, upstream, logger)
+				results <- result{attempt, index, false}
+			}()
+			return true
+		}
+
+		if next > len(upstreams) {
+			return false
+		}
+		next++
+
+		ctx, cancel := context.WithCancel(req.Context())
+		upstreamReq := req.Clone(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		pending++
+
+		go func() {
+			resp, timeAtRequestCreated, timeAtResponseReceived, err := c.forwardRequestWithRetries(
+				upstreamReq,
+				logger,
+			)
+			results <- result{
+				upstreamAttempt{
+					resp,
+					timeAtRequestCreated,
+					timeAtResponseReceived,
+					err,
+					err == nil && !isUpstreamFailure(resp),
+				},
+				index,
+				true,
+			}
+		}()
+		return true
+	}
+
+	// cleanup cancels all the requests but the one given, and closes their
+	// responses once they come back
+	cleanup := func(keep int) {
+		for index, cancel := range cancels {
+			if index != keep {
+				cancel()
+			}
+		}
+
+		remaining := pending
+		c.background.Add(1)
+		go func() {
+			defer c.background.Done()
+
+			for range remaining {
+				res := <-results
+				if res.resp != nil {
+					if err := res.resp.Body.Close(); err != nil {
+						logger.Debug().Err(err).Msg("Error closing a cancelled upstream response")
+					}
+				}
+			}
+		}()
+	}
+
+	startNext()
+
+	timer := time.NewTimer(c.opts.HedgingDelay)
+	defer timer.Stop()
+
+	var final upstreamAttempt
+	finalIndex := -1
+
+	// discardFinal closes the failed response from the upstream itself, once
+	// it is not needed anymore
+	discardFinal := func() {
+		if final.resp != nil {
+			if err := final.resp.Body.Close(); err != nil {
+				logger.Debug().Err(err).Msg("Error closing a failed upstream response")
+			}
+		}
+	}
+
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if startNext() {
+				logger.Debug().Msg("No response received in time, trying the next upstream")
+				timer.Reset(c.opts.HedgingDelay)
+			}
+		case res := <-results:
+			pending--
+
+			if res.usable {
+				discardFinal()
+				cleanup(res.index)
+				res.resp.Body = cancelOnCloseBody{res.resp.Body, cancels[res.index]}
+				return res.upstreamAttempt
+			}
+
+			// Only the answer from the upstream itself is relevant when all fail,
+			// it is kept until the upstream caches answer
+			if res.isOrigin {
+				final = res.upstreamAttempt
+				finalIndex = res.index
+			} else {
+				cancels[res.index]()
+			}
+
+			if err := req.Context().Err(); err != nil {
+				if !res.isOrigin {
+					discardFinal()
+				}
+				cleanup(-1)
+				return upstreamAttempt{
+					res.resp,
+					res.timeAtRequestCreated,
+					res.timeAtResponseReceived,
+					err,
+					false,
+				}
+			}
+
+			if startNext() {
+				timer.Reset(c.opts.HedgingDelay)
+			}
+		}
+	}
+
+	if final.resp != nil {
+		final.resp.Body = cancelOnCloseBody{final.resp.Body, cancels[finalIndex]}
+	} else if finalIndex != -1 {
+		cancels[finalIndex]()
+	}
+	return final
+}
@@ -0,0 +1,85 @@
+package httpclient
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/benjaminschubert/locaccel/internal/filecache"
+)
+
+// inflightRequest represents a request that is currently being fetched from
+// upstream, and that other requests for the same key can wait on instead of
+// contacting upstream themselves.
+type inflightRequest struct {
+	// ready is closed once the leader knows whether its response can be shared
+	ready     chan struct{}
+	readyOnce sync.Once
+	// done is closed once the leader is done, and the response is in the cache
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// Only valid once ready is closed
+	statusCode  int
+	headers     http.Header
+	varyHeaders http.Header
+	ingestion   *filecache.Ingestion
+}
+
+// share allows waiters to stream the response while it is being ingested
+func (r *inflightRequest) share(
+	resp *http.Response,
+	varyHeaders http.Header,
+	ingestion *filecache.Ingestion,
+) {
+	r.readyOnce.Do(func() {
+		r.statusCode = resp.StatusCode
+		r.headers = resp.Header.Clone()
+		r.varyHeaders = varyHeaders
+		r.ingestion = ingestion
+		close(r.ready)
+	})
+}
+
+type inflightRequests struct {
+	lock     sync.Mutex
+	requests map[string]*inflightRequest
+}
+
+func newInflightRequests() *inflightRequests {
+	return &inflightRequests{requests: make(map[string]*inflightRequest)}
+}
+
+// join registers the caller as interested in the given key.
+//
+// The first caller for a key becomes the leader, and is responsible for
+// calling release once the response has been stored in the cache, or once it
+// knows it won't be. Other callers can wait on the returned request's ready
+// and done channels.
+func (i *inflightRequests) join(key []byte) (req *inflightRequest, isLeader bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if req, ok := i.requests[string(key)]; ok {
+		return req, false
+	}
+
+	req = &inflightRequest{ready: make(chan struct{}), done: make(chan struct{})}
+	i.requests[string(key)] = req
+	return req, true
+}
+
+// release marks the request as done, waking up all the waiters. It is safe to
+// call it multiple times.
+func (i *inflightRequests) release(key []byte, req *inflightRequest) {
+	req.doneOnce.Do(func() {
+		i.lock.Lock()
+		if i.requests[string(key)] == req {
+			delete(i.requests, string(key))
+		}
+		i.lock.Unlock()
+
+		// Ensure waiters don't wait for a response that will never be shared
+		req.readyOnce.Do(func() { close(req.ready) })
+		close(req.done)
+	})
+}
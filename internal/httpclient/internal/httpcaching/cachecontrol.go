@@ -1,4 +1,5 @@
-// Implements the parsing for RFC 9111 section 5.2.2 'Response directives' in addition to RFC 8246 and 5861
+// Implements the parsing for RFC 9111 section 5.2.1 'Request directives' and
+// section 5.2.2 'Response directives' in addition to RFC 8246 and 5861
 //
 //		See https://datatracker.ietf.org/doc/html/rfc9111
 //		See https://datatracker.ietf.org/doc/html/rfc8246
@@ -9,6 +10,7 @@ package httpcaching
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -144,3 +146,110 @@ func ParseCacheControlDirective(
 
 	return response, nil
 }
+
+type CacheControlRequestDirective struct {
+	// MaxAge is nil when the client did not specify any
+	MaxAge *time.Duration
+	// MaxStale is set to the maximum duration when the client accepts a stale
+	// response of any age
+	MaxStale     time.Duration
+	MinFresh     time.Duration
+	NoCache      bool
+	NoStore      bool
+	NoTransform  bool
+	OnlyIfCached bool
+}
+
+// Accepts returns whether the client accepts a response with the given age
+// and staleness, as returned by GetStaleness
+func (d CacheControlRequestDirective) Accepts(age, staleness time.Duration) bool {
+	if d.MaxAge != nil && age > *d.MaxAge {
+		return false
+	}
+	if d.MinFresh != 0 && -staleness < d.MinFresh {
+		return false
+	}
+	return staleness < 0 || (d.MaxStale != 0 && staleness <= d.MaxStale)
+}
+
+func parseSeconds(directive, val string) (time.Duration, error) {
+	v, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("%w for directive '%s': %s", ErrInvalidArgument, directive, err)
+	}
+	return time.Duration(v) * time.Second, nil
+}
+
+func ParseCacheControlRequestDirective(
+	cacheControlHeader []string,
+	pragmaHeader []string,
+	logger *zerolog.Logger,
+) (CacheControlRequestDirective, error) {
+	request := CacheControlRequestDirective{}
+
+	// Pragma is only considered when Cache-Control is absent
+	// See https://datatracker.ietf.org/doc/html/rfc7234#section-5.4
+	if len(cacheControlHeader) == 0 {
+		for _, hdr := range pragmaHeader {
+			for directive := range strings.SplitSeq(hdr, ",") {
+				if strings.TrimSpace(directive) == "no-cache" {
+					request.NoCache = true
+				}
+			}
+		}
+		return request, nil
+	}
+
+	seen := make(map[string]struct{}, 0)
+
+	for _, hdr := range cacheControlHeader {
+		for directive := range strings.SplitSeq(hdr, ",") {
+			key, val, found := strings.Cut(strings.TrimSpace(directive), "=")
+			if _, ok := seen[key]; ok {
+				continue // Duplicate entry, only the first value is valid
+			}
+			seen[key] = struct{}{}
+
+			var err error
+
+			switch key {
+			case "max-age":
+				if !found {
+					return request, fmt.Errorf("%w for directive 'max-age'", ErrMissingArgument)
+				}
+				var maxAge time.Duration
+				maxAge, err = parseSeconds(key, val)
+				request.MaxAge = &maxAge
+			case "max-stale":
+				// Without a value, the client accepts any stale response
+				request.MaxStale = math.MaxInt64
+				if found {
+					request.MaxStale, err = parseSeconds(key, val)
+				}
+			case "min-fresh":
+				if !found {
+					return request, fmt.Errorf("%w for directive 'min-fresh'", ErrMissingArgument)
+				}
+				request.MinFresh, err = parseSeconds(key, val)
+			case "no-cache":
+				request.NoCache = true
+			case "no-store":
+				request.NoStore = true
+			case "no-transform":
+				request.NoTransform = true
+			case "only-if-cached":
+				request.OnlyIfCached = true
+			default:
+				logger.Warn().
+					Str("directive", directive).
+					Msg("received an unknown directive in Cache-Control request header")
+			}
+
+			if err != nil {
+				return request, err
+			}
+		}
+	}
+
+	return request, nil
+}
@@ -1,6 +1,7 @@
 package httpcaching_test
 
 import (
+	"math"
 	"strings"
 	"testing"
 	"time"
@@ -130,3 +131,97 @@ func TestCanComposeMultipleHeaders(t *testing.T) {
 		result,
 	)
 }
+
+func TestCanParseValidRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	zero := time.Duration(0)
+	maxAge := 123 * time.Second
+
+	for _, tc := range []struct {
+		description  string
+		cacheControl []string
+		pragma       []string
+		expected     httpcaching.CacheControlRequestDirective
+	}{
+		{"max-age", []string{"max-age=123"}, nil, httpcaching.CacheControlRequestDirective{MaxAge: &maxAge}},
+		{"max-age-zero", []string{"max-age=0"}, nil, httpcaching.CacheControlRequestDirective{MaxAge: &zero}},
+		{"max-stale", []string{"max-stale=10"}, nil, httpcaching.CacheControlRequestDirective{MaxStale: 10 * time.Second}},
+		{"max-stale-unbounded", []string{"max-stale"}, nil, httpcaching.CacheControlRequestDirective{MaxStale: math.MaxInt64}},
+		{"min-fresh", []string{"min-fresh=10"}, nil, httpcaching.CacheControlRequestDirective{MinFresh: 10 * time.Second}},
+		{"no-cache", []string{"no-cache"}, nil, httpcaching.CacheControlRequestDirective{NoCache: true}},
+		{"no-store", []string{"no-store"}, nil, httpcaching.CacheControlRequestDirective{NoStore: true}},
+		{"no-transform", []string{"no-transform"}, nil, httpcaching.CacheControlRequestDirective{NoTransform: true}},
+		{"only-if-cached", []string{"only-if-cached"}, nil, httpcaching.CacheControlRequestDirective{OnlyIfCached: true}},
+		{"pragma", nil, []string{"no-cache"}, httpcaching.CacheControlRequestDirective{NoCache: true}},
+		{"pragma-ignored-with-cache-control", []string{"max-stale=10"}, []string{"no-cache"}, httpcaching.CacheControlRequestDirective{MaxStale: 10 * time.Second}},
+		{"duplicates", []string{"min-fresh=10", "min-fresh=20"}, nil, httpcaching.CacheControlRequestDirective{MinFresh: 10 * time.Second}},
+		{"unknown", []string{"unknown"}, nil, httpcaching.CacheControlRequestDirective{}},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := httpcaching.ParseCacheControlRequestDirective(
+				tc.cacheControl,
+				tc.pragma,
+				testutils.TestLogger(t, nil),
+			)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestErrorsOnInvalidRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		header   string
+		expected error
+	}{
+		{"max-age=hello", httpcaching.ErrInvalidArgument},
+		{"max-stale=hello", httpcaching.ErrInvalidArgument},
+		{"min-fresh=hello", httpcaching.ErrInvalidArgument},
+		{"max-age", httpcaching.ErrMissingArgument},
+		{"min-fresh", httpcaching.ErrMissingArgument},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := httpcaching.ParseCacheControlRequestDirective(
+				[]string{tc.header},
+				nil,
+				testutils.TestLogger(t, nil),
+			)
+			require.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestRequestDirectivesAcceptResponses(t *testing.T) {
+	t.Parallel()
+
+	maxAge := 10 * time.Second
+
+	for _, tc := range []struct {
+		description string
+		directive   httpcaching.CacheControlRequestDirective
+		age         time.Duration
+		staleness   time.Duration
+		expected    bool
+	}{
+		{"fresh", httpcaching.CacheControlRequestDirective{}, 5 * time.Second, -5 * time.Second, true},
+		{"stale", httpcaching.CacheControlRequestDirective{}, 15 * time.Second, 5 * time.Second, false},
+		{"too-old", httpcaching.CacheControlRequestDirective{MaxAge: &maxAge}, 15 * time.Second, -5 * time.Second, false},
+		{"not-fresh-enough", httpcaching.CacheControlRequestDirective{MinFresh: 10 * time.Second}, 5 * time.Second, -5 * time.Second, false},
+		{"fresh-enough", httpcaching.CacheControlRequestDirective{MinFresh: 5 * time.Second}, 5 * time.Second, -5 * time.Second, true},
+		{"accepts-stale", httpcaching.CacheControlRequestDirective{MaxStale: 10 * time.Second}, 15 * time.Second, 5 * time.Second, true},
+		{"too-stale", httpcaching.CacheControlRequestDirective{MaxStale: 1 * time.Second}, 15 * time.Second, 5 * time.Second, false},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.expected, tc.directive.Accepts(tc.age, tc.staleness))
+		})
+	}
+}
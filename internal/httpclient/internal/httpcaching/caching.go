@@ -10,6 +10,26 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// IsNegativeResponse returns whether the status code indicates the resource is
+// missing upstream
+func IsNegativeResponse(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusGone
+}
+
+// IsNegativeResponseCacheable returns whether the response for a missing
+// resource can be stored. Those responses are only cached when explicitly
+// configured, so this only ensures that nothing in the response forbids it.
+func IsNegativeResponseCacheable(r *http.Response, isPrivate bool, logger *zerolog.Logger) bool {
+	if !IsNegativeResponse(r.StatusCode) {
+		return false
+	}
+
+	resp := *r
+	resp.StatusCode = http.StatusOK
+	cacheable, explicitlyConfigured := IsCacheable(&resp, isPrivate, logger)
+	return cacheable || !explicitlyConfigured
+}
+
 func IsCacheable(
 	r *http.Response,
 	isPrivate bool,
@@ -118,3 +118,46 @@ func IsFresh(
 	age := GetCurrentAge(responseCreationTime, since)
 	return age, getFreshnessLifetime(headers, cacheControl, logger) > age
 }
+
+func CanServeStaleWhileRevalidating(
+	headers http.Header,
+	cacheControl CacheControlResponseDirective,
+	age time.Duration,
+	defaultWindow time.Duration,
+	logger *zerolog.Logger,
+) bool {
+	// Implements https://datatracker.ietf.org/doc/html/rfc5861#section-3
+	// The default window is used when the response doesn't specify one.
+	window := cacheControl.StaleWhileRevalidate
+	if window == 0 {
+		window = defaultWindow
+	}
+	if window == 0 {
+		return false
+	}
+
+	return getFreshnessLifetime(headers, cacheControl, logger)+window > age
+}
+
+// GetStaleResponseCreation returns when the response would need to have been
+// created to be stale by a second, so that it must be revalidated before being
+// served again, while still reporting a sensible age
+func GetStaleResponseCreation(
+	headers http.Header,
+	cacheControl CacheControlResponseDirective,
+	logger *zerolog.Logger,
+	now func() time.Time,
+) time.Time {
+	return now().Add(-getFreshnessLifetime(headers, cacheControl, logger) - time.Second)
+}
+
+func GetStaleness(
+	headers http.Header,
+	cacheControl CacheControlResponseDirective,
+	age time.Duration,
+	logger *zerolog.Logger,
+) time.Duration {
+	// Returns for how long the response has been stale, or a negative duration
+	// if it is still fresh
+	return age - getFreshnessLifetime(headers, cacheControl, logger)
+}
@@ -216,3 +216,83 @@ func TestIsNotFresh(t *testing.T) {
 	assert.Equal(t, time.Second*120, age)
 	assert.False(t, isFresh)
 }
+
+func TestCanServeStaleWhileRevalidating(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description   string
+		cacheControl  CacheControlResponseDirective
+		defaultWindow time.Duration
+		expected      bool
+	}{
+		{"no-window", CacheControlResponseDirective{MaxAge: 60 * time.Second}, 0, false},
+		{
+			"within-upstream-window",
+			CacheControlResponseDirective{
+				MaxAge:               60 * time.Second,
+				StaleWhileRevalidate: 90 * time.Second,
+			},
+			0,
+			true,
+		},
+		{
+			"outside-upstream-window",
+			CacheControlResponseDirective{
+				MaxAge:               60 * time.Second,
+				StaleWhileRevalidate: 30 * time.Second,
+			},
+			0,
+			false,
+		},
+		{
+			"within-default-window",
+			CacheControlResponseDirective{MaxAge: 60 * time.Second},
+			90 * time.Second,
+			true,
+		},
+		{
+			"upstream-window-takes-precedence",
+			CacheControlResponseDirective{
+				MaxAge:               60 * time.Second,
+				StaleWhileRevalidate: 30 * time.Second,
+			},
+			90 * time.Second,
+			false,
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(
+				t,
+				tc.expected,
+				CanServeStaleWhileRevalidating(
+					http.Header{},
+					tc.cacheControl,
+					120*time.Second,
+					tc.defaultWindow,
+					testutils.TestLogger(t, nil),
+				),
+			)
+		})
+	}
+}
+
+func TestGetStaleness(t *testing.T) {
+	t.Parallel()
+
+	logger := testutils.TestLogger(t, nil)
+	cacheControl := CacheControlResponseDirective{MaxAge: 60 * time.Second}
+
+	assert.Equal(
+		t,
+		-30*time.Second,
+		GetStaleness(http.Header{}, cacheControl, 30*time.Second, logger),
+	)
+	assert.Equal(
+		t,
+		60*time.Second,
+		GetStaleness(http.Header{}, cacheControl, 120*time.Second, logger),
+	)
+}
@@ -0,0 +1,353 @@
+// This implements the proactive negotiation headers from RFC 9110, used to select
+// which stored response to use, as allowed by RFC 9111 section 4.1
+//
+// See https://datatracker.ietf.org/doc/html/rfc9110#section-12.5
+// See https://datatracker.ietf.org/doc/html/rfc9111#section-4.1
+package httpcaching
+
+import (
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// negotiation describes a request header used for proactive negotiation, and
+// how to compute the quality of a response for it
+type negotiation struct {
+	// representationHeader is the response header describing what the
+	// request header negotiates
+	representationHeader string
+	// quality returns the quality of the representation for the given
+	// preferences, or false if it cannot be computed
+	quality func(preferences []preference, representation []string) (float64, bool)
+}
+
+var negotiations = map[string]negotiation{
+	"Accept":          {"Content-Type", mediaTypeQuality},
+	"Accept-Encoding": {"Content-Encoding", contentCodingQuality},
+	"Accept-Language": {"Content-Language", languageQuality},
+}
+
+// minimumQuality is the lowest non-zero weight that can be expressed
+const minimumQuality = 0.001
+
+// preference is an element of a negotiation header, with its weight.
+//
+// See https://datatracker.ietf.org/doc/html/rfc9110#section-12.4.2
+type preference struct {
+	value   string
+	params  []string
+	quality float64
+}
+
+func (p preference) String() string {
+	var builder strings.Builder
+
+	builder.WriteString(p.value)
+	for _, param := range p.params {
+		builder.WriteString(";")
+		builder.WriteString(param)
+	}
+	if p.quality != 1 {
+		builder.WriteString(";q=")
+		builder.WriteString(strconv.FormatFloat(p.quality, 'f', -1, 64))
+	}
+
+	return builder.String()
+}
+
+func parsePreferences(values []string) []preference {
+	preferences := make([]preference, 0, len(values))
+
+	for _, value := range values {
+		for element := range strings.SplitSeq(value, ",") {
+			parts := strings.Split(element, ";")
+
+			pref := preference{value: strings.ToLower(strings.TrimSpace(parts[0])), quality: 1}
+			if pref.value == "" {
+				continue
+			}
+
+			valid := true
+			for _, param := range parts[1:] {
+				key, val, _ := strings.Cut(param, "=")
+				key = strings.ToLower(strings.TrimSpace(key))
+				val = strings.TrimSpace(val)
+
+				if key == "q" {
+					quality, err := strconv.ParseFloat(val, 64)
+					if err != nil || quality < 0 || quality > 1 {
+						valid = false
+						break
+					}
+					pref.quality = quality
+				} else if key != "" {
+					pref.params = append(pref.params, key+"="+strings.ToLower(val))
+				}
+			}
+
+			if valid {
+				preferences = append(preferences, pref)
+			}
+		}
+	}
+
+	return preferences
+}
+
+func normalizePreferences(values []string) []string {
+	preferences := parsePreferences(values)
+	if len(preferences) == 0 {
+		return normalizeVaryHeaders(values)
+	}
+
+	// The order of the elements is not significant, only their weight is
+	elements := make([]string, 0, len(preferences))
+	for _, pref := range preferences {
+		elements = append(elements, pref.String())
+	}
+	slices.Sort(elements)
+
+	return []string{strings.Join(elements, ", ")}
+}
+
+func maxQuality(preferences []preference) float64 {
+	maxQuality := 0.0
+	for _, pref := range preferences {
+		maxQuality = max(maxQuality, pref.quality)
+	}
+	return maxQuality
+}
+
+// mediaTypeQuality implements https://datatracker.ietf.org/doc/html/rfc9110#section-12.5.1
+func mediaTypeQuality(preferences []preference, contentType []string) (float64, bool) {
+	if len(contentType) == 0 {
+		return 0, false
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType[0])
+	if err != nil {
+		return 0, false
+	}
+	mainType, subType, _ := strings.Cut(mediaType, "/")
+
+	quality := 0.0
+	bestSpecificity := -1
+
+	for _, pref := range preferences {
+		prefMainType, prefSubType, _ := strings.Cut(pref.value, "/")
+
+		var specificity int
+		switch {
+		case prefMainType == "*" && prefSubType == "*":
+			specificity = 0
+		case prefMainType == mainType && prefSubType == "*":
+			specificity = 1
+		case prefMainType == mainType && prefSubType == subType:
+			specificity = 2
+		default:
+			continue
+		}
+
+		matchesParams := true
+		for _, param := range pref.params {
+			key, val, _ := strings.Cut(param, "=")
+			if !strings.EqualFold(params[key], strings.Trim(val, `"`)) {
+				matchesParams = false
+				break
+			}
+		}
+		if !matchesParams {
+			continue
+		}
+
+		// The most specific media range has precedence
+		specificity += len(pref.params)
+		if specificity > bestSpecificity {
+			bestSpecificity = specificity
+			quality = pref.quality
+		}
+	}
+
+	return quality, true
+}
+
+func normalizeContentCoding(coding string) string {
+	// See https://datatracker.ietf.org/doc/html/rfc9110#section-8.4.1
+	switch coding {
+	case "x-gzip":
+		return "gzip"
+	case "x-compress":
+		return "compress"
+	default:
+		return coding
+	}
+}
+
+// contentCodingQuality implements https://datatracker.ietf.org/doc/html/rfc9110#section-12.5.3
+func contentCodingQuality(preferences []preference, contentEncoding []string) (float64, bool) {
+	codings := []string{}
+	for _, value := range contentEncoding {
+		for coding := range strings.SplitSeq(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" {
+				codings = append(codings, normalizeContentCoding(coding))
+			}
+		}
+	}
+	if len(codings) == 0 {
+		codings = []string{"identity"}
+	}
+
+	// All the codings applied need to be acceptable
+	quality := 1.0
+	for _, coding := range codings {
+		codingQuality := -1.0
+		wildcardQuality := -1.0
+
+		for _, pref := range preferences {
+			switch normalizeContentCoding(pref.value) {
+			case coding:
+				codingQuality = pref.quality
+			case "*":
+				wildcardQuality = pref.quality
+			}
+		}
+
+		switch {
+		case codingQuality >= 0:
+		case wildcardQuality >= 0:
+			codingQuality = wildcardQuality
+		case coding == "identity":
+			// Identity is always acceptable, unless explicitly excluded, but
+			// we consider it less preferred than any coding explicitly listed
+			codingQuality = minimumQuality
+		default:
+			codingQuality = 0
+		}
+
+		quality = min(quality, codingQuality)
+	}
+
+	return quality, true
+}
+
+// languageQuality implements https://datatracker.ietf.org/doc/html/rfc9110#section-12.5.4
+// using the basic filtering from https://datatracker.ietf.org/doc/html/rfc4647#section-3.3.1
+func languageQuality(preferences []preference, contentLanguage []string) (float64, bool) {
+	quality := 0.0
+	hasLanguage := false
+
+	// The content is acceptable if any of its intended audiences is
+	for _, value := range contentLanguage {
+		for tag := range strings.SplitSeq(value, ",") {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" {
+				continue
+			}
+			hasLanguage = true
+
+			tagQuality := 0.0
+			bestSpecificity := -1
+
+			for _, pref := range preferences {
+				var specificity int
+				switch {
+				case pref.value == "*":
+					specificity = 0
+				case pref.value == tag || strings.HasPrefix(tag, pref.value+"-"):
+					specificity = len(pref.value)
+				default:
+					continue
+				}
+
+				if specificity > bestSpecificity {
+					bestSpecificity = specificity
+					tagQuality = pref.quality
+				}
+			}
+
+			quality = max(quality, tagQuality)
+		}
+	}
+
+	return quality, hasLanguage
+}
+
+// NegotiateVaryHeaders checks whether a stored response can be used to answer the
+// request, and how much the request prefers it.
+//
+// Headers used for proactive negotiation match if the stored response is among
+// the most preferred ones by the request, even if the request headers are
+// different. Other headers need to match exactly, modulo normalization.
+func NegotiateVaryHeaders(
+	reqHeaders, varyHeaders, respHeaders http.Header,
+	logger *zerolog.Logger,
+) (quality float64, match bool) {
+	quality = 1
+
+	if _, ok := varyHeaders["*"]; ok {
+		return 0, false
+	}
+
+	for headerName, headerValue := range varyHeaders {
+		reqValues := reqHeaders.Values(headerName)
+		matches := slices.Equal(
+			normalizeVaryHeader(headerName, reqValues),
+			normalizeVaryHeader(headerName, headerValue),
+		)
+
+		negotiation, ok := negotiations[http.CanonicalHeaderKey(headerName)]
+		if !ok {
+			if !matches {
+				logger.Debug().
+					Str("header", headerName).
+					Strs("currentHeaders", reqValues).
+					Strs("originalHeaders", headerValue).
+					Msg("unable to reuse query without validating due to different headers")
+				return 0, false
+			}
+			continue
+		}
+
+		preferences := parsePreferences(reqValues)
+		headerQuality, known := negotiation.quality(
+			preferences,
+			respHeaders.Values(negotiation.representationHeader),
+		)
+
+		if !matches {
+			// Clients not sending the header often can't handle anything
+			// but the default, so we don't take chances with them
+			if len(reqValues) == 0 || !known || headerQuality == 0 ||
+				headerQuality < maxQuality(preferences) {
+				logger.Debug().
+					Str("header", headerName).
+					Strs("currentHeaders", reqValues).
+					Strs("representation", respHeaders.Values(negotiation.representationHeader)).
+					Msg("unable to reuse query without validating as it is not a preferred variant")
+				return 0, false
+			}
+		}
+
+		if known {
+			quality *= headerQuality
+		}
+	}
+
+	return quality, true
+}
+
+// AcceptsContentCoding returns whether the request accepts responses encoded
+// with the given content coding
+func AcceptsContentCoding(reqHeaders http.Header, coding string) bool {
+	quality, _ := contentCodingQuality(
+		parsePreferences(reqHeaders.Values("Accept-Encoding")),
+		[]string{coding},
+	)
+	return quality > 0
+}
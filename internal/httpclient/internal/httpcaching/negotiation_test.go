@@ -0,0 +1,219 @@
+package httpcaching
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/benjaminschubert/locaccel/internal/testutils"
+)
+
+func TestNegotiateVaryHeaders(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description     string
+		reqHeaders      http.Header
+		varyHeaders     http.Header
+		respHeaders     http.Header
+		expectedQuality float64
+		expectedMatch   bool
+	}{
+		{
+			"no-vary",
+			http.Header{},
+			http.Header{},
+			http.Header{},
+			1,
+			true,
+		},
+		{
+			"vary-wildcard",
+			http.Header{},
+			http.Header{"*": nil},
+			http.Header{},
+			0,
+			false,
+		},
+		{
+			"other-header-must-match",
+			http.Header{"Foo": []string{"one"}},
+			http.Header{"Foo": []string{"two"}},
+			http.Header{},
+			0,
+			false,
+		},
+		{
+			"encoding-exact-match",
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Content-Encoding": []string{"gzip"}},
+			1,
+			true,
+		},
+		{
+			"encoding-preferred",
+			http.Header{"Accept-Encoding": []string{"gzip, deflate, br"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Content-Encoding": []string{"gzip"}},
+			1,
+			true,
+		},
+		{
+			"encoding-alias",
+			http.Header{"Accept-Encoding": []string{"x-gzip"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Content-Encoding": []string{"gzip"}},
+			1,
+			true,
+		},
+		{
+			"encoding-not-preferred",
+			http.Header{"Accept-Encoding": []string{"br, gzip;q=0.5"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Content-Encoding": []string{"gzip"}},
+			0,
+			false,
+		},
+		{
+			"encoding-not-acceptable",
+			http.Header{"Accept-Encoding": []string{"identity"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Content-Encoding": []string{"gzip"}},
+			0,
+			false,
+		},
+		{
+			"encoding-identity-implicit",
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{},
+			0.001,
+			true,
+		},
+		{
+			"encoding-identity-implicit-not-preferred",
+			http.Header{"Accept-Encoding": []string{"br"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{},
+			0,
+			false,
+		},
+		{
+			"encoding-identity-excluded",
+			http.Header{"Accept-Encoding": []string{"br, *;q=0"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{},
+			0,
+			false,
+		},
+		{
+			"encoding-missing-request-header",
+			http.Header{},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			http.Header{"Content-Encoding": []string{"gzip"}},
+			0,
+			false,
+		},
+		{
+			"media-type-preferred",
+			http.Header{"Accept": []string{
+				"application/vnd.pypi.simple.v1+json, application/vnd.pypi.simple.v1+html;q=0.1",
+			}},
+			http.Header{"Accept": []string{"application/vnd.pypi.simple.v1+json"}},
+			http.Header{"Content-Type": []string{"application/vnd.pypi.simple.v1+json"}},
+			1,
+			true,
+		},
+		{
+			"media-type-not-preferred",
+			http.Header{"Accept": []string{
+				"application/vnd.pypi.simple.v1+json, text/html;q=0.01",
+			}},
+			http.Header{"Accept": []string{"text/html"}},
+			http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+			0,
+			false,
+		},
+		{
+			"media-type-most-specific-range",
+			http.Header{"Accept": []string{"text/*;q=0.5, text/html, */*;q=0.1"}},
+			http.Header{"Accept": []string{"text/html"}},
+			http.Header{"Content-Type": []string{"text/html"}},
+			1,
+			true,
+		},
+		{
+			"media-type-exact-match-keeps-quality",
+			http.Header{"Accept": []string{"text/html;q=0.5, application/json"}},
+			http.Header{"Accept": []string{"application/json, text/html;q=0.5"}},
+			http.Header{"Content-Type": []string{"text/html"}},
+			0.5,
+			true,
+		},
+		{
+			"media-type-unknown",
+			http.Header{"Accept": []string{"text/html"}},
+			http.Header{"Accept": []string{"*/*"}},
+			http.Header{},
+			0,
+			false,
+		},
+		{
+			"language-prefix",
+			http.Header{"Accept-Language": []string{"fr-CH, fr;q=0.9, en;q=0.8"}},
+			http.Header{"Accept-Language": []string{"fr"}},
+			http.Header{"Content-Language": []string{"fr-CH"}},
+			1,
+			true,
+		},
+		{
+			"language-not-preferred",
+			http.Header{"Accept-Language": []string{"fr-CH, fr;q=0.9, en;q=0.8"}},
+			http.Header{"Accept-Language": []string{"en"}},
+			http.Header{"Content-Language": []string{"en"}},
+			0,
+			false,
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			quality, match := NegotiateVaryHeaders(
+				tc.reqHeaders,
+				tc.varyHeaders,
+				tc.respHeaders,
+				testutils.TestLogger(t, nil),
+			)
+			assert.Equal(t, tc.expectedMatch, match)
+			assert.InDelta(t, tc.expectedQuality, quality, 0.001)
+		})
+	}
+}
+
+func TestAcceptsContentCoding(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		description    string
+		acceptEncoding []string
+		expected       bool
+	}{
+		{"no-header", nil, false},
+		{"listed", []string{"gzip, zstd"}, true},
+		{"wildcard", []string{"*"}, true},
+		{"excluded", []string{"gzip, zstd;q=0"}, false},
+		{"not-listed", []string{"gzip, br"}, false},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(
+				t,
+				tc.expected,
+				AcceptsContentCoding(http.Header{"Accept-Encoding": tc.acceptEncoding}, "zstd"),
+			)
+		})
+	}
+}
@@ -28,10 +28,29 @@ func getVaryHeaderNames(headers http.Header) []string {
 }
 
 func normalizeVaryHeaders(headerVal []string) []string {
-	if headerVal == nil || len(headerVal) == 1 {
+	if len(headerVal) == 0 {
 		return headerVal
 	}
-	return []string{strings.Join(headerVal, ", ")}
+
+	// Whitespace around list elements is not significant
+	elements := make([]string, 0, len(headerVal))
+	for _, value := range headerVal {
+		for element := range strings.SplitSeq(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return []string{strings.Join(elements, ", ")}
+}
+
+// normalizeVaryHeader normalizes the header values in a way that keeps
+// their semantics, as described in RFC 9111 section 4.1
+func normalizeVaryHeader(headerName string, headerVal []string) []string {
+	if _, ok := negotiations[http.CanonicalHeaderKey(headerName)]; ok && len(headerVal) != 0 {
+		return normalizePreferences(headerVal)
+	}
+	return normalizeVaryHeaders(headerVal)
 }
 
 func ExtractVaryHeaders(reqHeaders, respHeaders http.Header) http.Header {
@@ -39,7 +58,7 @@ func ExtractVaryHeaders(reqHeaders, respHeaders http.Header) http.Header {
 	relevantHeaders := http.Header{}
 
 	for _, header := range varyHeaders {
-		relevantHeaders[header] = normalizeVaryHeaders(reqHeaders[header])
+		relevantHeaders[header] = normalizeVaryHeader(header, reqHeaders.Values(header))
 	}
 
 	return relevantHeaders
@@ -55,7 +74,9 @@ func MatchVaryHeaders(reqHeaders, varyHeaders http.Header, logger *zerolog.Logge
 	}
 
 	for headerName, headerValue := range varyHeaders {
-		reqHeader := normalizeVaryHeaders(reqHeaders[headerName])
+		reqHeader := normalizeVaryHeader(headerName, reqHeaders.Values(headerName))
+		// Entries stored by older versions might not be fully normalized
+		headerValue = normalizeVaryHeader(headerName, headerValue)
 		if len(reqHeader) != len(headerValue) {
 			logger.Debug().
 				Str("header", headerName).
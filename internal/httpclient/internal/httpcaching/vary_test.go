@@ -56,6 +56,11 @@ func TestMatchVaryHeaders(t *testing.T) {
 		{"vary-missing", http.Header{}, http.Header{"Foo": []string{"one"}}, false},
 		{"vary-matching", http.Header{"Foo": []string{"one"}, "Bar": []string{"two"}}, http.Header{"Foo": []string{"one"}, "Baz": nil}, true},
 		{"vary-matching-normalized", http.Header{"Foo": []string{"one, two", "three"}}, http.Header{"Foo": []string{"one, two, three"}}, true},
+		{"vary-matching-normalized-whitespace", http.Header{"Foo": []string{"one ,two"}}, http.Header{"Foo": []string{"one, two"}}, true},
+		{"vary-matching-case-insensitive", http.Header{"Accept-Encoding": []string{"GZIP, br"}}, http.Header{"Accept-Encoding": []string{"br, gzip"}}, true},
+		{"vary-matching-weights", http.Header{"Accept": []string{"text/html ; q=0.50", "*/*;q=0.1"}}, http.Header{"Accept": []string{"*/*;q=0.1, text/html;q=0.5"}}, true},
+		{"vary-not-matching-weights", http.Header{"Accept": []string{"text/html;q=0.5"}}, http.Header{"Accept": []string{"text/html"}}, false},
+		{"vary-case-sensitive", http.Header{"Foo": []string{"ONE"}}, http.Header{"Foo": []string{"one"}}, false},
 	} {
 		t.Run(tc.description, func(t *testing.T) {
 			t.Parallel()
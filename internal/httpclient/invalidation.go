@@ -0,0 +1,103 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// isSafeMethod returns whether the method is safe, as described in RFC 9110
+// section 9.2.1
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// invalidate marks the responses stored for the target URI of an unsafe request
+// stale, as it is likely to have changed them, along with the ones stored for
+// the Location and Content-Location of the response, if they are on the same
+// origin.
+//
+// See https://datatracker.ietf.org/doc/html/rfc9111#section-4.4
+func (c *Client) invalidate(req *http.Request, resp *http.Response, logger *zerolog.Logger) {
+	if isSafeMethod(req.Method) {
+		return
+	}
+
+	// Only non-error status codes invalidate the responses
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return
+	}
+
+	uris := []*url.URL{req.URL}
+	for _, header := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(header)
+		if value == "" {
+			continue
+		}
+
+		uri, err := req.URL.Parse(value)
+		if err != nil {
+			logger.Debug().Err(err).Str("header", header).Msg("unable to parse URI to invalidate")
+			continue
+		}
+		uri.Fragment = ""
+
+		// Invalidating other origins would allow denial of service attacks
+		if uri.Scheme != req.URL.Scheme || uri.Host != req.URL.Host {
+			logger.Debug().
+				Str("header", header).
+				Stringer("uri", uri).
+				Msg("not invalidating URI from another origin")
+			continue
+		}
+		uris = append(uris, uri)
+	}
+
+	for _, uri := range uris {
+		key := buildKeyForMethod(http.MethodGet, uri)
+		if err := c.cache.MarkStale(key, c.staleResponseCreation(uri, logger)); err != nil {
+			logger.Warn().Err(err).Stringer("uri", uri).Msg("unable to invalidate cached responses")
+		} else {
+			logger.Debug().Stringer("uri", uri).Msg("invalidated cached responses")
+		}
+	}
+}
+
+// staleResponseCreation returns when the responses stored for the URI would
+// need to have been created to be stale, according to the same lifetimes as
+// when serving them
+func (c *Client) staleResponseCreation(
+	uri *url.URL,
+	logger *zerolog.Logger,
+) func(CachedResponse) time.Time {
+	rule := c.freshnessRuleFor(uri)
+
+	return func(resp CachedResponse) time.Time {
+		if httpcaching.IsNegativeResponse(resp.StatusCode) {
+			return c.now().Add(-c.opts.NegativeTTL - time.Second)
+		}
+
+		cacheControl, err := httpcaching.ParseCacheControlDirective(
+			resp.Headers["Cache-Control"],
+			logger,
+		)
+		if err != nil {
+			logger.Warn().Err(err).Msg("unable to parse cache control directives")
+		}
+		return httpcaching.GetStaleResponseCreation(
+			resp.Headers,
+			rule.apply(cacheControl),
+			logger,
+			c.now,
+		)
+	}
+}
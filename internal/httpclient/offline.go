@@ -0,0 +1,114 @@
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/benjaminschubert/locaccel/internal/database"
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// OfflineMode controls whether upstream can be contacted. When offline, requests
+// are answered from the cache only, and can be toggled at runtime.
+type OfflineMode struct {
+	enabled atomic.Bool
+	parent  *OfflineMode
+}
+
+// NewOfflineMode returns an offline mode, which is also enabled whenever its
+// parent is, if it has one
+func NewOfflineMode(enabled bool, parent *OfflineMode) *OfflineMode {
+	mode := &OfflineMode{parent: parent}
+	mode.enabled.Store(enabled)
+	return mode
+}
+
+// Set enables or disables the offline mode
+func (m *OfflineMode) Set(enabled bool) {
+	m.enabled.Store(enabled)
+}
+
+// IsSet returns whether the offline mode was enabled, regardless of its parent
+func (m *OfflineMode) IsSet() bool {
+	return m != nil && m.enabled.Load()
+}
+
+// Enabled returns whether upstream must not be contacted
+func (m *OfflineMode) Enabled() bool {
+	return m.IsSet() || (m != nil && m.parent.Enabled())
+}
+
+// OfflineModes gathers the offline modes of all the registries, along with the
+// global one they inherit from, so they can be toggled at runtime
+type OfflineModes struct {
+	Global     *OfflineMode
+	Registries map[string]*OfflineMode
+}
+
+// doOffline answers the request without contacting upstream. Any stored
+// response is better than none, so their freshness is not taken into account.
+func (c *Client) doOffline(
+	req *http.Request,
+	notify func(r *http.Request, status string),
+	logger *zerolog.Logger,
+) *http.Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		notify(req, "miss")
+		return newGatewayTimeoutResponse(
+			"The cache is offline, and cannot forward " + req.Method + " requests upstream",
+		)
+	}
+
+	dbEntry := cachedResponsesPool.Get().(*database.Entry[CachedResponses])
+	defer cachedResponsesPool.Put(dbEntry)
+
+	// HEAD requests are answered from the GET responses
+	if err := c.getStoredResponses(req, dbEntry); err == nil {
+		if resp := c.serveFromCache(
+			req,
+			dbEntry,
+			serveOffline,
+			httpcaching.CacheControlRequestDirective{},
+			logger,
+		); resp != nil {
+			logger.Debug().Msg("serving response from cache while offline")
+			return c.serveOfflineResponse(req, resp, notify, logger)
+		}
+	} else if !errors.Is(err, database.ErrKeyNotFound) {
+		logger.Debug().Err(err).Msg("unable to retrieve entry from database")
+	}
+
+	if resp := c.serveFromDigests(req, logger); resp != nil {
+		return c.serveOfflineResponse(req, resp, notify, logger)
+	}
+
+	logger.Debug().Msg("no response in cache while offline")
+	notify(req, "miss")
+	return newGatewayTimeoutResponse(
+		"The cache is offline, and has no stored response for this request",
+	)
+}
+
+// serveOfflineResponse answers the request with the stored response, which is
+// reported as stale if it is
+func (c *Client) serveOfflineResponse(
+	req *http.Request,
+	resp *http.Response,
+	notify func(r *http.Request, status string),
+	logger *zerolog.Logger,
+) *http.Response {
+	if c.timeToLive(req, resp, logger) > 0 {
+		notify(req, "hit")
+	} else {
+		markServedOffline(req, resp)
+		notify(req, "stale")
+	}
+
+	if req.Method == http.MethodHead {
+		return toHeadResponse(req, resp, logger)
+	}
+	return resp
+}
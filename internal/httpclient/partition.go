@@ -0,0 +1,98 @@
+package httpclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog"
+
+	"github.com/benjaminschubert/locaccel/internal/database"
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// partitionSeparator separates the key of a response from the partition it
+// belongs to. Request URIs never contain fragments, so it cannot be ambiguous,
+// and the key can still be parsed as a URI.
+const partitionSeparator = "#partition="
+
+// partition returns the partition of the cache the responses to the request
+// are stored in, or an empty string if they go to the shared cache.
+//
+// Partitions are derived from the credentials the client sent, so that private
+// responses are only served back to whoever was allowed to see them. They are
+// keyed with a secret of the instance, so the credentials cannot be guessed back
+// from the keys in the database.
+func (c *Client) partition(req *http.Request) string {
+	if !c.opts.PartitionByAuthorization {
+		return ""
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, c.cache.partitionSecret)
+	mac.Write([]byte(authorization))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// withPartition returns the key for the responses stored in the partition
+func withPartition(key []byte, partition string) []byte {
+	if partition == "" {
+		return key
+	}
+	return append(key, partitionSeparator+partition...)
+}
+
+// isPublic returns whether the response was explicitly marked as public, and can
+// thus be shared with everyone, even if the request was authenticated
+func isPublic(resp *http.Response, logger *zerolog.Logger) bool {
+	cacheControl, err := httpcaching.ParseCacheControlDirective(
+		resp.Header["Cache-Control"],
+		logger,
+	)
+	return err == nil && cacheControl.Public
+}
+
+// getStoredResponses loads the responses stored for the GET request of the
+// request's URI, from its partition, or from the shared cache if there are none.
+func (c *Client) getStoredResponses(
+	req *http.Request,
+	dbEntry *database.Entry[CachedResponses],
+) error {
+	key := buildKeyForMethod(http.MethodGet, req.URL)
+
+	if partition := c.partition(req); partition != "" {
+		err := c.cache.Get(withPartition(key, partition), dbEntry)
+		if !errors.Is(err, database.ErrKeyNotFound) {
+			return err
+		}
+	}
+
+	return c.cache.Get(key, dbEntry)
+}
+
+// serveFromSharedCache serves a fresh response from the shared cache to a
+// request having its own partition, as responses in the shared cache are
+// available to everyone.
+func (c *Client) serveFromSharedCache(
+	req *http.Request,
+	requestCacheControl httpcaching.CacheControlRequestDirective,
+	logger *zerolog.Logger,
+) *http.Response {
+	dbEntry := cachedResponsesPool.Get().(*database.Entry[CachedResponses])
+	defer cachedResponsesPool.Put(dbEntry)
+
+	if err := c.cache.Get(buildKey(req), dbEntry); err != nil {
+		if !errors.Is(err, database.ErrKeyNotFound) {
+			logger.Debug().Err(err).Msg("unable to retrieve shared entry from database")
+		}
+		return nil
+	}
+
+	return c.serveFromCache(req, dbEntry, serveFreshOnly, requestCacheControl, logger)
+}
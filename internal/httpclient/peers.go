@@ -0,0 +1,85 @@
+package httpclient
+
+import (
+	"cmp"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// PeerGroup is a group of locaccel instances sharing the work of fetching
+// artifacts. Each URL is owned by a single peer, through which all the others
+// fetch it, so that it is downloaded only once for the whole group.
+//
+// Owners are selected by rendezvous hashing, so that when a peer goes down,
+// only the URLs it owned move to other peers.
+type PeerGroup struct {
+	// Peers are all the instances in the group, in the same order on every peer
+	Peers []*url.URL
+	// Self is the entry of Peers designating this instance, if it is part of it
+	Self *url.URL
+}
+
+// peerScore is the weight of the peer for the key. The peer with the highest
+// weight owns the key.
+func peerScore(peer *url.URL, key []byte) uint64 {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(peer.String()))
+	_, _ = hasher.Write(key)
+	score := hasher.Sum64()
+
+	// FNV alone doesn't spread similar inputs well enough, finalize it as
+	// splitmix64 does
+	score ^= score >> 30
+	score *= 0xbf58476d1ce4e5b9
+	score ^= score >> 27
+	score *= 0x94d049bb133111eb
+	score ^= score >> 31
+
+	return score
+}
+
+func (g PeerGroup) isSelf(peer *url.URL) bool {
+	return g.Self != nil && g.Self.String() == peer.String()
+}
+
+// rankPeers returns the peers ordered by their preference to own the key
+func (g PeerGroup) rankPeers(key []byte) []*url.URL {
+	scores := make(map[*url.URL]uint64, len(g.Peers))
+	for _, peer := range g.Peers {
+		scores[peer] = peerScore(peer, key)
+	}
+
+	ranked := slices.Clone(g.Peers)
+	slices.SortFunc(ranked, func(a, b *url.URL) int {
+		return cmp.Compare(scores[b], scores[a])
+	})
+	return ranked
+}
+
+// Peers returns the instances of the group this client shares its work with.
+// Their URLs can appear in the responses this instance gets from them.
+func (c *Client) Peers() []*url.URL {
+	return c.opts.PeerGroup.Peers
+}
+
+// peerOwner returns the peer through which the request needs to go, or nil if
+// this instance owns it. Peers known to be down are skipped, so their URLs are
+// handled by the next peers in line until they come back.
+func (c *Client) peerOwner(req *http.Request) *url.URL {
+	if len(c.opts.PeerGroup.Peers) == 0 || !isSafeMethod(req.Method) {
+		return nil
+	}
+
+	for _, peer := range c.opts.PeerGroup.rankPeers(buildKeyForMethod(http.MethodGet, req.URL)) {
+		if c.opts.PeerGroup.isSelf(peer) {
+			return nil
+		}
+		if c.health.available(peer.String()) {
+			return peer
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+package httpclient
+
+import "io"
+
+// sizedReadSeekCloser allows seeking relative to the end of a reader whose
+// size is already known, but whose content might not be available yet.
+type sizedReadSeekCloser struct {
+	io.ReadSeekCloser
+	size int64
+}
+
+func (r *sizedReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		return r.ReadSeekCloser.Seek(r.size+offset, io.SeekStart)
+	}
+	return r.ReadSeekCloser.Seek(offset, whence)
+}
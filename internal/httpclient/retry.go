@@ -0,0 +1,286 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// maxRetryTokens is the number of retries that can happen in a row, before
+// needing successful requests to allow more
+const maxRetryTokens = 10
+
+// RetryPolicy controls how idempotent requests to upstream are retried on
+// transient errors
+type RetryPolicy struct {
+	// Attempts is the maximum number of retries for a request. Retries are
+	// disabled if 0.
+	Attempts int
+	// StatusCodes are the upstream status codes for which requests are retried,
+	// in addition to transport errors.
+	StatusCodes []int
+	// InitialBackoff is how long to wait before the first retry. It doubles for
+	// every retry, with jitter.
+	InitialBackoff time.Duration
+	// MaxBackoff bounds how long to wait before a retry. Requests asking to be
+	// retried later than this are not.
+	MaxBackoff time.Duration
+	// Budget is the number of retries allowed for each request, on average.
+	// It avoids hammering an upstream already struggling.
+	Budget float64
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.MaxBackoff
+	if attempt < 32 {
+		backoff = min(p.InitialBackoff<<attempt, p.MaxBackoff)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	// Full jitter, to avoid clients retrying in lockstep
+	return rand.N(backoff) //nolint:gosec
+}
+
+// retryBudget is a token bucket filled by requests and drained by retries
+type retryBudget struct {
+	mutex  sync.Mutex
+	tokens float64
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{tokens: maxRetryTokens}
+}
+
+func (b *retryBudget) deposit(amount float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens = min(b.tokens+amount, maxRetryTokens)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryAfter returns how long upstream asked to wait before retrying
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests &&
+		resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return max(0, time.Duration(seconds)*time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(0, date.Sub(now)), true
+	}
+
+	return 0, false
+}
+
+// retryDelay returns how long to wait before retrying the request, and whether
+// it should be retried at all
+func (c *Client) retryDelay(
+	req *http.Request,
+	resp *http.Response,
+	err error,
+	attempt int,
+) (time.Duration, bool) {
+	policy := c.opts.Retry
+
+	if attempt >= policy.Attempts || req.Context().Err() != nil {
+		return 0, false
+	}
+	if err == nil && !slices.Contains(policy.StatusCodes, resp.StatusCode) {
+		return 0, false
+	}
+
+	delay := policy.backoff(attempt)
+	if err == nil {
+		if after, ok := retryAfter(resp, c.now()); ok {
+			if after > policy.MaxBackoff {
+				return 0, false
+			}
+			delay = max(delay, after)
+		}
+	}
+
+	return delay, c.retries.withdraw()
+}
+
+// forwardRequestWithRetries forwards the request to upstream, retrying
+// idempotent requests on transient errors, as configured.
+func (c *Client) forwardRequestWithRetries(
+	req *http.Request,
+	logger *zerolog.Logger,
+) (resp *http.Response, timeAtRequestCreated, timeAtResponseReceived time.Time, err error) {
+	if c.opts.Retry.Attempts == 0 ||
+		(req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return c.forwardRequest(req, logger)
+	}
+
+	c.retries.deposit(c.opts.Retry.Budget)
+
+	for attempt := 0; ; attempt++ {
+		// Forwarding modifies the request, which needs to be sent again as is
+		resp, timeAtRequestCreated, timeAtResponseReceived, err = c.forwardRequest(
+			req.Clone(req.Context()),
+			logger,
+		)
+
+		delay, retry := c.retryDelay(req, resp, err, attempt)
+		if !retry {
+			break
+		}
+
+		event := logger.Debug().Int("attempt", attempt+1).Dur("delay", delay)
+		if err != nil {
+			event = event.Err(err)
+		} else {
+			event = event.Int("status", resp.StatusCode)
+			readAndCloseUpstreamBody(resp.Body, logger)
+		}
+		event.Msg("Retrying request to upstream")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, timeAtRequestCreated, timeAtResponseReceived, req.Context().Err()
+		}
+	}
+
+	if err == nil &&
+		req.Method == http.MethodGet &&
+		resp.StatusCode == http.StatusOK &&
+		req.Header.Get("Range") == "" {
+		if validator := rangeValidator(resp.Header); validator != "" {
+			resp.Body = &resumableBody{
+				body:      resp.Body,
+				req:       req,
+				validator: validator,
+				client:    c,
+				logger:    logger,
+			}
+		}
+	}
+
+	return resp, timeAtRequestCreated, timeAtResponseReceived, err
+}
+
+// rangeValidator returns the validator to use in If-Range, to ensure a range
+// request is for the same representation, or an empty string if there is none.
+//
+// See https://datatracker.ietf.org/doc/html/rfc9110#section-13.1.5
+func rangeValidator(headers http.Header) string {
+	if etag := headers.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return headers.Get("Last-Modified")
+}
+
+var (
+	errUnexpectedRangeResponse = errors.New("unexpected response to a range request")
+	errNoRetriesLeft           = errors.New("no retries left")
+)
+
+// resumableBody continues reading the body of a response with range requests
+// when the connection to upstream breaks.
+type resumableBody struct {
+	body      io.ReadCloser
+	req       *http.Request
+	validator string
+	client    *Client
+	logger    *zerolog.Logger
+	read      int64
+	attempts  int
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.read += int64(n)
+
+	if err == nil || errors.Is(err, io.EOF) {
+		return n, err
+	}
+
+	if resumeErr := b.resume(err); resumeErr != nil {
+		b.logger.Debug().Err(resumeErr).Msg("Unable to resume reading the upstream response")
+		return n, err
+	}
+
+	b.logger.Debug().Err(err).Int64("offset", b.read).Msg("Resumed reading the upstream response")
+	return n, nil
+}
+
+func (b *resumableBody) resume(readErr error) error {
+	delay, retry := b.client.retryDelay(b.req, nil, readErr, b.attempts)
+	if !retry {
+		return errNoRetriesLeft
+	}
+	b.attempts++
+
+	// The broken response holds a slot of the upstream until it is closed, which
+	// the range request would otherwise wait for
+	if err := b.body.Close(); err != nil {
+		b.logger.Debug().Err(err).Msg("Error closing the broken upstream response")
+	}
+
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-b.req.Context().Done():
+		timer.Stop()
+		return b.req.Context().Err()
+	}
+
+	req := b.req.Clone(b.req.Context())
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+	req.Header.Set("If-Range", b.validator)
+
+	resp, _, _, err := b.client.forwardRequest(req, b.logger)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", b.read)) {
+		readAndCloseUpstreamBody(resp.Body, b.logger)
+		return fmt.Errorf("%w: %d", errUnexpectedRangeResponse, resp.StatusCode)
+	}
+
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
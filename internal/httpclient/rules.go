@@ -0,0 +1,68 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// immutableLifetime is the freshness lifetime given to immutable responses.
+// It is large enough to never expire, without risking overflows.
+const immutableLifetime = 100 * 365 * 24 * time.Hour
+
+// FreshnessRule overrides what upstream says about the freshness of the
+// responses for the paths it matches
+type FreshnessRule struct {
+	Path *regexp.Regexp
+	// TTL is how long responses are fresh, regardless of their headers
+	TTL *time.Duration
+	// Immutable responses are never revalidated
+	Immutable bool
+	// NoStore responses are neither stored nor served from the cache
+	NoStore bool
+}
+
+// overridesFreshness returns whether the rule decides of the freshness of
+// the responses, instead of their headers
+func (r *FreshnessRule) overridesFreshness() bool {
+	return r != nil && (r.Immutable || r.TTL != nil)
+}
+
+// apply overrides the directives of the response with the ones from the rule
+func (r *FreshnessRule) apply(
+	cacheControl httpcaching.CacheControlResponseDirective,
+) httpcaching.CacheControlResponseDirective {
+	if !r.overridesFreshness() {
+		return cacheControl
+	}
+
+	cacheControl.NoCache = false
+	cacheControl.MustRevalidate = false
+	cacheControl.ProxyRevalidate = false
+
+	// The shared max age takes precedence over anything else
+	if r.Immutable {
+		cacheControl.Immutable = true
+		cacheControl.SMaxAge = immutableLifetime
+	} else {
+		cacheControl.SMaxAge = *r.TTL
+	}
+
+	return cacheControl
+}
+
+func (c *Client) freshnessRule(req *http.Request) *FreshnessRule {
+	return c.freshnessRuleFor(req.URL)
+}
+
+func (c *Client) freshnessRuleFor(uri *url.URL) *FreshnessRule {
+	for idx := range c.opts.FreshnessRules {
+		if c.opts.FreshnessRules[idx].Path.MatchString(uri.Path) {
+			return &c.opts.FreshnessRules[idx]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package httpclient
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/benjaminschubert/locaccel/internal/httpclient/internal/httpcaching"
+)
+
+// StaleIfErrorPolicy controls when a stale response can be served instead of
+// an upstream error.
+//
+// See https://datatracker.ietf.org/doc/html/rfc5861#section-4
+type StaleIfErrorPolicy struct {
+	// MaxStaleness bounds for how long a response can have been stale, for
+	// responses that don't carry a stale-if-error directive. Unbounded if nil.
+	MaxStaleness *time.Duration
+	// StatusCodes are the upstream status codes considered as errors. Defaults
+	// to all 5xx and 429 when empty.
+	StatusCodes []int
+	// AllowMustRevalidate allows serving stale responses that require being
+	// revalidated, for example with must-revalidate. This goes against RFC 9111.
+	AllowMustRevalidate bool
+}
+
+func (p *StaleIfErrorPolicy) isError(statusCode int) bool {
+	if len(p.StatusCodes) == 0 {
+		return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+	}
+
+	return slices.Contains(p.StatusCodes, statusCode)
+}
+
+func (p *StaleIfErrorPolicy) allows(
+	cacheControl httpcaching.CacheControlResponseDirective,
+	staleness time.Duration,
+) bool {
+	if !p.AllowMustRevalidate &&
+		(cacheControl.MustRevalidate || cacheControl.ProxyRevalidate || cacheControl.NoCache) {
+		return false
+	}
+
+	if cacheControl.StaleIfError != 0 {
+		return staleness <= cacheControl.StaleIfError
+	}
+	return p.MaxStaleness == nil || staleness <= *p.MaxStaleness
+}
+
+// markServedStale flags a response served stale because upstream failed. Its
+// Cache-Status tells the request was forwarded, and how upstream answered.
+//
+// See https://datatracker.ietf.org/doc/html/rfc7234#section-5.5.2
+// See https://datatracker.ietf.org/doc/html/rfc9211
+func markServedStale(req *http.Request, resp, upstreamResp *http.Response) {
+	resp.Header.Add("Warning", `111 - "Revalidation Failed"`)
+
+	setCacheStatus(req, func(status *cacheStatus) {
+		status.servedStale = true
+		if upstreamResp != nil {
+			status.fwdStatus = upstreamResp.StatusCode
+		}
+	})
+}
+
+// markServedOffline flags a stale response served because upstream cannot be
+// contacted.
+//
+// See https://datatracker.ietf.org/doc/html/rfc7234#section-5.5.3
+func markServedOffline(req *http.Request, resp *http.Response) {
+	resp.Header.Add("Warning", `112 - "Disconnected Operation"`)
+
+	setCacheStatus(req, func(status *cacheStatus) {
+		status.servedStale = true
+	})
+}
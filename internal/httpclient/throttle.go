@@ -0,0 +1,310 @@
+package httpclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxThrottledRead bounds how much is read from upstream at once when throttled,
+// which keeps the bandwidth smooth instead of alternating bursts and pauses
+const maxThrottledRead = 32 * 1024
+
+// Throttle limits the bandwidth used to download responses from upstream. It is
+// a token bucket, allowing bursts of up to a second worth of data.
+type Throttle struct {
+	mutex sync.Mutex
+	// rate is the number of bytes allowed per second
+	rate   float64
+	tokens float64
+	last   time.Time
+	parent *Throttle
+}
+
+// NewThrottle returns a throttle allowing the given number of bytes per second,
+// and whatever its parent allows, if it has one. A rate of 0 is unlimited.
+func NewThrottle(bytesPerSecond int64, parent *Throttle) *Throttle {
+	if bytesPerSecond <= 0 {
+		return parent
+	}
+
+	return &Throttle{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+		parent: parent,
+	}
+}
+
+// reserve takes the bytes from the bucket, and returns how long to wait until
+// they can be used
+func (t *Throttle) reserve(n int, now time.Time) time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	t.mutex.Lock()
+	t.tokens = min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens -= float64(n)
+
+	var delay time.Duration
+	if t.tokens < 0 {
+		delay = time.Duration(-t.tokens / t.rate * float64(time.Second))
+	}
+	t.mutex.Unlock()
+
+	return max(delay, t.parent.reserve(n, now))
+}
+
+// wait blocks until the bytes can be used, and returns how long it waited
+func (t *Throttle) wait(ctx context.Context, n int) (time.Duration, error) {
+	delay := t.reserve(n, time.Now())
+	if delay == 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return delay, ctx.Err()
+	}
+}
+
+// concurrencyLimiter bounds the number of requests in flight to each upstream.
+// Requests above the limit are queued until a previous one is done.
+type concurrencyLimiter struct {
+	limit int
+	mutex sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	return &concurrencyLimiter{limit: limit, slots: map[string]chan struct{}{}}
+}
+
+// acquire waits for a slot for the upstream, and returns a function to release
+// it, along with how long the request was queued
+func (l *concurrencyLimiter) acquire(
+	ctx context.Context,
+	upstream string,
+	stats *shapingStats,
+) (release func(), err error) {
+	if l == nil || l.limit <= 0 {
+		return func() {}, nil
+	}
+
+	l.mutex.Lock()
+	slots, ok := l.slots[upstream]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[upstream] = slots
+	}
+	l.mutex.Unlock()
+
+	release = func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	stats.queue(upstream, 1)
+	queuedAt := time.Now()
+	defer func() {
+		stats.queue(upstream, -1)
+		stats.recordQueued(upstream, time.Since(queuedAt))
+	}()
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// shapedBody is the body of a response from upstream, downloaded within the
+// bandwidth limits, and holding a slot of the upstream until it is closed
+type shapedBody struct {
+	io.ReadCloser
+
+	ctx      context.Context //nolint:containedctx
+	upstream string
+	throttle *Throttle
+	stats    *shapingStats
+	release  func()
+	once     sync.Once
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	if b.throttle != nil && len(p) > maxThrottledRead {
+		p = p[:maxThrottledRead]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.throttle != nil {
+		waited, wErr := b.throttle.wait(b.ctx, n)
+		b.stats.recordThrottled(b.upstream, waited)
+		if err == nil {
+			err = wErr
+		}
+	}
+	return n, err
+}
+
+func (b *shapedBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// upstreamHost returns the host the request is sent to, which is the upstream
+// cache when going through one acting as a proxy
+func upstreamHost(req *http.Request) string {
+	if proxy, ok := req.Context().Value(proxyCtx{}).(*url.URL); ok {
+		return proxy.Host
+	}
+	return req.URL.Host
+}
+
+// shapeTraffic waits for the request to be allowed to be sent to upstream. The
+// returned function applies the bandwidth limits to its response, and releases
+// the upstream once the response is closed, or immediately if it failed.
+func (c *Client) shapeTraffic(
+	req *http.Request,
+) (func(resp *http.Response, err error), error) {
+	upstream := upstreamHost(req)
+
+	release, err := c.concurrency.acquire(req.Context(), upstream, c.shaping)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(resp *http.Response, err error) {
+		if err != nil {
+			release()
+			return
+		}
+
+		resp.Body = &shapedBody{
+			ReadCloser: resp.Body,
+			ctx:        req.Context(),
+			upstream:   upstream,
+			throttle:   c.opts.Bandwidth,
+			stats:      c.shaping,
+			release:    release,
+		}
+	}, nil
+}
+
+type upstreamShaping struct {
+	throttled time.Duration
+	queued    time.Duration
+	waiting   int64
+}
+
+// shapingStats keeps track of how long requests to each upstream were delayed
+// by the bandwidth and concurrency limits
+type shapingStats struct {
+	mutex     sync.Mutex
+	upstreams map[string]*upstreamShaping
+}
+
+func newShapingStats() *shapingStats {
+	return &shapingStats{upstreams: map[string]*upstreamShaping{}}
+}
+
+func (s *shapingStats) update(upstream string, apply func(stats *upstreamShaping)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats, ok := s.upstreams[upstream]
+	if !ok {
+		stats = &upstreamShaping{}
+		s.upstreams[upstream] = stats
+	}
+	apply(stats)
+}
+
+func (s *shapingStats) recordThrottled(upstream string, duration time.Duration) {
+	if duration > 0 {
+		s.update(upstream, func(stats *upstreamShaping) { stats.throttled += duration })
+	}
+}
+
+func (s *shapingStats) recordQueued(upstream string, duration time.Duration) {
+	s.update(upstream, func(stats *upstreamShaping) { stats.queued += duration })
+}
+
+func (s *shapingStats) queue(upstream string, delta int64) {
+	s.update(upstream, func(stats *upstreamShaping) { stats.waiting += delta })
+}
+
+var (
+	upstreamThrottledDesc = prometheus.NewDesc(
+		"upstream_throttled_seconds_total",
+		"Time spent waiting for the bandwidth limits while downloading from upstream.",
+		[]string{"upstream"},
+		nil,
+	)
+	upstreamQueuedDesc = prometheus.NewDesc(
+		"upstream_queued_seconds_total",
+		"Time requests spent queued, waiting for the concurrency limit of upstream.",
+		[]string{"upstream"},
+		nil,
+	)
+	upstreamQueuedRequestsDesc = prometheus.NewDesc(
+		"upstream_queued_requests",
+		"Number of requests currently queued, waiting for the concurrency limit of upstream.",
+		[]string{"upstream"},
+		nil,
+	)
+)
+
+func (s *shapingStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamThrottledDesc
+	ch <- upstreamQueuedDesc
+	ch <- upstreamQueuedRequestsDesc
+}
+
+func (s *shapingStats) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for upstream, stats := range s.upstreams {
+		ch <- prometheus.MustNewConstMetric(
+			upstreamThrottledDesc,
+			prometheus.CounterValue,
+			stats.throttled.Seconds(),
+			upstream,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			upstreamQueuedDesc,
+			prometheus.CounterValue,
+			stats.queued.Seconds(),
+			upstream,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			upstreamQueuedRequestsDesc,
+			prometheus.GaugeValue,
+			float64(stats.waiting),
+			upstream,
+		)
+	}
+}
+
+// TrafficShapingCollector returns a collector exposing how long requests to
+// upstream were delayed by the bandwidth and concurrency limits
+func (c *Client) TrafficShapingCollector() prometheus.Collector {
+	return c.shaping
+}
@@ -61,6 +61,10 @@ func newLoggingMiddleware(
 			statistics.BytesDownloaded.Add(uint64(size))
 		case "revalidated":
 			statistics.Revalidated.Add(1)
+		case "coalesced":
+			statistics.Coalesced.Add(1)
+		case "stale":
+			statistics.Stale.Add(1)
 		default:
 			panic("Unexpected cache state: " + cacheState)
 		}
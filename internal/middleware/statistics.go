@@ -16,6 +16,8 @@ type Statistics struct {
 	CacheMisses     atomic.Uint64
 	UnCacheable     atomic.Uint64
 	Revalidated     atomic.Uint64
+	Coalesced       atomic.Uint64
+	Stale           atomic.Uint64
 	BytesServed     atomic.Uint64
 	BytesDownloaded atomic.Uint64
 }
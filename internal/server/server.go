@@ -1,14 +1,19 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	stdlog "log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -53,58 +58,137 @@ func New(
 ) *Server {
 	srv := Server{logger: logger}
 
+	if metricsRegistry != nil {
+		metricsRegistry.MustRegister(client.UpstreamHealthCollector())
+		metricsRegistry.MustRegister(client.TrafficShapingCollector())
+	}
+
+	offline := newOfflineModes(conf, logger)
+	bandwidth := httpclient.NewThrottle(conf.HTTPClient.MaxBandwidth.Bytes, nil)
+
 	for _, proxy := range conf.AnsibleGalaxies {
 		srv.servers = append(
 			srv.servers,
-			setupGalaxy(conf, proxy, client, logger, metricsRegistry, statistics),
+			setupGalaxy(
+				conf,
+				proxy,
+				client,
+				offline.forRegistry(proxy.Port, proxy.Offline),
+				registryBandwidth(bandwidth, proxy.HTTPClient),
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	}
 	for _, proxy := range conf.GoProxies {
 		srv.servers = append(
 			srv.servers,
-			setupGoProxy(conf, proxy, client, logger, metricsRegistry, statistics),
+			setupGoProxy(
+				conf,
+				proxy,
+				client,
+				offline.forRegistry(proxy.Port, proxy.Offline),
+				registryBandwidth(bandwidth, proxy.HTTPClient),
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	}
 
 	for _, registry := range conf.OciRegistries {
 		srv.servers = append(
 			srv.servers,
-			setupOciRegistry(conf, registry, client, logger, metricsRegistry, statistics),
+			setupOciRegistry(
+				conf,
+				registry,
+				client,
+				offline.forRegistry(registry.Port, registry.Offline),
+				registryBandwidth(bandwidth, registry.HTTPClient),
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	}
 
 	for _, registry := range conf.PyPIRegistries {
 		srv.servers = append(
 			srv.servers,
-			setupPypiRegistry(conf, registry, client, logger, metricsRegistry, statistics),
+			setupPypiRegistry(
+				conf,
+				registry,
+				client,
+				offline.forRegistry(registry.Port, registry.Offline),
+				registryBandwidth(bandwidth, registry.HTTPClient),
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	}
 
 	for _, registry := range conf.NpmRegistries {
 		srv.servers = append(
 			srv.servers,
-			setupNpmRegistry(conf, registry, client, logger, metricsRegistry, statistics),
+			setupNpmRegistry(
+				conf,
+				registry,
+				client,
+				offline.forRegistry(registry.Port, registry.Offline),
+				registryBandwidth(bandwidth, registry.HTTPClient),
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	}
 
 	for _, proxy := range conf.Proxies {
 		srv.servers = append(
 			srv.servers,
-			setupProxy(conf, proxy, client, logger, metricsRegistry, statistics),
+			setupProxy(
+				conf,
+				proxy,
+				client,
+				offline.forRegistry(proxy.Port, proxy.Offline),
+				registryBandwidth(bandwidth, proxy.HTTPClient),
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	}
 
 	for _, registry := range conf.RubyGemRegistries {
 		srv.servers = append(
 			srv.servers,
-			setupRubyGemRegistry(conf, registry, client, logger, metricsRegistry, statistics),
+			setupRubyGemRegistry(
+				conf,
+				registry,
+				client,
+				offline.forRegistry(registry.Port, registry.Offline),
+				registryBandwidth(bandwidth, registry.HTTPClient),
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	}
 
 	if conf.AdminInterface != "" {
 		srv.servers = append(
 			srv.servers,
-			setupAdminInterface(conf, cache, logger, metricsRegistry, statistics),
+			setupAdminInterface(
+				conf,
+				client,
+				cache,
+				offline.OfflineModes,
+				logger,
+				metricsRegistry,
+				statistics,
+			),
 		)
 	} else if conf.EnableProfiling {
 		logger.Warn().Msg("Profiling requested, but the admin interface is disabled. Ignoring.")
@@ -168,18 +252,32 @@ func setupGalaxy(
 	conf *config.Config,
 	ansibleGalaxy config.AnsibleGalaxy,
 	client *httpclient.Client,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
 	logger *zerolog.Logger,
 	registry prometheus.Registerer,
 	statistics *middleware.Statistics,
 ) serverInfo {
 	serviceName := "galaxy[" + ansibleGalaxy.Upstream + "]"
 	log := logger.With().Str("service", serviceName).Logger()
+	httpConf := conf.HTTPClient.Merge(ansibleGalaxy.HTTPClient)
 
 	handler := http.NewServeMux()
 	galaxy.RegisterHandler(
 		ansibleGalaxy.Upstream,
 		handler,
-		client,
+		withOptions(
+			client,
+			ansibleGalaxy.Caching,
+			ansibleGalaxy.UpstreamCachesPolicy,
+			asPeerGroup(conf, ansibleGalaxy.Peers, ansibleGalaxy.Port, &log),
+			instanceName(conf, ansibleGalaxy.Port, &log),
+			httpConf,
+			offline,
+			bandwidth,
+			asCredentials(ansibleGalaxy.Upstream, ansibleGalaxy.Credentials, &log),
+			&log,
+		),
 		asURLs(ansibleGalaxy.UpstreamCaches),
 	)
 
@@ -187,7 +285,7 @@ func setupGalaxy(
 		fmt.Sprintf("%s:%d", conf.Host, ansibleGalaxy.Port),
 		handler,
 		serviceName,
-		conf,
+		httpConf.Timeout,
 		&log,
 		registry,
 		statistics,
@@ -198,19 +296,34 @@ func setupGoProxy(
 	conf *config.Config,
 	goProxy config.GoProxy,
 	client *httpclient.Client,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
 	logger *zerolog.Logger,
 	registry prometheus.Registerer,
 	statistics *middleware.Statistics,
 ) serverInfo {
 	serviceName := "go[" + goProxy.Upstream + "]"
 	log := logger.With().Str("service", serviceName).Logger()
+	httpConf := conf.HTTPClient.Merge(goProxy.HTTPClient)
 
 	handler := http.NewServeMux()
 	goproxy.RegisterHandler(
 		goProxy.Upstream,
 		goProxy.SumDBURL,
+		cmp.Or(goProxy.SumDBKey, goproxy.DefaultSumDBKey),
 		handler,
-		client,
+		withOptions(
+			client,
+			goProxy.Caching,
+			goProxy.UpstreamCachesPolicy,
+			asPeerGroup(conf, goProxy.Peers, goProxy.Port, &log),
+			instanceName(conf, goProxy.Port, &log),
+			httpConf,
+			offline,
+			bandwidth,
+			asCredentials(goProxy.Upstream, goProxy.Credentials, &log),
+			&log,
+		),
 		asURLs(goProxy.UpstreamCaches),
 	)
 
@@ -218,7 +331,7 @@ func setupGoProxy(
 		fmt.Sprintf("%s:%d", conf.Host, goProxy.Port),
 		handler,
 		serviceName,
-		conf,
+		httpConf.Timeout,
 		&log,
 		registry,
 		statistics,
@@ -229,21 +342,40 @@ func setupOciRegistry(
 	conf *config.Config,
 	registry config.OciRegistry,
 	client *httpclient.Client,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
 	logger *zerolog.Logger,
 	metricsRegistry prometheus.Registerer,
 	statistics *middleware.Statistics,
 ) serverInfo {
 	serviceName := "oci[" + registry.Upstream + "]"
 	log := logger.With().Str("service", serviceName).Logger()
+	httpConf := conf.HTTPClient.Merge(registry.HTTPClient)
 
 	handler := http.NewServeMux()
-	oci.RegisterHandler(registry.Upstream, handler, client, asURLs(registry.UpstreamCaches))
+	oci.RegisterHandler(
+		registry.Upstream,
+		handler,
+		withOptions(
+			client,
+			registry.Caching,
+			registry.UpstreamCachesPolicy,
+			asPeerGroup(conf, registry.Peers, registry.Port, &log),
+			instanceName(conf, registry.Port, &log),
+			httpConf,
+			offline,
+			bandwidth,
+			asCredentials(registry.Upstream, registry.Credentials, &log),
+			&log,
+		),
+		asURLs(registry.UpstreamCaches),
+	)
 
 	return createServer(
 		fmt.Sprintf("%s:%d", conf.Host, registry.Port),
 		handler,
 		serviceName,
-		conf,
+		httpConf.Timeout,
 		&log,
 		metricsRegistry,
 		statistics,
@@ -254,19 +386,33 @@ func setupPypiRegistry(
 	conf *config.Config,
 	registry config.PyPIRegistry,
 	client *httpclient.Client,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
 	logger *zerolog.Logger,
 	metricsRegistry prometheus.Registerer,
 	statistics *middleware.Statistics,
 ) serverInfo {
 	serviceName := "pypi[" + registry.Upstream + "]"
 	log := logger.With().Str("service", serviceName).Logger()
+	httpConf := conf.HTTPClient.Merge(registry.HTTPClient)
 
 	handler := http.NewServeMux()
 	pypi.RegisterHandler(
 		registry.Upstream,
 		registry.CDN,
 		handler,
-		client,
+		withOptions(
+			client,
+			registry.Caching,
+			registry.UpstreamCachesPolicy,
+			asPeerGroup(conf, registry.Peers, registry.Port, &log),
+			instanceName(conf, registry.Port, &log),
+			httpConf,
+			offline,
+			bandwidth,
+			asCredentials(registry.Upstream, registry.Credentials, &log),
+			&log,
+		),
 		asURLs(registry.UpstreamCaches),
 	)
 
@@ -274,7 +420,7 @@ func setupPypiRegistry(
 		fmt.Sprintf("%s:%d", conf.Host, registry.Port),
 		handler,
 		serviceName,
-		conf,
+		httpConf.Timeout,
 		&log,
 		metricsRegistry,
 		statistics,
@@ -285,19 +431,33 @@ func setupNpmRegistry(
 	conf *config.Config,
 	registry config.NpmRegistry,
 	client *httpclient.Client,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
 	logger *zerolog.Logger,
 	metricsRegistry prometheus.Registerer,
 	statistics *middleware.Statistics,
 ) serverInfo {
 	serviceName := "npm[" + registry.Upstream + "]"
 	log := logger.With().Str("service", serviceName).Logger()
+	httpConf := conf.HTTPClient.Merge(registry.HTTPClient)
 
 	handler := http.NewServeMux()
 	npm.RegisterHandler(
 		registry.Upstream,
 		registry.Scheme,
 		handler,
-		client,
+		withOptions(
+			client,
+			registry.Caching,
+			registry.UpstreamCachesPolicy,
+			asPeerGroup(conf, registry.Peers, registry.Port, &log),
+			instanceName(conf, registry.Port, &log),
+			httpConf,
+			offline,
+			bandwidth,
+			asCredentials(registry.Upstream, registry.Credentials, &log),
+			&log,
+		),
 		asURLs(registry.UpstreamCaches),
 	)
 
@@ -305,7 +465,7 @@ func setupNpmRegistry(
 		fmt.Sprintf("%s:%d", conf.Host, registry.Port),
 		handler,
 		serviceName,
-		conf,
+		httpConf.Timeout,
 		&log,
 		metricsRegistry,
 		statistics,
@@ -316,18 +476,32 @@ func setupProxy(
 	conf *config.Config,
 	proxyConf config.Proxy,
 	client *httpclient.Client,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
 	logger *zerolog.Logger,
 	registry prometheus.Registerer,
 	statistics *middleware.Statistics,
 ) serverInfo {
 	serviceName := "proxy"
 	log := logger.With().Str("service", serviceName).Logger()
+	httpConf := conf.HTTPClient.Merge(proxyConf.HTTPClient)
 
 	handler := http.NewServeMux()
 	proxy.RegisterHandler(
 		proxyConf.AllowedUpstreams,
 		handler,
-		client,
+		withOptions(
+			client,
+			proxyConf.Caching,
+			proxyConf.UpstreamCachesPolicy,
+			asPeerGroup(conf, proxyConf.Peers, proxyConf.Port, &log),
+			instanceName(conf, proxyConf.Port, &log),
+			httpConf,
+			offline,
+			bandwidth,
+			nil,
+			&log,
+		),
 		asURLs(proxyConf.UpstreamCaches),
 	)
 
@@ -335,7 +509,7 @@ func setupProxy(
 		fmt.Sprintf("%s:%d", conf.Host, proxyConf.Port),
 		handler,
 		serviceName,
-		conf,
+		httpConf.Timeout,
 		&log,
 		registry,
 		statistics,
@@ -346,18 +520,32 @@ func setupRubyGemRegistry(
 	conf *config.Config,
 	registry config.RubyGemRegistry,
 	client *httpclient.Client,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
 	logger *zerolog.Logger,
 	metricsRegistry prometheus.Registerer,
 	statistics *middleware.Statistics,
 ) serverInfo {
 	serviceName := "rubygem[" + registry.Upstream + "]"
 	log := logger.With().Str("service", serviceName).Logger()
+	httpConf := conf.HTTPClient.Merge(registry.HTTPClient)
 
 	handler := http.NewServeMux()
 	rubygem.RegisterHandler(
 		registry.Upstream,
 		handler,
-		client,
+		withOptions(
+			client,
+			registry.Caching,
+			registry.UpstreamCachesPolicy,
+			asPeerGroup(conf, registry.Peers, registry.Port, &log),
+			instanceName(conf, registry.Port, &log),
+			httpConf,
+			offline,
+			bandwidth,
+			asCredentials(registry.Upstream, registry.Credentials, &log),
+			&log,
+		),
 		asURLs(registry.UpstreamCaches),
 	)
 
@@ -365,7 +553,7 @@ func setupRubyGemRegistry(
 		fmt.Sprintf("%s:%d", conf.Host, registry.Port),
 		handler,
 		serviceName,
-		conf,
+		httpConf.Timeout,
 		&log,
 		metricsRegistry,
 		statistics,
@@ -374,7 +562,9 @@ func setupRubyGemRegistry(
 
 func setupAdminInterface(
 	conf *config.Config,
+	client *httpclient.Client,
 	cache *httpclient.Cache,
+	offline httpclient.OfflineModes,
 	logger *zerolog.Logger,
 	registry interface {
 		prometheus.Registerer
@@ -404,7 +594,14 @@ func setupAdminInterface(
 
 	}
 
-	if err := admin.RegisterHandler(handler, cache, conf, statistics); err != nil {
+	if err := admin.RegisterHandler(
+		handler,
+		cache,
+		client,
+		offline,
+		conf,
+		statistics,
+	); err != nil {
 		logger.Panic().Err(err).Msg("unable to initialize server properly")
 	}
 
@@ -413,7 +610,7 @@ func setupAdminInterface(
 		conf.AdminInterface,
 		handler,
 		serviceName,
-		conf,
+		conf.HTTPClient.Timeout,
 		&log,
 		registry,
 		&middleware.Statistics{},
@@ -424,7 +621,7 @@ func createServer(
 	address string,
 	handler *http.ServeMux,
 	serviceName string,
-	conf *config.Config,
+	timeout time.Duration,
 	log *zerolog.Logger,
 	registry prometheus.Registerer,
 	statistics *middleware.Statistics,
@@ -442,13 +639,220 @@ func createServer(
 				statistics,
 			),
 			ReadTimeout:  10 * time.Second,
-			WriteTimeout: conf.HTTPClient.Timeout + 10*time.Second,
+			WriteTimeout: timeout + 10*time.Second,
 			ErrorLog:     stdlog.New(log, "", 0),
 		},
 		log,
 	}
 }
 
+// offlineModes are the offline modes of the registries, indexed by the port they
+// are served on
+type offlineModes struct {
+	httpclient.OfflineModes
+
+	logger *zerolog.Logger
+}
+
+func newOfflineModes(conf *config.Config, logger *zerolog.Logger) offlineModes {
+	if conf.Offline {
+		logger.Warn().Msg("Running offline, upstreams will not be contacted")
+	}
+
+	return offlineModes{
+		httpclient.OfflineModes{
+			Global:     httpclient.NewOfflineMode(conf.Offline, nil),
+			Registries: map[string]*httpclient.OfflineMode{},
+		},
+		logger,
+	}
+}
+
+func (m offlineModes) forRegistry(port uint16, enabled bool) *httpclient.OfflineMode {
+	name := strconv.FormatUint(uint64(port), 10)
+	if enabled {
+		m.logger.Warn().Str("registry", name).Msg("Running registry offline")
+	}
+
+	mode := httpclient.NewOfflineMode(enabled, m.Global)
+	m.Registries[name] = mode
+	return mode
+}
+
+func withOptions(
+	client *httpclient.Client,
+	caching config.Caching,
+	upstreamCachesPolicy config.UpstreamCachesPolicy,
+	peerGroup httpclient.PeerGroup,
+	name string,
+	httpConf config.HTTPClient,
+	offline *httpclient.OfflineMode,
+	bandwidth *httpclient.Throttle,
+	credentials *httpclient.Credentials,
+	logger *zerolog.Logger,
+) *httpclient.Client {
+	httpClient, err := NewHTTPClient(httpConf)
+	if err != nil {
+		logger.Panic().Err(err).Msg("unable to configure the http client")
+	}
+
+	return client.WithHTTPClient(httpClient).WithOptions(httpclient.Options{
+		StaleWhileRevalidate: caching.StaleWhileRevalidate,
+		StaleIfError: httpclient.StaleIfErrorPolicy{
+			MaxStaleness:        caching.StaleIfError.MaxAge,
+			StatusCodes:         caching.StaleIfError.StatusCodes,
+			AllowMustRevalidate: caching.StaleIfError.AllowMustRevalidate,
+		},
+		IgnoreClientNoCache:          caching.IgnoreClientNoCache,
+		NegativeTTL:                  caching.NegativeTTL,
+		PartitionByAuthorization:     caching.PartitionByAuthorization,
+		VerifyDigests:                caching.VerifyDigests,
+		FreshnessRules:               asFreshnessRules(caching.Rules),
+		HedgingDelay:                 upstreamCachesPolicy.HedgingDelay,
+		OrderUpstreamCachesByLatency: upstreamCachesPolicy.OrderByLatency,
+		PeerGroup:                    peerGroup,
+		Name:                         name,
+		Retry: httpclient.RetryPolicy{
+			Attempts:       httpConf.Retry.Attempts,
+			StatusCodes:    httpConf.Retry.StatusCodes,
+			InitialBackoff: httpConf.Retry.InitialBackoff,
+			MaxBackoff:     httpConf.Retry.MaxBackoff,
+			Budget:         httpConf.Retry.Budget,
+		},
+		Offline:               offline,
+		Credentials:           credentials,
+		Bandwidth:             bandwidth,
+		MaxConcurrentRequests: httpConf.MaxConcurrentRequests,
+	})
+}
+
+// registryBandwidth returns the bandwidth limit of a registry, which is applied
+// on top of the global one
+func registryBandwidth(
+	global *httpclient.Throttle,
+	conf *config.HTTPClientOverride,
+) *httpclient.Throttle {
+	if conf == nil {
+		return global
+	}
+	return httpclient.NewThrottle(conf.MaxBandwidth.Bytes, global)
+}
+
+// asCredentials reads the secrets of the credentials, which are only sent to the
+// host of the upstream
+func asCredentials(
+	upstream string,
+	credentials *config.Credentials,
+	logger *zerolog.Logger,
+) *httpclient.Credentials {
+	if credentials == nil {
+		return nil
+	}
+
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		logger.Panic().Err(err).Msg("invalid upstream url")
+	}
+
+	password, err := credentials.Password.Read(os.LookupEnv)
+	if err != nil {
+		logger.Panic().Err(err).Msg("unable to read the credentials for upstream")
+	}
+
+	kind := httpclient.BasicCredentials
+	switch credentials.Type {
+	case config.BasicCredentials:
+	case config.BearerCredentials:
+		kind = httpclient.BearerCredentials
+	case config.OCICredentials:
+		kind = httpclient.OCITokenCredentials
+	}
+
+	logger.Info().
+		Str("type", string(credentials.Type)).
+		Str("host", upstreamURL.Host).
+		Msg("Authenticating requests to upstream")
+	return httpclient.NewCredentials(
+		kind,
+		upstreamURL.Host,
+		credentials.Username,
+		password,
+		credentials.TokenRealms,
+	)
+}
+
+// hostname returns the name under which the other peers know this instance
+func hostname(conf *config.Config, logger *zerolog.Logger) string {
+	if conf.PeerName != "" {
+		return conf.PeerName
+	}
+
+	name, err := os.Hostname()
+	if err != nil {
+		logger.Warn().Err(err).Msg("Unable to get the hostname, set peer_name instead")
+		return conf.Host
+	}
+	return name
+}
+
+// instanceName identifies the registry served on the port by this instance, in
+// the Cache-Status and Via headers
+func instanceName(conf *config.Config, port uint16, logger *zerolog.Logger) string {
+	return net.JoinHostPort(hostname(conf, logger), strconv.FormatUint(uint64(port), 10))
+}
+
+// asPeerGroup finds which of the peers is this instance, from the names it is
+// known under and the port of the registry
+func asPeerGroup(
+	conf *config.Config,
+	peers []config.SerializableURL,
+	port uint16,
+	logger *zerolog.Logger,
+) httpclient.PeerGroup {
+	group := httpclient.PeerGroup{Peers: asURLs(peers)}
+	if len(group.Peers) == 0 {
+		return group
+	}
+
+	names := []string{"localhost", conf.Host, hostname(conf, logger)}
+
+	for _, peer := range group.Peers {
+		if peer.Port() != strconv.FormatUint(uint64(port), 10) {
+			continue
+		}
+
+		peerHost := peer.Hostname()
+		ip := net.ParseIP(peerHost)
+		if (ip != nil && ip.IsLoopback()) || slices.ContainsFunc(names, func(name string) bool {
+			return name != "" && strings.EqualFold(name, peerHost)
+		}) {
+			group.Self = peer
+			break
+		}
+	}
+
+	if group.Self == nil {
+		logger.Info().Msg("This instance is not part of its peers, requests are only forwarded")
+	} else {
+		logger.Info().Stringer("self", group.Self).Msg("Sharding requests across peers")
+	}
+
+	return group
+}
+
+func asFreshnessRules(rules []config.FreshnessRule) []httpclient.FreshnessRule {
+	freshnessRules := make([]httpclient.FreshnessRule, len(rules))
+	for i, rule := range rules {
+		freshnessRules[i] = httpclient.FreshnessRule{
+			Path:      rule.Matcher(),
+			TTL:       rule.TTL,
+			Immutable: rule.Immutable,
+			NoStore:   rule.NoStore,
+		}
+	}
+	return freshnessRules
+}
+
 func asURLs(sURLs []config.SerializableURL) []*url.URL {
 	urls := make([]*url.URL, len(sURLs))
 	for i, url := range sURLs {
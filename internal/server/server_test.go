@@ -1,11 +1,15 @@
 package server
 
 import (
+	"net/http"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/benjaminschubert/locaccel/internal/config"
+	"github.com/benjaminschubert/locaccel/internal/httpclient"
 	"github.com/benjaminschubert/locaccel/internal/middleware"
 	"github.com/benjaminschubert/locaccel/internal/testutils"
 )
@@ -18,7 +22,16 @@ func TestServerInitialization(t *testing.T) {
 	conf, err := config.Default(func(s string) (string, bool) { return "", false })
 	require.NoError(t, err)
 	conf.EnableProfiling = true
-	srv := New(conf, nil, nil, logger, nil, &middleware.Statistics{})
+	client := httpclient.New(
+		&http.Client{Transport: &http.Transport{}},
+		nil,
+		logger,
+		false,
+		middleware.SetCacheState,
+		time.Now,
+		time.Since,
+	)
+	srv := New(conf, client, nil, logger, nil, &middleware.Statistics{})
 
 	require.Len(t, srv.servers, 11)
 
@@ -44,3 +57,70 @@ func TestServerInitialization(t *testing.T) {
 		addresses,
 	)
 }
+
+func TestPeerGroupSkipsSelf(t *testing.T) {
+	t.Parallel()
+
+	peers := func(uris ...string) []config.SerializableURL {
+		result := make([]config.SerializableURL, 0, len(uris))
+		for _, uri := range uris {
+			parsed, err := url.Parse(uri)
+			require.NoError(t, err)
+			result = append(result, config.SerializableURL{URL: parsed})
+		}
+		return result
+	}
+
+	testCases := []struct {
+		name         string
+		peerName     string
+		peers        []config.SerializableURL
+		expectedSelf string
+	}{
+		{"no-peers", "cache-1", nil, ""},
+		{
+			"peer-name",
+			"cache-2",
+			peers("http://cache-1:3131", "http://CACHE-2:3131"),
+			"http://CACHE-2:3131",
+		},
+		{
+			"other-port",
+			"cache-2",
+			peers("http://cache-1:3131", "http://cache-2:3132"),
+			"",
+		},
+		{
+			"loopback",
+			"cache-2",
+			peers("http://cache-1:3131", "http://127.0.0.1:3131"),
+			"http://127.0.0.1:3131",
+		},
+		{
+			"not-a-member",
+			"cache-3",
+			peers("http://cache-1:3131", "http://cache-2:3131"),
+			"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf, err := config.Default(func(s string) (string, bool) { return "", false })
+			require.NoError(t, err)
+			conf.PeerName = tc.peerName
+
+			group := asPeerGroup(conf, tc.peers, 3131, testutils.TestLogger(t, nil))
+			require.Len(t, group.Peers, len(tc.peers))
+
+			if tc.expectedSelf == "" {
+				require.Nil(t, group.Self)
+			} else {
+				require.NotNil(t, group.Self)
+				require.Equal(t, tc.expectedSelf, group.Self.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/benjaminschubert/locaccel/internal/config"
+)
+
+func writePEM(t *testing.T, blockType string, content []byte) string {
+	t.Helper()
+
+	file := path.Join(t.TempDir(), "file.pem")
+	require.NoError(
+		t,
+		os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: content}), 0o600),
+	)
+	return file
+}
+
+func get(t *testing.T, client *http.Client, url string) error {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	return nil
+}
+
+func TestHTTPClientTrustsConfiguredCABundle(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	client, err := NewHTTPClient(config.HTTPClient{})
+	require.NoError(t, err)
+	var certErr *tls.CertificateVerificationError
+	require.ErrorAs(t, get(t, client, srv.URL), &certErr)
+
+	client, err = NewHTTPClient(config.HTTPClient{
+		TLS: config.TLS{CABundle: writePEM(t, "CERTIFICATE", srv.Certificate().Raw)},
+	})
+	require.NoError(t, err)
+	require.NoError(t, get(t, client, srv.URL))
+
+	client, err = NewHTTPClient(config.HTTPClient{TLS: config.TLS{InsecureSkipVerify: true}})
+	require.NoError(t, err)
+	require.NoError(t, get(t, client, srv.URL))
+}
+
+func TestHTTPClientRejectsInvalidCABundle(t *testing.T) {
+	t.Parallel()
+
+	bundle := path.Join(t.TempDir(), "bundle.pem")
+	require.NoError(t, os.WriteFile(bundle, []byte("not a certificate"), 0o600))
+
+	_, err := NewHTTPClient(config.HTTPClient{TLS: config.TLS{CABundle: bundle}})
+	require.ErrorIs(t, err, ErrInvalidCABundle)
+}
+
+func TestHTTPClientAuthenticatesWithClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MinVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caBundle := writePEM(t, "CERTIFICATE", srv.Certificate().Raw)
+
+	client, err := NewHTTPClient(config.HTTPClient{TLS: config.TLS{CABundle: caBundle}})
+	require.NoError(t, err)
+	require.Error(t, get(t, client, srv.URL))
+
+	// Reuse the certificate of the server, which is trusted anyway
+	key, err := x509.MarshalPKCS8PrivateKey(srv.TLS.Certificates[0].PrivateKey)
+	require.NoError(t, err)
+
+	client, err = NewHTTPClient(config.HTTPClient{
+		TLS: config.TLS{
+			CABundle:   caBundle,
+			ClientCert: caBundle,
+			ClientKey:  writePEM(t, "PRIVATE KEY", key),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, get(t, client, srv.URL))
+}
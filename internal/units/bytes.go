@@ -70,6 +70,10 @@ func DecodeBytes(value string) (Bytes, error) {
 	return Bytes{}, fmt.Errorf("%s: %w", ErrInvalidByteFormat, err)
 }
 
+func (b Bytes) MarshalYAML() (any, error) {
+	return b.String(), nil
+}
+
 func (b Bytes) String() string {
 	return PrettyBytes(b.Bytes)
 }